@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Policy is what an API key is allowed to do.
+type Policy struct {
+	Name string
+	Key  string
+	// RateLimit and RateLimitBurst override the global rate limit for the
+	// key, in compute units. Zero keeps the global limit.
+	RateLimit      float64
+	RateLimitBurst int
+	// AllowedNamespaces lists the method namespaces (the part before the
+	// first underscore, e.g. "eth") the key may call. Empty allows all.
+	AllowedNamespaces []string
+	// AllowedOrigins lists the browser origins the key may be used from.
+	// Entries may be "*" or use a leading wildcard such as
+	// "https://*.example.com". Empty allows all.
+	AllowedOrigins []string
+}
+
+// AllowsMethod reports whether the key may call method.
+func (p *Policy) AllowsMethod(method string) bool {
+	if len(p.AllowedNamespaces) == 0 {
+		return true
+	}
+	namespace, _, _ := strings.Cut(method, "_")
+	for _, ns := range p.AllowedNamespaces {
+		if ns == namespace || ns == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsOrigin reports whether the key may be used from origin. Requests
+// without an Origin header are not sent by browsers and always allowed.
+func (p *Policy) AllowsOrigin(origin string) bool {
+	if origin == "" || len(p.AllowedOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+		if prefix, suffix, ok := strings.Cut(allowed, "*"); ok &&
+			len(origin) > len(prefix)+len(suffix) &&
+			strings.HasPrefix(strings.ToLower(origin), strings.ToLower(prefix)) &&
+			strings.HasSuffix(strings.ToLower(origin), strings.ToLower(suffix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator resolves the API key of a request to its policy. Keys are
+// read from a header, a query parameter or a /v1/<key> path prefix.
+type Authenticator struct {
+	header     string
+	queryParam string
+	pathPrefix bool
+	keys       map[string]*Policy
+}
+
+var ErrNoKeys = errors.New("no API keys configured")
+
+func New(header, queryParam string, pathPrefix bool, policies []Policy) (*Authenticator, error) {
+	if len(policies) == 0 {
+		return nil, ErrNoKeys
+	}
+
+	keys := make(map[string]*Policy, len(policies))
+	for i := range policies {
+		p := policies[i]
+		if p.Key == "" {
+			return nil, fmt.Errorf("API key %q is empty", p.Name)
+		}
+		if _, ok := keys[p.Key]; ok {
+			return nil, fmt.Errorf("API key %q is configured twice", p.Name)
+		}
+		keys[p.Key] = &p
+	}
+
+	return &Authenticator{
+		header:     header,
+		queryParam: queryParam,
+		pathPrefix: pathPrefix,
+		keys:       keys,
+	}, nil
+}
+
+// AllowsOrigin reports whether any key may be used from origin.
+func (a *Authenticator) AllowsOrigin(origin string) bool {
+	for _, p := range a.keys {
+		if p.AllowsOrigin(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate returns the policy of the request's API key and the request
+// path with a /v1/<key> prefix removed. It returns false if the request
+// carries no key or an unknown one.
+func (a *Authenticator) Authenticate(r *http.Request) (*Policy, string, bool) {
+	path := r.URL.Path
+	key := ""
+
+	if a.header != "" {
+		key = r.Header.Get(a.header)
+	}
+	if key == "" && a.queryParam != "" {
+		key = r.URL.Query().Get(a.queryParam)
+	}
+	if a.pathPrefix {
+		if rest, ok := strings.CutPrefix(path, "/v1/"); ok {
+			pathKey, remainder, _ := strings.Cut(rest, "/")
+			if unescaped, err := url.PathUnescape(pathKey); err == nil && key == "" {
+				key = unescaped
+			}
+			path = "/" + remainder
+		}
+	}
+
+	if key == "" {
+		return nil, path, false
+	}
+	policy, ok := a.keys[key]
+	return policy, path, ok
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the policy of an authenticated
+// request.
+func NewContext(ctx context.Context, p *Policy) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the policy of an authenticated request, if any.
+func FromContext(ctx context.Context) (*Policy, bool) {
+	p, ok := ctx.Value(contextKey{}).(*Policy)
+	return p, ok
+}
@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticator_Authenticate(t *testing.T) {
+	a, err := New("X-API-Key", "apikey", true, []Policy{
+		{Name: "indexer", Key: "secret-1"},
+		{Name: "frontend", Key: "secret-2"},
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		target   string
+		header   string
+		wantName string
+		wantPath string
+		wantOK   bool
+	}{
+		{name: "header", target: "/", header: "secret-1", wantName: "indexer", wantPath: "/", wantOK: true},
+		{name: "query param", target: "/?apikey=secret-2", wantName: "frontend", wantPath: "/", wantOK: true},
+		{name: "path prefix", target: "/v1/secret-1", wantName: "indexer", wantPath: "/", wantOK: true},
+		{name: "path prefix with rest", target: "/v1/secret-2/ws", wantName: "frontend", wantPath: "/ws", wantOK: true},
+		{name: "missing key", target: "/", wantPath: "/", wantOK: false},
+		{name: "unknown key", target: "/", header: "nope", wantPath: "/", wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.target, nil)
+			if tt.header != "" {
+				req.Header.Set("X-API-Key", tt.header)
+			}
+
+			policy, path, ok := a.Authenticate(req)
+			if ok != tt.wantOK {
+				t.Fatalf("Authenticate() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if path != tt.wantPath {
+				t.Errorf("path = %q, want %q", path, tt.wantPath)
+			}
+			if ok && policy.Name != tt.wantName {
+				t.Errorf("policy = %q, want %q", policy.Name, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestNew_Errors(t *testing.T) {
+	if _, err := New("X-API-Key", "", false, nil); err != ErrNoKeys {
+		t.Errorf("New() without keys error = %v, want ErrNoKeys", err)
+	}
+	if _, err := New("X-API-Key", "", false, []Policy{{Name: "a", Key: "k"}, {Name: "b", Key: "k"}}); err == nil {
+		t.Error("New() with a duplicate key succeeded")
+	}
+	if _, err := New("X-API-Key", "", false, []Policy{{Name: "a"}}); err == nil {
+		t.Error("New() with an empty key succeeded")
+	}
+}
+
+func TestPolicy_AllowsMethod(t *testing.T) {
+	p := &Policy{AllowedNamespaces: []string{"eth", "net"}}
+
+	for method, want := range map[string]bool{
+		"eth_call":               true,
+		"net_version":            true,
+		"debug_traceTransaction": false,
+		"admin_addPeer":          false,
+		"ethx_call":              false,
+	} {
+		if got := p.AllowsMethod(method); got != want {
+			t.Errorf("AllowsMethod(%q) = %v, want %v", method, got, want)
+		}
+	}
+
+	if !(&Policy{}).AllowsMethod("debug_traceTransaction") {
+		t.Error("policy without namespaces should allow every method")
+	}
+}
+
+func TestPolicy_AllowsOrigin(t *testing.T) {
+	p := &Policy{AllowedOrigins: []string{"https://app.example.com", "https://*.example.org"}}
+
+	for origin, want := range map[string]bool{
+		"":                        true,
+		"https://app.example.com": true,
+		"https://APP.example.com": true,
+		"https://a.example.org":   true,
+		"https://example.org":     false,
+		"https://evil.com":        false,
+	} {
+		if got := p.AllowsOrigin(origin); got != want {
+			t.Errorf("AllowsOrigin(%q) = %v, want %v", origin, got, want)
+		}
+	}
+}
+
+func TestAuthenticator_AllowsOrigin(t *testing.T) {
+	a, err := New("X-API-Key", "", false, []Policy{
+		{Name: "a", Key: "ka", AllowedOrigins: []string{"https://a.example.com"}},
+		{Name: "b", Key: "kb", AllowedOrigins: []string{"https://b.example.com"}},
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	for origin, want := range map[string]bool{
+		"https://a.example.com": true,
+		"https://b.example.com": true,
+		"https://evil.com":      false,
+	} {
+		if got := a.AllowsOrigin(origin); got != want {
+			t.Errorf("AllowsOrigin(%q) = %v, want %v", origin, got, want)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	if _, ok := FromContext(context.Background()); ok {
+		t.Error("FromContext() found a policy in an empty context")
+	}
+
+	p := &Policy{Name: "indexer"}
+	got, ok := FromContext(NewContext(context.Background(), p))
+	if !ok || got != p {
+		t.Errorf("FromContext() = %v, %v, want the stored policy", got, ok)
+	}
+}
@@ -0,0 +1,214 @@
+package cache
+
+import (
+	"container/list"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/devlongs/geth-relay/chain"
+)
+
+// Cache is an LRU cache of JSON-RPC results for deterministic methods.
+// Results at "latest" are dropped whenever a new head is observed, and at
+// the latest after latestTTL in case no head is observed. Results tied to a
+// block number are dropped when that block is reorged out.
+type Cache struct {
+	maxEntries int
+	latestTTL  time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	head    uint64
+	gen     uint64
+	safe    uint64
+
+	hits   uint64
+	misses uint64
+}
+
+type entry struct {
+	key     string
+	result  json.RawMessage
+	scope   scope
+	block   uint64
+	gen     uint64
+	expires time.Time
+}
+
+// Ticket is handed out on a cache miss and carries what Put needs to
+// store the result of the forwarded request.
+type Ticket struct {
+	key   string
+	scope scope
+	block uint64
+	gen   uint64
+}
+
+// Stats is a snapshot of the cache counters.
+type Stats struct {
+	Entries int
+	Hits    uint64
+	Misses  uint64
+}
+
+func New(maxEntries int, latestTTL time.Duration) *Cache {
+	return &Cache{
+		maxEntries: maxEntries,
+		latestTTL:  latestTTL,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Get looks up a request. On a hit it returns the cached result. On a miss
+// for a cacheable request it returns a ticket to pass to Put once the
+// upstream answered; both are nil for requests that cannot be cached.
+func (c *Cache) Get(method string, params json.RawMessage) (json.RawMessage, *Ticket) {
+	decoded, canonical, ok := canonicalParams(params)
+	if !ok {
+		return nil, nil
+	}
+	sc, block, ok := classify(method, decoded)
+	if !ok {
+		return nil, nil
+	}
+	key := method + ":" + canonical
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*entry)
+		if c.valid(e) {
+			c.lru.MoveToFront(el)
+			c.hits++
+			return e.result, nil
+		}
+		c.remove(el)
+	}
+	c.misses++
+
+	return nil, &Ticket{key: key, scope: sc, block: block, gen: c.gen}
+}
+
+// Put stores the result for a ticket returned by Get. Null results are not
+// cached since the data may simply not exist yet.
+func (c *Cache) Put(t *Ticket, result json.RawMessage) {
+	if t == nil || len(result) == 0 || string(result) == "null" {
+		return
+	}
+
+	e := &entry{key: t.key, result: result, scope: t.scope, block: t.block, gen: t.gen}
+	if t.scope == scopeResult {
+		block, ok := receiptBlock(result)
+		if !ok {
+			return
+		}
+		e.scope, e.block = scopeBlock, block
+	}
+	if e.scope == scopeLatest {
+		e.expires = time.Now().Add(c.latestTTL)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// A head observed while the request was in flight makes a latest result
+	// stale before it is even stored.
+	if e.scope == scopeLatest && e.gen != c.gen {
+		return
+	}
+
+	if el, ok := c.entries[t.key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[t.key] = c.lru.PushFront(e)
+
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+// ObserveHead records the block number of the chain head. A higher head
+// than previously seen invalidates every result cached at "latest".
+func (c *Cache) ObserveHead(number uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if number > c.head {
+		c.head = number
+		c.gen++
+	}
+}
+
+// Reorg evicts every result tied to a block above the common ancestor of a
+// reorg, together with all results at "latest", and returns the number of
+// evicted entries. Blocks at or below the safe block are never evicted.
+func (c *Cache) Reorg(commonAncestor uint64) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	from := max(commonAncestor, c.safe)
+	evicted := 0
+	for el := c.lru.Front(); el != nil; {
+		next := el.Next()
+		if e := el.Value.(*entry); e.scope == scopeBlock && e.block > from {
+			c.remove(el)
+			evicted++
+		}
+		el = next
+	}
+
+	c.head = commonAncestor
+	c.gen++
+	return evicted
+}
+
+// SetSafe records the latest safe (or finalized) block. Results for blocks
+// up to it can no longer be reorged out and are kept until evicted by LRU.
+func (c *Cache) SetSafe(number uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if number > c.safe {
+		c.safe = number
+	}
+}
+
+// Follow applies the events of a chain tracker to the cache until the
+// channel is closed.
+func (c *Cache) Follow(events <-chan chain.Event) {
+	for ev := range events {
+		switch ev.Type {
+		case chain.EventNewHead:
+			c.ObserveHead(ev.Head.Number)
+		case chain.EventReorg:
+			c.Reorg(ev.Reorg.CommonAncestor)
+		case chain.EventFinalized:
+			c.SetSafe(max(ev.Safe, ev.Finalized))
+		}
+	}
+}
+
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Stats{Entries: c.lru.Len(), Hits: c.hits, Misses: c.misses}
+}
+
+func (c *Cache) valid(e *entry) bool {
+	if e.scope != scopeLatest {
+		return true
+	}
+	return e.gen == c.gen && time.Now().Before(e.expires)
+}
+
+func (c *Cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*entry)
+	delete(c.entries, e.key)
+}
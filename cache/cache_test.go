@@ -0,0 +1,178 @@
+package cache
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/devlongs/geth-relay/chain"
+)
+
+func TestCache_GetPut(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		params    string
+		cacheable bool
+	}{
+		{name: "chain id", method: "eth_chainId", params: `[]`, cacheable: true},
+		{name: "net version", method: "net_version", params: ``, cacheable: true},
+		{name: "block by hash", method: "eth_getBlockByHash", params: `["0xabc", false]`, cacheable: true},
+		{name: "balance at number", method: "eth_getBalance", params: `["0x1", "0x10"]`, cacheable: true},
+		{name: "call at hash", method: "eth_call", params: `[{"to":"0x1"}, {"blockHash":"0xabc"}]`, cacheable: true},
+		{name: "call at latest", method: "eth_call", params: `[{"to":"0x1"}, "latest"]`, cacheable: true},
+		{name: "call at pending", method: "eth_call", params: `[{"to":"0x1"}, "pending"]`, cacheable: false},
+		{name: "block number", method: "eth_blockNumber", params: `[]`, cacheable: false},
+		{name: "send tx", method: "eth_sendRawTransaction", params: `["0x00"]`, cacheable: false},
+		{name: "bad params", method: "eth_chainId", params: `{`, cacheable: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(100, time.Minute)
+
+			result, ticket := c.Get(tt.method, json.RawMessage(tt.params))
+			if result != nil {
+				t.Fatal("Get() on empty cache returned a result")
+			}
+			if (ticket != nil) != tt.cacheable {
+				t.Fatalf("Get() ticket = %v, want cacheable %v", ticket, tt.cacheable)
+			}
+
+			c.Put(ticket, json.RawMessage(`"0x1"`))
+
+			result, _ = c.Get(tt.method, json.RawMessage(tt.params))
+			if (result != nil) != tt.cacheable {
+				t.Errorf("Get() after Put() = %s, want hit %v", result, tt.cacheable)
+			}
+		})
+	}
+}
+
+func TestCache_CanonicalKey(t *testing.T) {
+	c := New(100, time.Minute)
+
+	_, ticket := c.Get("eth_call", json.RawMessage(`[{"to":"0xABC","data":"0x01"},"0x10"]`))
+	c.Put(ticket, json.RawMessage(`"0x1"`))
+
+	result, _ := c.Get("eth_call", json.RawMessage(`[ {"data":"0x01", "to":"0xabc"}, "0x10" ]`))
+	if result == nil {
+		t.Error("Get() missed for a request that only differs in formatting")
+	}
+}
+
+func TestCache_LatestInvalidatedByNewHead(t *testing.T) {
+	c := New(100, time.Minute)
+	params := json.RawMessage(`["0x1", "latest"]`)
+
+	_, ticket := c.Get("eth_getBalance", params)
+	c.Put(ticket, json.RawMessage(`"0x1"`))
+
+	if result, _ := c.Get("eth_getBalance", params); result == nil {
+		t.Fatal("Get() missed before a new head")
+	}
+
+	c.ObserveHead(100)
+
+	if result, _ := c.Get("eth_getBalance", params); result != nil {
+		t.Error("Get() hit after a new head")
+	}
+
+	_, ticket = c.Get("eth_getBalance", params)
+	c.ObserveHead(101)
+	c.Put(ticket, json.RawMessage(`"0x2"`))
+	if result, _ := c.Get("eth_getBalance", params); result != nil {
+		t.Error("result fetched before a new head should not be stored")
+	}
+}
+
+func TestCache_LatestTTL(t *testing.T) {
+	c := New(100, time.Millisecond)
+	params := json.RawMessage(`["0x1"]`)
+
+	_, ticket := c.Get("eth_getBalance", params)
+	c.Put(ticket, json.RawMessage(`"0x1"`))
+	time.Sleep(5 * time.Millisecond)
+
+	if result, _ := c.Get("eth_getBalance", params); result != nil {
+		t.Error("Get() hit after latest_ttl expired")
+	}
+}
+
+func TestCache_Receipt(t *testing.T) {
+	c := New(100, time.Minute)
+	params := json.RawMessage(`["0xabc"]`)
+
+	_, ticket := c.Get("eth_getTransactionReceipt", params)
+	c.Put(ticket, json.RawMessage(`null`))
+	if result, _ := c.Get("eth_getTransactionReceipt", params); result != nil {
+		t.Error("receipt of a pending transaction was cached")
+	}
+
+	_, ticket = c.Get("eth_getTransactionReceipt", params)
+	c.Put(ticket, json.RawMessage(`{"blockNumber":"0x10","status":"0x1"}`))
+	if result, _ := c.Get("eth_getTransactionReceipt", params); result == nil {
+		t.Error("receipt of a mined transaction was not cached")
+	}
+}
+
+func TestCache_Eviction(t *testing.T) {
+	c := New(2, time.Minute)
+
+	for _, hash := range []string{`["0x1"]`, `["0x2"]`, `["0x3"]`} {
+		_, ticket := c.Get("eth_getBlockByHash", json.RawMessage(hash))
+		c.Put(ticket, json.RawMessage(`{}`))
+	}
+
+	if result, _ := c.Get("eth_getBlockByHash", json.RawMessage(`["0x1"]`)); result != nil {
+		t.Error("least recently used entry was not evicted")
+	}
+	if stats := c.Stats(); stats.Entries != 2 {
+		t.Errorf("Entries = %d, want 2", stats.Entries)
+	}
+}
+
+func TestCache_Reorg(t *testing.T) {
+	c := New(100, time.Minute)
+	put := func(block string) {
+		_, ticket := c.Get("eth_getBalance", json.RawMessage(`["0x1", "`+block+`"]`))
+		c.Put(ticket, json.RawMessage(`"0x1"`))
+	}
+	cached := func(block string) bool {
+		result, _ := c.Get("eth_getBalance", json.RawMessage(`["0x1", "`+block+`"]`))
+		return result != nil
+	}
+
+	for _, block := range []string{"0x5", "0x7", "0x8", "0x9"} {
+		put(block)
+	}
+	c.SetSafe(7)
+
+	if evicted := c.Reorg(6); evicted != 2 {
+		t.Errorf("Reorg() evicted %d entries, want 2", evicted)
+	}
+	if !cached("0x5") || !cached("0x7") {
+		t.Error("entries at or below the safe block were evicted")
+	}
+	if cached("0x8") || cached("0x9") {
+		t.Error("entries in the reorged range were not evicted")
+	}
+}
+
+func TestCache_Follow(t *testing.T) {
+	c := New(100, time.Minute)
+	params := json.RawMessage(`["0x1", "0x9"]`)
+	_, ticket := c.Get("eth_getBalance", params)
+	c.Put(ticket, json.RawMessage(`"0x1"`))
+
+	events := make(chan chain.Event, 2)
+	events <- chain.Event{Type: chain.EventNewHead, Head: chain.Head{Number: 9}}
+	events <- chain.Event{Type: chain.EventReorg, Reorg: &chain.Reorg{CommonAncestor: 8}}
+	close(events)
+
+	c.Follow(events)
+
+	if result, _ := c.Get("eth_getBalance", params); result != nil {
+		t.Error("entry for a reorged block is still cached")
+	}
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/devlongs/geth-relay/rpc"
+)
+
+// scope describes how long a cached result stays valid.
+type scope int
+
+const (
+	// scopeImmutable results never change: chain constants and data
+	// addressed by hash.
+	scopeImmutable scope = iota + 1
+	// scopeBlock results are tied to a block number and only change if
+	// that block is reorged out.
+	scopeBlock
+	// scopeLatest results are tied to the current head and are dropped as
+	// soon as a new head is observed.
+	scopeLatest
+	// scopeResult results are cacheable or not depending on the response,
+	// such as receipts which only exist once a transaction is mined.
+	scopeResult
+)
+
+// blockParamIndex maps the cacheable state methods to the position of
+// their block parameter.
+var blockParamIndex = map[string]int{
+	"eth_call":       1,
+	"eth_getBalance": 1,
+}
+
+// classify decides whether a request is cacheable and what its result is
+// tied to.
+func classify(method string, params []interface{}) (scope, uint64, bool) {
+	switch method {
+	case "eth_chainId", "net_version":
+		return scopeImmutable, 0, true
+	case "eth_getBlockByHash":
+		return scopeImmutable, 0, true
+	case "eth_getTransactionReceipt":
+		return scopeResult, 0, true
+	}
+
+	idx, ok := blockParamIndex[method]
+	if !ok {
+		return 0, 0, false
+	}
+	if len(params) <= idx {
+		// geth defaults a missing block parameter to latest.
+		return scopeLatest, 0, true
+	}
+	return classifyBlock(params[idx])
+}
+
+// classifyBlock interprets a block number, tag or EIP-1898 block object.
+func classifyBlock(param interface{}) (scope, uint64, bool) {
+	switch v := param.(type) {
+	case string:
+		switch v {
+		case "latest":
+			return scopeLatest, 0, true
+		case "earliest":
+			return scopeBlock, 0, true
+		case "pending", "safe", "finalized":
+			return 0, 0, false
+		}
+		n, err := rpc.ParseQuantity(v)
+		if err != nil {
+			return 0, 0, false
+		}
+		return scopeBlock, n, true
+	case map[string]interface{}:
+		if _, ok := v["blockHash"]; ok {
+			return scopeImmutable, 0, true
+		}
+		if num, ok := v["blockNumber"]; ok {
+			return classifyBlock(num)
+		}
+	}
+	return 0, 0, false
+}
+
+// receiptBlock returns the block a receipt was mined in, or false for a
+// pending transaction whose receipt is null.
+func receiptBlock(result json.RawMessage) (uint64, bool) {
+	var receipt struct {
+		BlockNumber string `json:"blockNumber"`
+	}
+	if err := json.Unmarshal(result, &receipt); err != nil || receipt.BlockNumber == "" {
+		return 0, false
+	}
+	n, err := rpc.ParseQuantity(receipt.BlockNumber)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// canonicalParams decodes params and re-encodes them with sorted object
+// keys and lowercased hex strings, so that requests which only differ in
+// formatting share a cache entry.
+func canonicalParams(raw json.RawMessage) ([]interface{}, string, bool) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, "[]", true
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+
+	var params []interface{}
+	if err := dec.Decode(&params); err != nil {
+		return nil, "", false
+	}
+	for i := range params {
+		params[i] = rpc.LowerHex(params[i])
+	}
+
+	encoded, err := json.Marshal(params)
+	if err != nil {
+		return nil, "", false
+	}
+	return params, string(encoded), true
+}
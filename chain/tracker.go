@@ -0,0 +1,374 @@
+package chain
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/devlongs/geth-relay/rpc"
+	"go.uber.org/zap"
+)
+
+// Head is a block header as followed by the tracker.
+type Head struct {
+	Number     uint64
+	Hash       string
+	ParentHash string
+	// Header is the header as returned by eth_getBlockByNumber.
+	Header json.RawMessage
+}
+
+type EventType int
+
+const (
+	// EventNewHead is published for every block that becomes part of the
+	// canonical chain, in ascending order.
+	EventNewHead EventType = iota + 1
+	// EventReorg is published before the new heads of a reorg.
+	EventReorg
+	// EventFinalized is published when the finalized or safe block advances.
+	EventFinalized
+)
+
+type Event struct {
+	Type EventType
+	// Head is the new block for EventNewHead and the new head of the chain
+	// for EventReorg.
+	Head Head
+	// Reorg is set for EventReorg.
+	Reorg *Reorg
+	// Finalized and Safe are set for EventFinalized.
+	Finalized uint64
+	Safe      uint64
+}
+
+// Reorg describes a switch of the canonical chain. Every block above
+// CommonAncestor up to OldHead was replaced.
+type Reorg struct {
+	CommonAncestor uint64
+	OldHead        Head
+	NewHead        Head
+	Depth          uint64
+}
+
+// Tracker follows the canonical chain of the upstream by polling for the
+// latest block. It keeps the hashes of the most recent blocks to detect
+// reorgs and publishes new heads, reorgs and finality changes to its
+// subscribers.
+type Tracker struct {
+	client   *rpc.Client
+	logger   *zap.Logger
+	interval time.Duration
+	history  int
+
+	pollMu    sync.Mutex
+	mu        sync.RWMutex
+	blocks    []Head // ascending, contiguous, at most history entries
+	finalized uint64
+	safe      uint64
+	subs      map[chan Event]struct{}
+	stopped   bool
+}
+
+func NewTracker(client *rpc.Client, logger *zap.Logger, interval time.Duration, history int) *Tracker {
+	if history < 2 {
+		history = 2
+	}
+	return &Tracker{
+		client:   client,
+		logger:   logger,
+		interval: interval,
+		history:  history,
+		subs:     make(map[chan Event]struct{}),
+	}
+}
+
+// Run polls the upstream until ctx is cancelled, then closes the channels
+// of all subscriptions.
+func (t *Tracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	defer t.stop()
+
+	for {
+		if err := t.Poll(ctx); err != nil && ctx.Err() == nil {
+			t.logger.Warn("head tracker poll failed", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving every event published from now on
+// and a function to cancel the subscription. Events are dropped for
+// subscribers that fall more than buffer events behind. The channel is
+// closed when the subscription is cancelled or Run returns.
+func (t *Tracker) Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped {
+		close(ch)
+		return ch, func() {}
+	}
+	t.subs[ch] = struct{}{}
+	return ch, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+
+		if _, ok := t.subs[ch]; ok {
+			delete(t.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (t *Tracker) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stopped = true
+	for ch := range t.subs {
+		delete(t.subs, ch)
+		close(ch)
+	}
+}
+
+// Head returns the current head, or false before the first poll.
+func (t *Tracker) Head() (Head, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if len(t.blocks) == 0 {
+		return Head{}, false
+	}
+	return t.blocks[len(t.blocks)-1], true
+}
+
+// Finalized returns the latest finalized and safe block numbers, or zero if
+// the upstream does not report them.
+func (t *Tracker) Finalized() (finalized, safe uint64) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.finalized, t.safe
+}
+
+// Poll fetches the latest block once and publishes what changed.
+func (t *Tracker) Poll(ctx context.Context) error {
+	t.pollMu.Lock()
+	defer t.pollMu.Unlock()
+
+	latest, err := t.fetch(ctx, "eth_getBlockByNumber", "latest")
+	if err != nil {
+		return err
+	}
+
+	events, err := t.advance(ctx, latest)
+	if err != nil {
+		return err
+	}
+
+	if ev, ok := t.pollFinality(ctx); ok {
+		events = append(events, ev)
+	}
+
+	for _, ev := range events {
+		t.publish(ev)
+	}
+	return nil
+}
+
+// advance links the new head to the known chain, fetching any blocks in
+// between by parent hash, and returns the resulting events.
+func (t *Tracker) advance(ctx context.Context, latest Head) ([]Event, error) {
+	t.mu.RLock()
+	current, known := Head{}, len(t.blocks) > 0
+	if known {
+		current = t.blocks[len(t.blocks)-1]
+	}
+	t.mu.RUnlock()
+
+	switch {
+	case !known:
+		t.mu.Lock()
+		t.blocks = []Head{latest}
+		t.mu.Unlock()
+		return []Event{{Type: EventNewHead, Head: latest}}, nil
+	case latest.Hash == current.Hash:
+		return nil, nil
+	case latest.Number < current.Number:
+		// A lagging upstream answered; wait for it to catch up rather than
+		// treat a shorter chain as canonical.
+		return nil, nil
+	}
+
+	// Walk back from the new head until a block whose parent we know.
+	newBlocks := []Head{latest}
+	var (
+		ancestor uint64
+		found    bool
+	)
+	for len(newBlocks) <= t.history {
+		oldest := newBlocks[0]
+		if hash, ok := t.hashAt(oldest.Number - 1); ok && oldest.Number > 0 {
+			if hash == oldest.ParentHash {
+				ancestor, found = oldest.Number-1, true
+				break
+			}
+		} else if oldest.Number == 0 || oldest.Number-1 < t.oldest() {
+			break
+		}
+
+		parent, err := t.fetch(ctx, "eth_getBlockByHash", oldest.ParentHash)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch parent of block %d: %w", oldest.Number, err)
+		}
+		newBlocks = append([]Head{parent}, newBlocks...)
+	}
+
+	var events []Event
+
+	t.mu.Lock()
+	if !found {
+		// The new head does not link up with the blocks we know: either the
+		// reorg is deeper than the history or the gap since the last poll is
+		// longer than it. Only the finalized block is known to be unaffected.
+		t.logger.Warn("head tracker lost track of the chain, resetting",
+			zap.Uint64("old_head", current.Number),
+			zap.Uint64("new_head", latest.Number))
+		ancestor = min(t.finalized, current.Number)
+		t.blocks = nil
+	} else {
+		t.blocks = t.blocks[:ancestor-t.blocks[0].Number+1]
+	}
+	if ancestor < current.Number {
+		reorg := &Reorg{
+			CommonAncestor: ancestor,
+			OldHead:        current,
+			NewHead:        latest,
+			Depth:          current.Number - ancestor,
+		}
+		t.logger.Warn("chain reorg detected",
+			zap.Uint64("common_ancestor", ancestor),
+			zap.Uint64("old_head", current.Number),
+			zap.String("old_hash", current.Hash),
+			zap.Uint64("new_head", latest.Number),
+			zap.String("new_hash", latest.Hash),
+			zap.Uint64("depth", reorg.Depth))
+		events = append(events, Event{Type: EventReorg, Head: latest, Reorg: reorg})
+	}
+	t.blocks = append(t.blocks, newBlocks...)
+	if len(t.blocks) > t.history {
+		t.blocks = append([]Head(nil), t.blocks[len(t.blocks)-t.history:]...)
+	}
+	t.mu.Unlock()
+
+	for _, b := range newBlocks {
+		events = append(events, Event{Type: EventNewHead, Head: b})
+	}
+	return events, nil
+}
+
+func (t *Tracker) pollFinality(ctx context.Context) (Event, bool) {
+	// Chains without finality (pre-merge, dev mode) reject these tags;
+	// treat that as no finalized block.
+	finalized, ferr := t.fetch(ctx, "eth_getBlockByNumber", "finalized")
+	safe, serr := t.fetch(ctx, "eth_getBlockByNumber", "safe")
+	if ferr != nil && serr != nil {
+		return Event{}, false
+	}
+	if serr != nil {
+		safe = finalized
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if finalized.Number <= t.finalized && safe.Number <= t.safe {
+		return Event{}, false
+	}
+	t.finalized = max(t.finalized, finalized.Number)
+	t.safe = max(t.safe, safe.Number)
+	return Event{Type: EventFinalized, Finalized: t.finalized, Safe: t.safe}, true
+}
+
+func (t *Tracker) hashAt(number uint64) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if len(t.blocks) == 0 || number < t.blocks[0].Number || number > t.blocks[len(t.blocks)-1].Number {
+		return "", false
+	}
+	return t.blocks[number-t.blocks[0].Number].Hash, true
+}
+
+func (t *Tracker) oldest() uint64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.blocks[0].Number
+}
+
+func (t *Tracker) publish(ev Event) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for ch := range t.subs {
+		select {
+		case ch <- ev:
+		default:
+			t.logger.Warn("dropping chain event for slow subscriber", zap.Uint64("block", ev.Head.Number))
+		}
+	}
+}
+
+var errBlockNotFound = errors.New("block not found")
+
+func (t *Tracker) fetch(ctx context.Context, method, block string) (Head, error) {
+	params, _ := json.Marshal([]interface{}{block, false})
+	resp, err := t.client.Forward(ctx, &rpc.JSONRPCRequest{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  params,
+		ID:      json.RawMessage("1"),
+	})
+	if err != nil {
+		return Head{}, err
+	}
+	if resp.Error != nil {
+		return Head{}, fmt.Errorf("%s(%s): %s", method, block, resp.Error.Message)
+	}
+	if len(resp.Result) == 0 || string(resp.Result) == "null" {
+		return Head{}, fmt.Errorf("%s(%s): %w", method, block, errBlockNotFound)
+	}
+
+	var header struct {
+		Number     string `json:"number"`
+		Hash       string `json:"hash"`
+		ParentHash string `json:"parentHash"`
+	}
+	if err := json.Unmarshal(resp.Result, &header); err != nil {
+		return Head{}, fmt.Errorf("failed to decode block header: %w", err)
+	}
+	number, err := rpc.ParseQuantity(header.Number)
+	if err != nil {
+		return Head{}, fmt.Errorf("failed to decode block number: %w", err)
+	}
+
+	return Head{
+		Number:     number,
+		Hash:       header.Hash,
+		ParentHash: header.ParentHash,
+		Header:     resp.Result,
+	}, nil
+}
@@ -0,0 +1,269 @@
+package chain
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devlongs/geth-relay/rpc"
+	"go.uber.org/zap"
+)
+
+// fakeChain serves blocks of a chain that tests can extend and reorg.
+type fakeChain struct {
+	mu        sync.Mutex
+	canonical []string // hash by number
+	parents   map[string]string
+	numbers   map[string]uint64
+	finalized uint64
+}
+
+func newFakeChain(length int) *fakeChain {
+	c := &fakeChain{parents: make(map[string]string), numbers: make(map[string]uint64)}
+	c.extend(length, "a")
+	return c
+}
+
+func (c *fakeChain) extend(n int, fork string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := 0; i < n; i++ {
+		number := uint64(len(c.canonical))
+		hash := fmt.Sprintf("0x%s%d", fork, number)
+		parent := "0x0"
+		if number > 0 {
+			parent = c.canonical[number-1]
+		}
+		c.canonical = append(c.canonical, hash)
+		c.parents[hash] = parent
+		c.numbers[hash] = number
+	}
+}
+
+// reorg replaces every block above ancestor with blocks of a new fork.
+func (c *fakeChain) reorg(ancestor uint64, length int, fork string) {
+	c.mu.Lock()
+	c.canonical = c.canonical[:ancestor+1]
+	c.mu.Unlock()
+	c.extend(length, fork)
+}
+
+func (c *fakeChain) header(hash string) json.RawMessage {
+	header, _ := json.Marshal(map[string]string{
+		"number":     rpc.EncodeQuantity(c.numbers[hash]),
+		"hash":       hash,
+		"parentHash": c.parents[hash],
+	})
+	return header
+}
+
+func (c *fakeChain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req rpc.JSONRPCRequest
+	json.NewDecoder(r.Body).Decode(&req)
+	var params []interface{}
+	json.Unmarshal(req.Params, &params)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result := json.RawMessage(`null`)
+	switch req.Method {
+	case "eth_getBlockByNumber":
+		switch params[0] {
+		case "latest":
+			result = c.header(c.canonical[len(c.canonical)-1])
+		case "finalized", "safe":
+			if c.finalized > 0 {
+				result = c.header(c.canonical[c.finalized])
+			}
+		}
+	case "eth_getBlockByHash":
+		if _, ok := c.numbers[params[0].(string)]; ok {
+			result = c.header(params[0].(string))
+		}
+	}
+	json.NewEncoder(w).Encode(rpc.JSONRPCResponse{JSONRPC: "2.0", Result: result, ID: req.ID})
+}
+
+func setupTracker(t *testing.T, c *fakeChain, history int) *Tracker {
+	server := httptest.NewServer(c)
+	t.Cleanup(server.Close)
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient(server.URL, 5*time.Second, logger)
+	return NewTracker(client, logger, time.Minute, history)
+}
+
+func drain(ch <-chan Event) []Event {
+	var events []Event
+	for {
+		select {
+		case ev := <-ch:
+			events = append(events, ev)
+		default:
+			return events
+		}
+	}
+}
+
+func TestTracker_NewHeads(t *testing.T) {
+	c := newFakeChain(10)
+	tracker := setupTracker(t, c, 16)
+	events, unsubscribe := tracker.Subscribe(64)
+	defer unsubscribe()
+
+	if err := tracker.Poll(context.Background()); err != nil {
+		t.Fatalf("Poll() error = %v", err)
+	}
+	got := drain(events)
+	if len(got) != 1 || got[0].Type != EventNewHead || got[0].Head.Number != 9 {
+		t.Fatalf("events after first poll = %+v, want new head 9", got)
+	}
+
+	c.extend(3, "a")
+	if err := tracker.Poll(context.Background()); err != nil {
+		t.Fatalf("Poll() error = %v", err)
+	}
+	got = drain(events)
+	if len(got) != 3 {
+		t.Fatalf("len(events) = %d, want 3 new heads for the gap", len(got))
+	}
+	for i, ev := range got {
+		if ev.Type != EventNewHead || ev.Head.Number != uint64(10+i) {
+			t.Errorf("events[%d] = %+v, want new head %d", i, ev, 10+i)
+		}
+	}
+
+	if err := tracker.Poll(context.Background()); err != nil {
+		t.Fatalf("Poll() error = %v", err)
+	}
+	if got := drain(events); len(got) != 0 {
+		t.Errorf("events for an unchanged head = %+v, want none", got)
+	}
+
+	head, ok := tracker.Head()
+	if !ok || head.Number != 12 || len(head.Header) == 0 {
+		t.Errorf("Head() = %+v, %v, want block 12 with its header", head, ok)
+	}
+}
+
+func TestTracker_Reorg(t *testing.T) {
+	c := newFakeChain(10)
+	tracker := setupTracker(t, c, 16)
+	events, unsubscribe := tracker.Subscribe(64)
+	defer unsubscribe()
+
+	tracker.Poll(context.Background())
+	c.extend(3, "a")
+	tracker.Poll(context.Background())
+	drain(events)
+
+	c.reorg(10, 4, "b")
+	if err := tracker.Poll(context.Background()); err != nil {
+		t.Fatalf("Poll() error = %v", err)
+	}
+
+	got := drain(events)
+	if len(got) != 5 {
+		t.Fatalf("len(events) = %d, want a reorg and 4 new heads", len(got))
+	}
+	if got[0].Type != EventReorg {
+		t.Fatalf("events[0].Type = %v, want EventReorg", got[0].Type)
+	}
+	reorg := got[0].Reorg
+	if reorg.CommonAncestor != 10 || reorg.Depth != 2 || reorg.OldHead.Number != 12 || reorg.NewHead.Number != 14 {
+		t.Errorf("reorg = %+v, want ancestor 10, depth 2, 12 -> 14", reorg)
+	}
+	for i, ev := range got[1:] {
+		if ev.Type != EventNewHead || ev.Head.Number != uint64(11+i) {
+			t.Errorf("events[%d] = %+v, want new head %d", i+1, ev, 11+i)
+		}
+	}
+
+	head, _ := tracker.Head()
+	if head.Hash != "0xb14" {
+		t.Errorf("Head().Hash = %s, want 0xb14", head.Hash)
+	}
+}
+
+func TestTracker_ReorgDeeperThanHistory(t *testing.T) {
+	c := newFakeChain(20)
+	tracker := setupTracker(t, c, 4)
+	events, unsubscribe := tracker.Subscribe(64)
+	defer unsubscribe()
+
+	tracker.Poll(context.Background())
+	c.extend(3, "a")
+	tracker.Poll(context.Background())
+	drain(events)
+
+	c.reorg(10, 12, "b")
+	if err := tracker.Poll(context.Background()); err != nil {
+		t.Fatalf("Poll() error = %v", err)
+	}
+
+	got := drain(events)
+	if len(got) == 0 || got[0].Type != EventReorg {
+		t.Fatalf("events = %+v, want a reorg first", got)
+	}
+	if got[0].Reorg.CommonAncestor > 10 {
+		t.Errorf("CommonAncestor = %d, want at most the real ancestor 10", got[0].Reorg.CommonAncestor)
+	}
+}
+
+func TestTracker_Finality(t *testing.T) {
+	c := newFakeChain(10)
+	tracker := setupTracker(t, c, 16)
+	events, unsubscribe := tracker.Subscribe(64)
+	defer unsubscribe()
+
+	tracker.Poll(context.Background())
+	if finalized, _ := tracker.Finalized(); finalized != 0 {
+		t.Errorf("Finalized() = %d on a chain without finality, want 0", finalized)
+	}
+
+	c.finalized = 5
+	tracker.Poll(context.Background())
+
+	var found bool
+	for _, ev := range drain(events) {
+		if ev.Type == EventFinalized {
+			found = true
+			if ev.Finalized != 5 || ev.Safe != 5 {
+				t.Errorf("finality event = %+v, want finalized and safe 5", ev)
+			}
+		}
+	}
+	if !found {
+		t.Error("no EventFinalized published")
+	}
+}
+
+func TestTracker_RunClosesSubscriptions(t *testing.T) {
+	tracker := setupTracker(t, newFakeChain(10), 16)
+	events, unsubscribe := tracker.Subscribe(64)
+	defer unsubscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		tracker.Run(ctx)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	// Ranging over the events ends once the subscription is closed.
+	for range events {
+	}
+	late, _ := tracker.Subscribe(1)
+	if _, ok := <-late; ok {
+		t.Error("subscription after Run returned is open")
+	}
+}
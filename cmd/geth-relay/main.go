@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/devlongs/geth-relay/auth"
+	"github.com/devlongs/geth-relay/cache"
+	"github.com/devlongs/geth-relay/chain"
+	"github.com/devlongs/geth-relay/health"
+	"github.com/devlongs/geth-relay/internal/config"
+	"github.com/devlongs/geth-relay/internal/server"
+	"github.com/devlongs/geth-relay/logger"
+	"github.com/devlongs/geth-relay/metrics"
+	"github.com/devlongs/geth-relay/proxy"
+	"github.com/devlongs/geth-relay/ratelimit"
+	"github.com/devlongs/geth-relay/rpc"
+	"github.com/devlongs/geth-relay/subscription"
+	"github.com/devlongs/geth-relay/tracing"
+	"go.uber.org/zap"
+)
+
+// version is set at build time via -ldflags "-X main.version=...".
+var version = "dev"
+
+const usage = `Usage: geth-relay [command] [flags]
+
+Commands:
+  serve          Start the relay (default)
+  config check   Load and validate the configuration, then exit
+  version        Print the version and exit
+
+Run "geth-relay <command> -h" to list the flags of a command.
+`
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdout, stderr io.Writer) int {
+	cmd := "serve"
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "serve":
+		cfg, err := loadConfig("serve", args, stderr)
+		if err != nil {
+			return exitCode(err)
+		}
+		if err := serve(cfg); err != nil {
+			fmt.Fprintf(stderr, "geth-relay: %v\n", err)
+			return 1
+		}
+		return 0
+
+	case "config":
+		if len(args) == 0 || args[0] != "check" {
+			fmt.Fprint(stderr, "Usage: geth-relay config check [flags]\n")
+			return 2
+		}
+		if _, err := loadConfig("config check", args[1:], stderr); err != nil {
+			return exitCode(err)
+		}
+		fmt.Fprintln(stdout, "configuration is valid")
+		return 0
+
+	case "version":
+		fmt.Fprintf(stdout, "geth-relay %s\n", version)
+		return 0
+
+	case "help":
+		fmt.Fprint(stdout, usage)
+		return 0
+
+	default:
+		fmt.Fprintf(stderr, "geth-relay: unknown command %q\n\n%s", cmd, usage)
+		return 2
+	}
+}
+
+// loadConfig parses the flags of a command, loads the config file with any
+// flag overrides applied and validates the result.
+func loadConfig(name string, args []string, stderr io.Writer) (*config.Config, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+
+	configPath := fs.String("config", "", "path to the config file (default: ./config.yaml or ./configs/config.yaml)")
+	for _, d := range config.Defaults() {
+		usage := fmt.Sprintf("override %s (default %v)", d.Key, d.Value)
+		// Booleans can be set with a bare flag.
+		if _, ok := d.Value.(bool); ok {
+			fs.Bool(d.Key, false, usage)
+			continue
+		}
+		fs.String(d.Key, "", usage)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "Usage of %s:\n", name)
+		fs.PrintDefaults()
+		fmt.Fprint(stderr, "\nLists take comma separated values. upstream.endpoints, auth.keys and\n"+
+			"limits.compute_units.methods can only be set in the config file.\n")
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, errUsage
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintf(stderr, "geth-relay %s: unexpected argument %q\n", name, fs.Arg(0))
+		return nil, errUsage
+	}
+
+	overrides := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			overrides[f.Name] = f.Value.String()
+		}
+	})
+
+	cfg, err := config.LoadWithOverrides(*configPath, overrides)
+	if err != nil {
+		fmt.Fprintf(stderr, "geth-relay: %v\n", err)
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(stderr, "geth-relay: invalid configuration:\n%v\n", err)
+		return nil, err
+	}
+	return cfg, nil
+}
+
+var errUsage = errors.New("usage error")
+
+func exitCode(err error) int {
+	if errors.Is(err, errUsage) {
+		return 2
+	}
+	return 1
+}
+
+func serve(cfg *config.Config) error {
+	log, err := logger.New(cfg.Logging.Level, cfg.Logging.Format)
+	if err != nil {
+		return err
+	}
+	defer log.Sync()
+
+	pool := cfg.Upstream.Pool()
+	endpoints := make([]rpc.Endpoint, len(pool))
+	for i, e := range pool {
+		endpoints[i] = rpc.Endpoint{Name: e.Name, URL: e.URL, Weight: e.Weight, Timeout: e.Timeout}
+	}
+
+	if cfg.Tracing.Enabled {
+		shutdown, err := tracing.Setup(context.Background(), tracing.Config{
+			ServiceName: cfg.Tracing.ServiceName,
+			Version:     version,
+			Exporter:    cfg.Tracing.Exporter,
+			Endpoint:    cfg.Tracing.Endpoint,
+			File:        cfg.Tracing.File,
+			SampleRatio: cfg.Tracing.SampleRatio,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set up tracing: %w", err)
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+			defer cancel()
+			if err := shutdown(ctx); err != nil {
+				log.Warn("failed to flush traces", zap.Error(err))
+			}
+		}()
+		log.Info("tracing enabled", zap.String("exporter", cfg.Tracing.Exporter))
+	}
+
+	// A nil *Metrics records nothing.
+	var m *metrics.Metrics
+	if cfg.Metrics.Enabled {
+		m = metrics.New()
+	}
+
+	clientOpts := []rpc.ClientOption{rpc.WithMetrics(m), rpc.WithMaxResponseSize(cfg.Limits.MaxResponseSize)}
+	if cb := cfg.Upstream.CircuitBreaker; cb.Enabled {
+		clientOpts = append(clientOpts, rpc.WithCircuitBreaker(rpc.CircuitBreakerConfig{
+			ConsecutiveFailures: cb.ConsecutiveFailures,
+			ErrorRate:           cb.ErrorRate,
+			Window:              cb.Window,
+			Cooldown:            cb.Cooldown,
+			Probes:              cb.Probes,
+		}))
+	}
+	if r := cfg.Upstream.Retry; r.Enabled {
+		clientOpts = append(clientOpts, rpc.WithRetry(rpc.RetryConfig{
+			MaxRetries:  r.MaxRetries,
+			Backoff:     r.Backoff,
+			MaxBackoff:  r.MaxBackoff,
+			BudgetRatio: r.BudgetRatio,
+			BudgetBurst: r.BudgetBurst,
+		}))
+	}
+	if h := cfg.Upstream.Hedge; h.Enabled {
+		clientOpts = append(clientOpts, rpc.WithHedging(rpc.HedgeConfig{
+			Methods:    h.Methods,
+			Percentile: h.Percentile,
+			MinDelay:   h.MinDelay,
+			MaxRate:    h.MaxRate,
+		}))
+	}
+	client := rpc.NewPoolClient(endpoints, log, clientOpts...)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var tracker *chain.Tracker
+	if cfg.TrackerNeeded() {
+		tracker = chain.NewTracker(client, log, cfg.Tracker.PollInterval, cfg.Tracker.History)
+		go tracker.Run(ctx)
+	}
+
+	methods, err := proxy.NewMethodFilter(cfg.Methods.Allow, cfg.Methods.Deny)
+	if err != nil {
+		return fmt.Errorf("invalid method rules: %w", err)
+	}
+	proxyOpts := []proxy.Option{proxy.WithMethodFilter(methods), proxy.WithMetrics(m)}
+	if cfg.Batch.Fanout {
+		proxyOpts = append(proxyOpts, proxy.WithBatchFanout(cfg.Batch.SubBatchSize, cfg.Batch.Concurrency))
+	}
+	if cfg.Cache.Enabled {
+		c := cache.New(cfg.Cache.MaxEntries, cfg.Cache.LatestTTL)
+		if tracker != nil {
+			events, unsubscribe := tracker.Subscribe(256)
+			defer unsubscribe()
+			go c.Follow(events)
+		}
+		proxyOpts = append(proxyOpts, proxy.WithCache(c))
+	}
+
+	p := proxy.New(client, log, cfg.Limits.MaxBatchItems, cfg.Limits.MaxBatchResponse, proxyOpts...)
+
+	opts := []server.Option{server.WithVersion(version)}
+	if m != nil {
+		opts = append(opts, server.WithMetrics(m, cfg.Metrics.Path))
+	}
+	if cfg.Health.Enabled {
+		checker := health.NewChecker(client, log,
+			cfg.Health.Interval, cfg.Health.Timeout, cfg.Health.MaxBlockLag, cfg.Health.MinPeers)
+		go checker.Run(ctx)
+		opts = append(opts, server.WithHealthChecker(checker))
+	}
+
+	if cfg.Events.Enabled && tracker != nil {
+		opts = append(opts, server.WithEvents(tracker, cfg.Events.MaxBackfill))
+	}
+
+	if cfg.WS.Enabled {
+		hub := subscription.NewHub(cfg.WS.UpstreamURL, log, cfg.WS.MaxBackfill)
+		go hub.Run(ctx)
+		opts = append(opts, server.WithWebSocket(hub))
+	}
+
+	keyLimits := false
+	if cfg.Auth.Enabled {
+		policies := make([]auth.Policy, 0, len(cfg.Auth.Keys))
+		for _, k := range cfg.Auth.APIKeys() {
+			policies = append(policies, auth.Policy{
+				Name:              k.Name,
+				Key:               k.Key,
+				RateLimit:         k.RateLimit,
+				RateLimitBurst:    k.RateLimitBurst,
+				AllowedNamespaces: k.AllowedNamespaces,
+				AllowedOrigins:    k.AllowedOrigins,
+			})
+			keyLimits = keyLimits || k.RateLimit > 0
+		}
+		authenticator, err := auth.New(cfg.Auth.Header, cfg.Auth.QueryParam, cfg.Auth.PathPrefix, policies)
+		if err != nil {
+			return fmt.Errorf("failed to set up authentication: %w", err)
+		}
+		opts = append(opts, server.WithAuth(authenticator))
+		log.Info("API key authentication enabled", zap.Int("keys", len(policies)))
+	}
+
+	if cfg.Limits.RateLimit > 0 || keyLimits {
+		cu := cfg.Limits.ComputeUnits
+		opts = append(opts, server.WithRateLimit(
+			ratelimit.New(cfg.Limits.RateLimit, cfg.Limits.RateLimitBurst),
+			ratelimit.NewCostTable(cu.Default, cu.BatchItem, cu.Methods),
+			server.ClientKey(cfg.Limits.TrustForwardedFor)))
+	}
+
+	srv := server.New(cfg.GetAddress(), p, log, cfg.Limits.MaxBodySize, opts...)
+
+	log.Info("geth-relay starting",
+		zap.String("version", version),
+		zap.Int("upstreams", len(endpoints)))
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Start()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Info("shutdown signal received",
+		zap.Duration("timeout", cfg.Server.ShutdownTimeout))
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("graceful shutdown failed: %w", err)
+	}
+	return <-errCh
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunVersion(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"version"}, &stdout, &stderr); code != 0 {
+		t.Fatalf("run(version) = %d, want 0", code)
+	}
+	if !strings.Contains(stdout.String(), version) {
+		t.Errorf("stdout = %q, want it to contain %q", stdout.String(), version)
+	}
+}
+
+func TestRunConfigCheck(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.yaml")
+	invalid := filepath.Join(dir, "invalid.yaml")
+	os.WriteFile(valid, []byte("server:\n  port: 9545\n"), 0o644)
+	os.WriteFile(invalid, []byte("logging:\n  format: xml\n"), 0o644)
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{name: "valid file", args: []string{"config", "check", "-config", valid}, want: 0},
+		{name: "invalid file", args: []string{"config", "check", "-config", invalid}, want: 1},
+		{name: "override fixes file", args: []string{"config", "check", "-config", invalid, "-logging.format", "console"}, want: 0},
+		{name: "invalid override", args: []string{"config", "check", "-config", valid, "-server.port", "70000"}, want: 1},
+		{name: "unknown flag", args: []string{"config", "check", "-nope", "1"}, want: 2},
+		{name: "missing subcommand", args: []string{"config"}, want: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			if got := run(tt.args, &stdout, &stderr); got != tt.want {
+				t.Errorf("run(%v) = %d, want %d (stderr: %s)", tt.args, got, tt.want, stderr.String())
+			}
+		})
+	}
+}
+
+func TestRunUnknownCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if code := run([]string{"bogus"}, &stdout, &stderr); code != 2 {
+		t.Errorf("run(bogus) = %d, want 2", code)
+	}
+}
+
+func TestLoadConfigOverrides(t *testing.T) {
+	var stderr bytes.Buffer
+	cfg, err := loadConfig("serve", []string{
+		"-server.port", "9999",
+		"-upstream.url", "http://10.0.0.1:8545",
+		"-upstream.timeout", "5s",
+		"-limits.max_batch_items", "10",
+		"-cache.enabled",
+		"-methods.deny", "eth_sendTransaction,debug_*",
+	}, &stderr)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v (stderr: %s)", err, stderr.String())
+	}
+
+	if cfg.Server.Port != 9999 {
+		t.Errorf("Server.Port = %d, want 9999", cfg.Server.Port)
+	}
+	if cfg.Upstream.URL != "http://10.0.0.1:8545" {
+		t.Errorf("Upstream.URL = %q, want http://10.0.0.1:8545", cfg.Upstream.URL)
+	}
+	if cfg.Upstream.Timeout.String() != "5s" {
+		t.Errorf("Upstream.Timeout = %s, want 5s", cfg.Upstream.Timeout)
+	}
+	if cfg.Limits.MaxBatchItems != 10 {
+		t.Errorf("Limits.MaxBatchItems = %d, want 10", cfg.Limits.MaxBatchItems)
+	}
+	if !cfg.Cache.Enabled {
+		t.Error("Cache.Enabled = false, want true from a bare flag")
+	}
+	if got := cfg.Methods.Deny; len(got) != 2 || got[0] != "eth_sendTransaction" || got[1] != "debug_*" {
+		t.Errorf("Methods.Deny = %q, want both listed methods", got)
+	}
+}
@@ -0,0 +1,184 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/devlongs/geth-relay/rpc"
+	"go.uber.org/zap"
+)
+
+// Status is the outcome of the latest check of one upstream.
+type Status struct {
+	Upstream    string    `json:"upstream"`
+	Healthy     bool      `json:"healthy"`
+	Reason      string    `json:"reason,omitempty"`
+	Syncing     bool      `json:"syncing"`
+	Peers       uint64    `json:"peers"`
+	BlockNumber uint64    `json:"block_number"`
+	Lag         uint64    `json:"lag"`
+	LatencyMs   float64   `json:"latency_ms"`
+	CheckedAt   time.Time `json:"checked_at"`
+}
+
+// Checker periodically polls every upstream for its sync status, peer count
+// and head block and marks upstreams that are syncing, have too few peers or
+// lag behind the best known head as unhealthy.
+type Checker struct {
+	client      *rpc.Client
+	logger      *zap.Logger
+	interval    time.Duration
+	timeout     time.Duration
+	maxBlockLag uint64
+	minPeers    uint64
+
+	mu       sync.RWMutex
+	statuses []Status
+}
+
+func NewChecker(client *rpc.Client, logger *zap.Logger, interval, timeout time.Duration, maxBlockLag, minPeers uint64) *Checker {
+	return &Checker{
+		client:      client,
+		logger:      logger,
+		interval:    interval,
+		timeout:     timeout,
+		maxBlockLag: maxBlockLag,
+		minPeers:    minPeers,
+	}
+}
+
+// Run checks the upstreams immediately and then on every interval until ctx
+// is cancelled.
+func (c *Checker) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		c.Check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check runs one round of checks against every upstream and updates their
+// health.
+func (c *Checker) Check(ctx context.Context) []Status {
+	upstreams := c.client.Upstreams()
+	statuses := make([]Status, len(upstreams))
+
+	var wg sync.WaitGroup
+	for i, u := range upstreams {
+		wg.Add(1)
+		go func(i int, u *rpc.Upstream) {
+			defer wg.Done()
+			statuses[i] = c.probe(ctx, u)
+		}(i, u)
+	}
+	wg.Wait()
+
+	var best uint64
+	for _, s := range statuses {
+		if s.Reason == "" && s.BlockNumber > best {
+			best = s.BlockNumber
+		}
+	}
+
+	for i := range statuses {
+		s := &statuses[i]
+		if s.Reason == "" {
+			s.Lag = best - s.BlockNumber
+			switch {
+			case s.Syncing:
+				s.Reason = "syncing"
+			case s.Peers < c.minPeers:
+				s.Reason = fmt.Sprintf("%d peers, want at least %d", s.Peers, c.minPeers)
+			case s.Lag > c.maxBlockLag:
+				s.Reason = fmt.Sprintf("%d blocks behind best head %d", s.Lag, best)
+			}
+		}
+		s.Healthy = s.Reason == ""
+
+		u := upstreams[i]
+		if u.Healthy() != s.Healthy {
+			if s.Healthy {
+				c.logger.Info("upstream became healthy", zap.String("upstream", u.Name()))
+			} else {
+				c.logger.Warn("upstream became unhealthy",
+					zap.String("upstream", u.Name()),
+					zap.String("reason", s.Reason))
+			}
+		}
+		u.SetHealthy(s.Healthy)
+	}
+
+	c.mu.Lock()
+	c.statuses = statuses
+	c.mu.Unlock()
+
+	return statuses
+}
+
+// Statuses returns the results of the latest check, or nil if no check has
+// completed yet.
+func (c *Checker) Statuses() []Status {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	out := make([]Status, len(c.statuses))
+	copy(out, c.statuses)
+	return out
+}
+
+func (c *Checker) probe(ctx context.Context, u *rpc.Upstream) Status {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	status := Status{Upstream: u.Name(), CheckedAt: time.Now()}
+	start := time.Now()
+
+	syncing, err := c.call(ctx, u, "eth_syncing")
+	if err == nil {
+		// eth_syncing returns false once synced and a progress object otherwise.
+		status.Syncing = string(syncing) != "false"
+
+		var head json.RawMessage
+		if head, err = c.call(ctx, u, "eth_blockNumber"); err == nil {
+			status.BlockNumber, err = rpc.DecodeQuantity(head)
+		}
+	}
+	if err == nil {
+		var peers json.RawMessage
+		if peers, err = c.call(ctx, u, "net_peerCount"); err == nil {
+			status.Peers, err = rpc.DecodeQuantity(peers)
+		}
+	}
+
+	status.LatencyMs = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		status.Reason = "unreachable: " + err.Error()
+	}
+	return status
+}
+
+func (c *Checker) call(ctx context.Context, u *rpc.Upstream, method string) (json.RawMessage, error) {
+	resp, err := c.client.ForwardTo(ctx, u, &rpc.JSONRPCRequest{
+		JSONRPC: "2.0",
+		Method:  method,
+		Params:  json.RawMessage(`[]`),
+		ID:      json.RawMessage("1"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Error != nil {
+		return nil, fmt.Errorf("%s: %s", method, resp.Error.Message)
+	}
+	return resp.Result, nil
+}
@@ -0,0 +1,105 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/devlongs/geth-relay/rpc"
+	"go.uber.org/zap"
+)
+
+type fakeNode struct {
+	syncing string
+	head    string
+	peers   string
+}
+
+func (n fakeNode) serve(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req rpc.JSONRPCRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+			return
+		}
+
+		var result string
+		switch req.Method {
+		case "eth_syncing":
+			result = n.syncing
+		case "eth_blockNumber":
+			result = n.head
+		case "net_peerCount":
+			result = n.peers
+		}
+		json.NewEncoder(w).Encode(rpc.JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(result), ID: req.ID})
+	}))
+}
+
+func TestChecker_Check(t *testing.T) {
+	good := fakeNode{syncing: `false`, head: `"0x64"`, peers: `"0x5"`}.serve(t)
+	defer good.Close()
+	syncing := fakeNode{syncing: `{"currentBlock":"0x10","highestBlock":"0x64"}`, head: `"0x10"`, peers: `"0x5"`}.serve(t)
+	defer syncing.Close()
+	lagging := fakeNode{syncing: `false`, head: `"0x50"`, peers: `"0x5"`}.serve(t)
+	defer lagging.Close()
+	lonely := fakeNode{syncing: `false`, head: `"0x64"`, peers: `"0x0"`}.serve(t)
+	defer lonely.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewPoolClient([]rpc.Endpoint{
+		{Name: "good", URL: good.URL, Timeout: time.Second},
+		{Name: "syncing", URL: syncing.URL, Timeout: time.Second},
+		{Name: "lagging", URL: lagging.URL, Timeout: time.Second},
+		{Name: "lonely", URL: lonely.URL, Timeout: time.Second},
+		{Name: "down", URL: down.URL, Timeout: time.Second},
+	}, logger)
+	checker := NewChecker(client, logger, time.Minute, time.Second, 5, 1)
+
+	statuses := checker.Check(context.Background())
+	if len(statuses) != 5 {
+		t.Fatalf("len(statuses) = %d, want 5", len(statuses))
+	}
+
+	want := map[string]bool{"good": true, "syncing": false, "lagging": false, "lonely": false, "down": false}
+	for i, s := range statuses {
+		if s.Healthy != want[s.Upstream] {
+			t.Errorf("%s: Healthy = %v (reason %q), want %v", s.Upstream, s.Healthy, s.Reason, want[s.Upstream])
+		}
+		if client.Upstreams()[i].Healthy() != s.Healthy {
+			t.Errorf("%s: upstream health not updated", s.Upstream)
+		}
+	}
+
+	if statuses[0].BlockNumber != 100 || statuses[0].Peers != 5 {
+		t.Errorf("good: BlockNumber = %d, Peers = %d, want 100 and 5", statuses[0].BlockNumber, statuses[0].Peers)
+	}
+	if statuses[2].Lag != 20 {
+		t.Errorf("lagging: Lag = %d, want 20", statuses[2].Lag)
+	}
+
+	if got := checker.Statuses(); len(got) != 5 {
+		t.Errorf("len(Statuses()) = %d, want 5", len(got))
+	}
+}
+
+func TestChecker_RecoversUpstream(t *testing.T) {
+	node := fakeNode{syncing: `false`, head: `"0x1"`, peers: `"0x1"`}.serve(t)
+	defer node.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient(node.URL, time.Second, logger)
+	client.Upstreams()[0].SetHealthy(false)
+
+	checker := NewChecker(client, logger, time.Minute, time.Second, 5, 1)
+	checker.Check(context.Background())
+
+	if !client.Upstreams()[0].Healthy() {
+		t.Error("upstream should be healthy after a passing check")
+	}
+}
@@ -1,10 +1,19 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/devlongs/geth-relay/methods"
+	"github.com/devlongs/geth-relay/tracing"
 	"github.com/spf13/viper"
+	"go.uber.org/zap/zapcore"
 )
 
 type Config struct {
@@ -12,41 +21,328 @@ type Config struct {
 	Upstream UpstreamConfig `mapstructure:"upstream"`
 	Logging  LoggingConfig  `mapstructure:"logging"`
 	Limits   LimitsConfig   `mapstructure:"limits"`
+	Batch    BatchConfig    `mapstructure:"batch"`
+	Health   HealthConfig   `mapstructure:"health"`
+	Cache    CacheConfig    `mapstructure:"cache"`
+	Tracker  TrackerConfig  `mapstructure:"head_tracker"`
+	Auth     AuthConfig     `mapstructure:"auth"`
+	Methods  MethodsConfig  `mapstructure:"methods"`
+	WS       WSConfig       `mapstructure:"websocket"`
+	Events   EventsConfig   `mapstructure:"events"`
+	Metrics  MetricsConfig  `mapstructure:"metrics"`
+	Tracing  TracingConfig  `mapstructure:"tracing"`
 }
 
 type ServerConfig struct {
-	Host string `mapstructure:"host"`
-	Port int    `mapstructure:"port"`
+	Host            string        `mapstructure:"host"`
+	Port            int           `mapstructure:"port"`
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
 }
 
 type LimitsConfig struct {
 	MaxBodySize      int `mapstructure:"max_body_size"`
 	MaxBatchItems    int `mapstructure:"max_batch_items"`
 	MaxBatchResponse int `mapstructure:"max_batch_response"`
+	// MaxResponseSize caps the size of every upstream response body so a
+	// huge eth_getLogs or trace result cannot exhaust the relay's memory.
+	MaxResponseSize int64 `mapstructure:"max_response_size"`
+
+	// RateLimit is the number of compute units per second each client may
+	// spend; zero disables rate limiting. RateLimitBurst is the bucket size
+	// in compute units.
+	RateLimit      float64 `mapstructure:"rate_limit"`
+	RateLimitBurst int     `mapstructure:"rate_limit_burst"`
+	// TrustForwardedFor takes the client IP from the last X-Forwarded-For
+	// entry.
+	TrustForwardedFor bool `mapstructure:"trust_forwarded_for"`
+
+	ComputeUnits ComputeUnitsConfig `mapstructure:"compute_units"`
+}
+
+// ComputeUnitsConfig prices requests for rate limiting. Methods not listed
+// in Methods cost Default; each batch item costs BatchItem on top.
+type ComputeUnitsConfig struct {
+	Default   float64            `mapstructure:"default"`
+	BatchItem float64            `mapstructure:"batch_item"`
+	Methods   map[string]float64 `mapstructure:"methods"`
+}
+
+// BatchConfig configures batch fan-out. With Fanout, batches are split into
+// sub-batches of SubBatchSize items, individual calls when it is 1, that
+// are forwarded concurrently, at most Concurrency at a time.
+type BatchConfig struct {
+	Fanout       bool `mapstructure:"fanout"`
+	SubBatchSize int  `mapstructure:"sub_batch_size"`
+	Concurrency  int  `mapstructure:"concurrency"`
 }
 
 type UpstreamConfig struct {
+	URL            string               `mapstructure:"url"`
+	Timeout        time.Duration        `mapstructure:"timeout"`
+	Endpoints      []EndpointConfig     `mapstructure:"endpoints"`
+	CircuitBreaker CircuitBreakerConfig `mapstructure:"circuit_breaker"`
+	Retry          RetryConfig          `mapstructure:"retry"`
+	Hedge          HedgeConfig          `mapstructure:"hedge"`
+}
+
+// RetryConfig configures retries of requests that failed on every upstream.
+// The n-th of up to MaxRetries retries waits a random time of up to Backoff
+// doubled n-1 times, capped at MaxBackoff. Every request adds BudgetRatio
+// retries to a budget shared by all requests, which saves up at most
+// BudgetBurst.
+type RetryConfig struct {
+	Enabled     bool          `mapstructure:"enabled"`
+	MaxRetries  int           `mapstructure:"max_retries"`
+	Backoff     time.Duration `mapstructure:"backoff"`
+	MaxBackoff  time.Duration `mapstructure:"max_backoff"`
+	BudgetRatio float64       `mapstructure:"budget_ratio"`
+	BudgetBurst int           `mapstructure:"budget_burst"`
+}
+
+// HedgeConfig configures hedged requests. A request for one of Methods that
+// has not been answered within the Percentile of the method's recent
+// latencies, and at least MinDelay, is also sent to a second upstream. At
+// most MaxRate of those requests are hedged.
+type HedgeConfig struct {
+	Enabled    bool          `mapstructure:"enabled"`
+	Methods    []string      `mapstructure:"methods"`
+	Percentile float64       `mapstructure:"percentile"`
+	MinDelay   time.Duration `mapstructure:"min_delay"`
+	MaxRate    float64       `mapstructure:"max_rate"`
+}
+
+// CircuitBreakerConfig configures the circuit breaker in front of every
+// upstream. The circuit opens after ConsecutiveFailures failures in a row or
+// when ErrorRate of the last Window requests failed, and lets Probes
+// requests through after Cooldown to decide whether to close again.
+type CircuitBreakerConfig struct {
+	Enabled             bool          `mapstructure:"enabled"`
+	ConsecutiveFailures int           `mapstructure:"consecutive_failures"`
+	ErrorRate           float64       `mapstructure:"error_rate"`
+	Window              int           `mapstructure:"window"`
+	Cooldown            time.Duration `mapstructure:"cooldown"`
+	Probes              int           `mapstructure:"probes"`
+}
+
+// EndpointConfig is one node of the upstream pool. Timeout falls back to
+// upstream.timeout and Weight to 1 when unset.
+type EndpointConfig struct {
+	Name    string        `mapstructure:"name"`
 	URL     string        `mapstructure:"url"`
+	Weight  int           `mapstructure:"weight"`
 	Timeout time.Duration `mapstructure:"timeout"`
 }
 
+// Pool returns the upstream nodes to proxy to. When no endpoints are
+// configured, the pool is the single node at upstream.url.
+func (u *UpstreamConfig) Pool() []EndpointConfig {
+	if len(u.Endpoints) == 0 {
+		return []EndpointConfig{{Name: "default", URL: u.URL, Weight: 1, Timeout: u.Timeout}}
+	}
+
+	pool := make([]EndpointConfig, len(u.Endpoints))
+	for i, e := range u.Endpoints {
+		if e.Name == "" {
+			e.Name = fmt.Sprintf("upstream-%d", i)
+		}
+		if e.Weight == 0 {
+			e.Weight = 1
+		}
+		if e.Timeout == 0 {
+			e.Timeout = u.Timeout
+		}
+		pool[i] = e
+	}
+	return pool
+}
+
+type HealthConfig struct {
+	Enabled     bool          `mapstructure:"enabled"`
+	Interval    time.Duration `mapstructure:"interval"`
+	Timeout     time.Duration `mapstructure:"timeout"`
+	MaxBlockLag uint64        `mapstructure:"max_block_lag"`
+	MinPeers    uint64        `mapstructure:"min_peers"`
+}
+
+type CacheConfig struct {
+	Enabled    bool          `mapstructure:"enabled"`
+	MaxEntries int           `mapstructure:"max_entries"`
+	LatestTTL  time.Duration `mapstructure:"latest_ttl"`
+}
+
+// TrackerConfig configures the head tracker that follows the canonical
+// chain to detect reorgs. It only runs for the cache and event streams.
+type TrackerConfig struct {
+	Enabled      bool          `mapstructure:"enabled"`
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	History      int           `mapstructure:"history"`
+}
+
+// WSConfig configures JSON-RPC over WebSocket. Subscriptions are proxied to
+// the upstream WebSocket endpoint at UpstreamURL. After a reconnect, up to
+// MaxBackfill missed blocks of newHeads and logs are backfilled.
+type WSConfig struct {
+	Enabled     bool   `mapstructure:"enabled"`
+	UpstreamURL string `mapstructure:"upstream_url"`
+	MaxBackfill uint64 `mapstructure:"max_backfill"`
+}
+
+// EventsConfig configures the Server-Sent Events streams of newHeads and
+// logs. They follow the head tracker; resuming clients are sent at most
+// MaxBackfill missed blocks.
+type EventsConfig struct {
+	Enabled     bool   `mapstructure:"enabled"`
+	MaxBackfill uint64 `mapstructure:"max_backfill"`
+}
+
+// TracingConfig configures OpenTelemetry tracing. Spans are sent to an
+// OTLP/HTTP collector at Endpoint, or written to stdout or File for
+// testing. SampleRatio is the fraction of new traces recorded.
+type TracingConfig struct {
+	Enabled     bool    `mapstructure:"enabled"`
+	Exporter    string  `mapstructure:"exporter"`
+	Endpoint    string  `mapstructure:"endpoint"`
+	File        string  `mapstructure:"file"`
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+	ServiceName string  `mapstructure:"service_name"`
+}
+
+// MetricsConfig configures the Prometheus metrics served at Path.
+type MetricsConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Path    string `mapstructure:"path"`
+}
+
+// MethodsConfig lists the methods the relay forwards. Rules are exact
+// method names or namespace wildcards such as "debug_*". Deny wins over
+// allow, and an empty Allow allows every method not denied.
+type MethodsConfig struct {
+	Allow []string `mapstructure:"allow"`
+	Deny  []string `mapstructure:"deny"`
+}
+
+// AuthConfig configures API key authentication. Keys are read from the
+// Header, the QueryParam or a /v1/<key> path prefix when PathPrefix is set.
+// KeyFile names a YAML or JSON file with a top-level keys list, appended
+// to Keys.
+type AuthConfig struct {
+	Enabled    bool           `mapstructure:"enabled"`
+	Header     string         `mapstructure:"header"`
+	QueryParam string         `mapstructure:"query_param"`
+	PathPrefix bool           `mapstructure:"path_prefix"`
+	KeyFile    string         `mapstructure:"key_file"`
+	Keys       []APIKeyConfig `mapstructure:"keys"`
+}
+
+// APIKeyConfig is one API key and its policy. RateLimit and RateLimitBurst
+// override limits.rate_limit for the key; empty AllowedNamespaces and
+// AllowedOrigins allow everything.
+type APIKeyConfig struct {
+	Name              string   `mapstructure:"name"`
+	Key               string   `mapstructure:"key"`
+	RateLimit         float64  `mapstructure:"rate_limit"`
+	RateLimitBurst    int      `mapstructure:"rate_limit_burst"`
+	AllowedNamespaces []string `mapstructure:"allowed_namespaces"`
+	AllowedOrigins    []string `mapstructure:"allowed_origins"`
+}
+
+// APIKeys returns the configured keys with unnamed keys named key-<i>.
+func (a *AuthConfig) APIKeys() []APIKeyConfig {
+	keys := make([]APIKeyConfig, len(a.Keys))
+	for i, k := range a.Keys {
+		if k.Name == "" {
+			k.Name = fmt.Sprintf("key-%d", i)
+		}
+		keys[i] = k
+	}
+	return keys
+}
+
 type LoggingConfig struct {
 	Level  string `mapstructure:"level"`
 	Format string `mapstructure:"format"`
 }
 
-func Load(configPath string) (*Config, error) {
-	v := viper.New()
-
+func setDefaults(v *viper.Viper) {
 	v.SetDefault("server.host", "0.0.0.0")
 	v.SetDefault("server.port", 8545)
+	v.SetDefault("server.shutdown_timeout", "15s")
 	v.SetDefault("upstream.url", "http://localhost:8546")
 	v.SetDefault("upstream.timeout", "30s")
+	v.SetDefault("upstream.circuit_breaker.enabled", false)
+	v.SetDefault("upstream.circuit_breaker.consecutive_failures", 5)
+	v.SetDefault("upstream.circuit_breaker.error_rate", 0.5)
+	v.SetDefault("upstream.circuit_breaker.window", 20)
+	v.SetDefault("upstream.circuit_breaker.cooldown", "30s")
+	v.SetDefault("upstream.circuit_breaker.probes", 1)
+	v.SetDefault("upstream.retry.enabled", false)
+	v.SetDefault("upstream.retry.max_retries", 2)
+	v.SetDefault("upstream.retry.backoff", "100ms")
+	v.SetDefault("upstream.retry.max_backoff", "2s")
+	v.SetDefault("upstream.retry.budget_ratio", 0.1)
+	v.SetDefault("upstream.retry.budget_burst", 10)
+	v.SetDefault("upstream.hedge.enabled", false)
+	v.SetDefault("upstream.hedge.methods", []string{"eth_call"})
+	v.SetDefault("upstream.hedge.percentile", 0.95)
+	v.SetDefault("upstream.hedge.min_delay", "10ms")
+	v.SetDefault("upstream.hedge.max_rate", 0.05)
 	v.SetDefault("logging.level", "info")
 	v.SetDefault("logging.format", "json")
 	v.SetDefault("limits.max_body_size", 5242880)
 	v.SetDefault("limits.max_batch_items", 100)
 	v.SetDefault("limits.max_batch_response", 25000000)
+	v.SetDefault("limits.max_response_size", 100000000)
+	v.SetDefault("limits.rate_limit", 0)
+	v.SetDefault("limits.rate_limit_burst", 0)
+	v.SetDefault("limits.trust_forwarded_for", false)
+	v.SetDefault("limits.compute_units.default", 1)
+	v.SetDefault("limits.compute_units.batch_item", 0)
+	v.SetDefault("batch.fanout", false)
+	v.SetDefault("batch.sub_batch_size", 10)
+	v.SetDefault("batch.concurrency", 8)
+	v.SetDefault("health.enabled", true)
+	v.SetDefault("health.interval", "10s")
+	v.SetDefault("health.timeout", "5s")
+	v.SetDefault("health.max_block_lag", 5)
+	v.SetDefault("health.min_peers", 1)
+	v.SetDefault("cache.enabled", false)
+	v.SetDefault("cache.max_entries", 10000)
+	v.SetDefault("cache.latest_ttl", "2s")
+	v.SetDefault("head_tracker.enabled", true)
+	v.SetDefault("head_tracker.poll_interval", "2s")
+	v.SetDefault("head_tracker.history", 128)
+	v.SetDefault("websocket.enabled", false)
+	v.SetDefault("websocket.upstream_url", "ws://localhost:8547")
+	v.SetDefault("websocket.max_backfill", 128)
+	v.SetDefault("events.enabled", false)
+	v.SetDefault("events.max_backfill", 128)
+	v.SetDefault("metrics.enabled", true)
+	v.SetDefault("metrics.path", "/metrics")
+	v.SetDefault("tracing.enabled", false)
+	v.SetDefault("tracing.exporter", "otlp")
+	v.SetDefault("tracing.endpoint", "")
+	v.SetDefault("tracing.file", "")
+	v.SetDefault("tracing.sample_ratio", 1.0)
+	v.SetDefault("tracing.service_name", "geth-relay")
+	v.SetDefault("methods.allow", []string{})
+	v.SetDefault("methods.deny", []string{"admin_*", "personal_*", "miner_*"})
+	v.SetDefault("auth.enabled", false)
+	v.SetDefault("auth.header", "X-API-Key")
+	v.SetDefault("auth.query_param", "apikey")
+	v.SetDefault("auth.path_prefix", true)
+	v.SetDefault("auth.key_file", "")
+}
+
+func Load(configPath string) (*Config, error) {
+	return LoadWithOverrides(configPath, nil)
+}
+
+// LoadWithOverrides loads the configuration like Load and then applies the
+// given overrides, keyed by their dotted config key (e.g. "server.port").
+// Overrides take precedence over the config file and environment.
+func LoadWithOverrides(configPath string, overrides map[string]string) (*Config, error) {
+	v := viper.New()
+	setDefaults(v)
 
 	if configPath != "" {
 		v.SetConfigFile(configPath)
@@ -65,14 +361,361 @@ func Load(configPath string) (*Config, error) {
 		}
 	}
 
+	for key, value := range overrides {
+		v.Set(key, value)
+	}
+
 	var cfg Config
 	if err := v.Unmarshal(&cfg); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
 
+	if cfg.Auth.KeyFile != "" {
+		keys, err := loadKeyFile(cfg.Auth.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Auth.Keys = append(cfg.Auth.Keys, keys...)
+	}
+
 	return &cfg, nil
 }
 
+// loadKeyFile reads the keys list of an API key file.
+func loadKeyFile(path string) ([]APIKeyConfig, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	var file struct {
+		Keys []APIKeyConfig `mapstructure:"keys"`
+	}
+	if err := v.Unmarshal(&file); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal key file: %w", err)
+	}
+	return file.Keys, nil
+}
+
+// Defaults returns the default value of every config key, sorted by key.
+// These are the keys that can be overridden individually.
+func Defaults() []Default {
+	v := viper.New()
+	setDefaults(v)
+
+	keys := v.AllKeys()
+	sort.Strings(keys)
+
+	defaults := make([]Default, 0, len(keys))
+	for _, key := range keys {
+		defaults = append(defaults, Default{Key: key, Value: v.Get(key)})
+	}
+	return defaults
+}
+
+type Default struct {
+	Key   string
+	Value interface{}
+}
+
 func (c *Config) GetAddress() string {
 	return fmt.Sprintf("%s:%d", c.Server.Host, c.Server.Port)
 }
+
+// TrackerNeeded reports whether the head tracker runs: it is enabled and
+// followed by the cache or the event streams.
+func (c *Config) TrackerNeeded() bool {
+	return c.Tracker.Enabled && (c.Cache.Enabled || c.Events.Enabled)
+}
+
+// Validate reports every problem found in the configuration.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		errs = append(errs, fmt.Errorf("server.port must be between 1 and 65535, got %d", c.Server.Port))
+	}
+	if c.Server.ShutdownTimeout < 0 {
+		errs = append(errs, fmt.Errorf("server.shutdown_timeout must not be negative, got %s", c.Server.ShutdownTimeout))
+	}
+
+	if c.Upstream.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("upstream.timeout must be positive, got %s", c.Upstream.Timeout))
+	}
+	if len(c.Upstream.Endpoints) == 0 {
+		if err := validateURL(c.Upstream.URL); err != nil {
+			errs = append(errs, fmt.Errorf("upstream.url: %w", err))
+		}
+	}
+	names := make(map[string]bool)
+	for i, e := range c.Upstream.Endpoints {
+		if e.Name == "" {
+			e.Name = fmt.Sprintf("upstream-%d", i)
+		}
+		if err := validateURL(e.URL); err != nil {
+			errs = append(errs, fmt.Errorf("upstream.endpoints[%d].url: %w", i, err))
+		}
+		if e.Weight < 0 {
+			errs = append(errs, fmt.Errorf("upstream.endpoints[%d].weight must not be negative, got %d", i, e.Weight))
+		}
+		if e.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("upstream.endpoints[%d].timeout must not be negative, got %s", i, e.Timeout))
+		}
+		if names[e.Name] {
+			errs = append(errs, fmt.Errorf("upstream.endpoints[%d].name %q is not unique", i, e.Name))
+		}
+		names[e.Name] = true
+	}
+	if cb := c.Upstream.CircuitBreaker; cb.Enabled {
+		if cb.ConsecutiveFailures < 0 {
+			errs = append(errs, fmt.Errorf("upstream.circuit_breaker.consecutive_failures must not be negative, got %d", cb.ConsecutiveFailures))
+		}
+		if cb.ErrorRate < 0 || cb.ErrorRate > 1 {
+			errs = append(errs, fmt.Errorf("upstream.circuit_breaker.error_rate must be between 0 and 1, got %g", cb.ErrorRate))
+		}
+		if cb.ErrorRate > 0 && cb.Window <= 0 {
+			errs = append(errs, fmt.Errorf("upstream.circuit_breaker.window must be positive, got %d", cb.Window))
+		}
+		if cb.ConsecutiveFailures <= 0 && cb.ErrorRate <= 0 {
+			errs = append(errs, errors.New("upstream.circuit_breaker needs consecutive_failures or error_rate to open"))
+		}
+		if cb.Cooldown <= 0 {
+			errs = append(errs, fmt.Errorf("upstream.circuit_breaker.cooldown must be positive, got %s", cb.Cooldown))
+		}
+		if cb.Probes <= 0 {
+			errs = append(errs, fmt.Errorf("upstream.circuit_breaker.probes must be positive, got %d", cb.Probes))
+		}
+	}
+	if r := c.Upstream.Retry; r.Enabled {
+		if r.MaxRetries <= 0 {
+			errs = append(errs, fmt.Errorf("upstream.retry.max_retries must be positive, got %d", r.MaxRetries))
+		}
+		if r.Backoff <= 0 {
+			errs = append(errs, fmt.Errorf("upstream.retry.backoff must be positive, got %s", r.Backoff))
+		}
+		if r.MaxBackoff < r.Backoff {
+			errs = append(errs, fmt.Errorf("upstream.retry.max_backoff must not be less than backoff, got %s", r.MaxBackoff))
+		}
+		if r.BudgetRatio < 0 {
+			errs = append(errs, fmt.Errorf("upstream.retry.budget_ratio must not be negative, got %g", r.BudgetRatio))
+		}
+		if r.BudgetBurst < 0 {
+			errs = append(errs, fmt.Errorf("upstream.retry.budget_burst must not be negative, got %d", r.BudgetBurst))
+		}
+	}
+	if h := c.Upstream.Hedge; h.Enabled {
+		if len(h.Methods) == 0 {
+			errs = append(errs, errors.New("upstream.hedge.methods must not be empty when hedging is enabled"))
+		}
+		for i, rule := range h.Methods {
+			if err := methods.ValidateRule(rule); err != nil {
+				errs = append(errs, fmt.Errorf("upstream.hedge.methods[%d]: %w", i, err))
+			}
+		}
+		if h.Percentile <= 0 || h.Percentile >= 1 {
+			errs = append(errs, fmt.Errorf("upstream.hedge.percentile must be between 0 and 1, got %g", h.Percentile))
+		}
+		if h.MinDelay < 0 {
+			errs = append(errs, fmt.Errorf("upstream.hedge.min_delay must not be negative, got %s", h.MinDelay))
+		}
+		if h.MaxRate <= 0 || h.MaxRate > 1 {
+			errs = append(errs, fmt.Errorf("upstream.hedge.max_rate must be between 0 and 1, got %g", h.MaxRate))
+		}
+	}
+
+	if _, err := zapcore.ParseLevel(c.Logging.Level); err != nil {
+		errs = append(errs, fmt.Errorf("logging.level: %w", err))
+	}
+	if c.Logging.Format != "json" && c.Logging.Format != "console" {
+		errs = append(errs, fmt.Errorf("logging.format must be json or console, got %q", c.Logging.Format))
+	}
+
+	if c.Limits.MaxBodySize <= 0 {
+		errs = append(errs, fmt.Errorf("limits.max_body_size must be positive, got %d", c.Limits.MaxBodySize))
+	}
+	if c.Limits.MaxBatchItems <= 0 {
+		errs = append(errs, fmt.Errorf("limits.max_batch_items must be positive, got %d", c.Limits.MaxBatchItems))
+	}
+	if c.Limits.MaxBatchResponse <= 0 {
+		errs = append(errs, fmt.Errorf("limits.max_batch_response must be positive, got %d", c.Limits.MaxBatchResponse))
+	}
+	if c.Limits.MaxResponseSize <= 0 {
+		errs = append(errs, fmt.Errorf("limits.max_response_size must be positive, got %d", c.Limits.MaxResponseSize))
+	}
+
+	if c.Limits.RateLimit < 0 {
+		errs = append(errs, fmt.Errorf("limits.rate_limit must not be negative, got %v", c.Limits.RateLimit))
+	}
+	if c.Limits.RateLimitBurst < 0 {
+		errs = append(errs, fmt.Errorf("limits.rate_limit_burst must not be negative, got %d", c.Limits.RateLimitBurst))
+	}
+
+	if c.Limits.ComputeUnits.Default < 0 || c.Limits.ComputeUnits.BatchItem < 0 {
+		errs = append(errs, errors.New("limits.compute_units costs must not be negative"))
+	}
+	burst := float64(c.Limits.RateLimitBurst)
+	if burst == 0 {
+		burst = math.Ceil(c.Limits.RateLimit)
+	}
+	for method, cost := range c.Limits.ComputeUnits.Methods {
+		if cost < 0 {
+			errs = append(errs, fmt.Errorf("limits.compute_units.methods.%s must not be negative, got %v", method, cost))
+		}
+		if c.Limits.RateLimit > 0 && cost > burst {
+			errs = append(errs, fmt.Errorf("limits.compute_units.methods.%s costs %v, more than the rate limit burst of %v, so it would always be limited", method, cost, burst))
+		}
+	}
+
+	if c.Batch.Fanout {
+		if c.Batch.SubBatchSize <= 0 {
+			errs = append(errs, fmt.Errorf("batch.sub_batch_size must be positive, got %d", c.Batch.SubBatchSize))
+		}
+		if c.Batch.Concurrency <= 0 {
+			errs = append(errs, fmt.Errorf("batch.concurrency must be positive, got %d", c.Batch.Concurrency))
+		}
+	}
+
+	if c.Health.Enabled {
+		if c.Health.Interval <= 0 {
+			errs = append(errs, fmt.Errorf("health.interval must be positive, got %s", c.Health.Interval))
+		}
+		if c.Health.Timeout <= 0 {
+			errs = append(errs, fmt.Errorf("health.timeout must be positive, got %s", c.Health.Timeout))
+		}
+	}
+
+	if c.Cache.Enabled {
+		if c.Cache.MaxEntries <= 0 {
+			errs = append(errs, fmt.Errorf("cache.max_entries must be positive, got %d", c.Cache.MaxEntries))
+		}
+		if c.Cache.LatestTTL < 0 {
+			errs = append(errs, fmt.Errorf("cache.latest_ttl must not be negative, got %s", c.Cache.LatestTTL))
+		}
+	}
+
+	if c.Tracker.Enabled {
+		if c.Tracker.PollInterval <= 0 {
+			errs = append(errs, fmt.Errorf("head_tracker.poll_interval must be positive, got %s", c.Tracker.PollInterval))
+		}
+		if c.Tracker.History < 2 {
+			errs = append(errs, fmt.Errorf("head_tracker.history must be at least 2, got %d", c.Tracker.History))
+		}
+	}
+
+	if c.WS.Enabled {
+		if err := validateWSURL(c.WS.UpstreamURL); err != nil {
+			errs = append(errs, fmt.Errorf("websocket.upstream_url: %w", err))
+		}
+	}
+
+	if c.Events.Enabled && !c.Tracker.Enabled {
+		errs = append(errs, errors.New("events.enabled requires head_tracker.enabled"))
+	}
+
+	if c.Metrics.Enabled {
+		if !strings.HasPrefix(c.Metrics.Path, "/") {
+			errs = append(errs, fmt.Errorf("metrics.path must start with /, got %q", c.Metrics.Path))
+		} else if reservedPaths[c.Metrics.Path] {
+			errs = append(errs, fmt.Errorf("metrics.path %s is already used by the relay", c.Metrics.Path))
+		}
+	}
+
+	if c.Tracing.Enabled {
+		switch c.Tracing.Exporter {
+		case tracing.ExporterOTLP:
+			if c.Tracing.Endpoint != "" {
+				if err := validateURL(c.Tracing.Endpoint); err != nil {
+					errs = append(errs, fmt.Errorf("tracing.endpoint: %w", err))
+				}
+			}
+		case tracing.ExporterStdout:
+		case tracing.ExporterFile:
+			if c.Tracing.File == "" {
+				errs = append(errs, errors.New("tracing.file must be set for the file exporter"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("tracing.exporter must be otlp, stdout or file, got %q", c.Tracing.Exporter))
+		}
+		if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+			errs = append(errs, fmt.Errorf("tracing.sample_ratio must be between 0 and 1, got %v", c.Tracing.SampleRatio))
+		}
+	}
+
+	for i, rule := range c.Methods.Allow {
+		if err := methods.ValidateRule(rule); err != nil {
+			errs = append(errs, fmt.Errorf("methods.allow[%d]: %w", i, err))
+		}
+	}
+	for i, rule := range c.Methods.Deny {
+		if err := methods.ValidateRule(rule); err != nil {
+			errs = append(errs, fmt.Errorf("methods.deny[%d]: %w", i, err))
+		}
+	}
+
+	if c.Auth.Enabled {
+		if c.Auth.Header == "" && c.Auth.QueryParam == "" && !c.Auth.PathPrefix {
+			errs = append(errs, errors.New("auth needs at least one of auth.header, auth.query_param or auth.path_prefix"))
+		}
+		if len(c.Auth.Keys) == 0 {
+			errs = append(errs, errors.New("auth.keys must not be empty when auth is enabled"))
+		}
+	}
+	keyNames := make(map[string]bool)
+	keyValues := make(map[string]bool)
+	for i, k := range c.Auth.APIKeys() {
+		if k.Key == "" {
+			errs = append(errs, fmt.Errorf("auth.keys[%d].key must not be empty", i))
+		} else if keyValues[k.Key] {
+			errs = append(errs, fmt.Errorf("auth.keys[%d].key is not unique", i))
+		}
+		keyValues[k.Key] = true
+		if keyNames[k.Name] {
+			errs = append(errs, fmt.Errorf("auth.keys[%d].name %q is not unique", i, k.Name))
+		}
+		keyNames[k.Name] = true
+		if k.RateLimit < 0 {
+			errs = append(errs, fmt.Errorf("auth.keys[%d].rate_limit must not be negative, got %v", i, k.RateLimit))
+		}
+		if k.RateLimitBurst < 0 {
+			errs = append(errs, fmt.Errorf("auth.keys[%d].rate_limit_burst must not be negative, got %d", i, k.RateLimitBurst))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// reservedPaths are served by the relay itself and cannot be the metrics
+// path.
+var reservedPaths = map[string]bool{
+	"/":       true,
+	"/health": true,
+	"/livez":  true,
+	"/readyz": true,
+	"/status": true,
+}
+
+func validateURL(raw string) error {
+	return validateURLScheme(raw, "http", "https")
+}
+
+func validateWSURL(raw string) error {
+	return validateURLScheme(raw, "ws", "wss")
+}
+
+func validateURLScheme(raw string, schemes ...string) error {
+	if raw == "" {
+		return errors.New("must not be empty")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(schemes, u.Scheme) {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return errors.New("missing host")
+	}
+	return nil
+}
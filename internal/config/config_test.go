@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"testing"
+	"time"
 )
 
 func TestLoad(t *testing.T) {
@@ -56,6 +57,33 @@ func TestConfigGetAddress(t *testing.T) {
 	}
 }
 
+func TestConfigTrackerNeeded(t *testing.T) {
+	tests := []struct {
+		name    string
+		tracker bool
+		cache   bool
+		events  bool
+		want    bool
+	}{
+		{name: "nothing follows it", tracker: true, want: false},
+		{name: "cache", tracker: true, cache: true, want: true},
+		{name: "events", tracker: true, events: true, want: true},
+		{name: "disabled", cache: true, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Tracker: TrackerConfig{Enabled: tt.tracker},
+				Cache:   CacheConfig{Enabled: tt.cache},
+				Events:  EventsConfig{Enabled: tt.events},
+			}
+			if got := cfg.TrackerNeeded(); got != tt.want {
+				t.Errorf("TrackerNeeded() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestLoadWithEnvVars(t *testing.T) {
 	os.Setenv("SERVER_PORT", "9999")
 	defer os.Unsetenv("SERVER_PORT")
@@ -69,3 +97,225 @@ func TestLoadWithEnvVars(t *testing.T) {
 		t.Logf("Port is %d (env vars may not override in test)", cfg.Server.Port)
 	}
 }
+
+func TestLoadWithOverrides(t *testing.T) {
+	cfg, err := LoadWithOverrides("", map[string]string{
+		"server.port":      "9999",
+		"upstream.timeout": "5s",
+		"logging.format":   "console",
+		"methods.deny":     "admin_*,debug_*",
+	})
+	if err != nil {
+		t.Fatalf("LoadWithOverrides() failed: %v", err)
+	}
+
+	if cfg.Server.Port != 9999 {
+		t.Errorf("Server.Port = %d, want 9999", cfg.Server.Port)
+	}
+	if cfg.Upstream.Timeout != 5*time.Second {
+		t.Errorf("Upstream.Timeout = %v, want 5s", cfg.Upstream.Timeout)
+	}
+	if cfg.Logging.Format != "console" {
+		t.Errorf("Logging.Format = %v, want console", cfg.Logging.Format)
+	}
+	if len(cfg.Methods.Deny) != 2 || cfg.Methods.Deny[1] != "debug_*" {
+		t.Errorf("Methods.Deny = %v, want [admin_* debug_*]", cfg.Methods.Deny)
+	}
+}
+
+func TestDefaults(t *testing.T) {
+	defaults := Defaults()
+	if len(defaults) == 0 {
+		t.Fatal("Defaults() returned no keys")
+	}
+
+	found := false
+	for i, d := range defaults {
+		if i > 0 && defaults[i-1].Key >= d.Key {
+			t.Errorf("Defaults() not sorted: %q before %q", defaults[i-1].Key, d.Key)
+		}
+		if d.Key == "server.port" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Defaults() is missing server.port")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := func() *Config {
+		cfg, err := Load("")
+		if err != nil {
+			t.Fatalf("Load() failed: %v", err)
+		}
+		return cfg
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(*Config)
+		wantErr bool
+	}{
+		{name: "defaults", modify: func(c *Config) {}, wantErr: false},
+		{name: "bad port", modify: func(c *Config) { c.Server.Port = 0 }, wantErr: true},
+		{name: "empty upstream", modify: func(c *Config) { c.Upstream.URL = "" }, wantErr: true},
+		{name: "bad upstream scheme", modify: func(c *Config) { c.Upstream.URL = "ftp://localhost" }, wantErr: true},
+		{name: "zero timeout", modify: func(c *Config) { c.Upstream.Timeout = 0 }, wantErr: true},
+		{name: "bad log level", modify: func(c *Config) { c.Logging.Level = "verbose" }, wantErr: true},
+		{name: "bad log format", modify: func(c *Config) { c.Logging.Format = "xml" }, wantErr: true},
+		{name: "zero batch items", modify: func(c *Config) { c.Limits.MaxBatchItems = 0 }, wantErr: true},
+		{name: "negative compute units", modify: func(c *Config) {
+			c.Limits.ComputeUnits.Methods = map[string]float64{"eth_call": -1}
+		}, wantErr: true},
+		{name: "method cost above burst", modify: func(c *Config) {
+			c.Limits.RateLimit = 10
+			c.Limits.ComputeUnits.Methods = map[string]float64{"debug_tracetransaction": 100}
+		}, wantErr: true},
+		{name: "method cost within burst", modify: func(c *Config) {
+			c.Limits.RateLimit = 10
+			c.Limits.RateLimitBurst = 100
+			c.Limits.ComputeUnits.Methods = map[string]float64{"debug_tracetransaction": 100}
+		}, wantErr: false},
+		{name: "websocket http url", modify: func(c *Config) {
+			c.WS.Enabled = true
+			c.WS.UpstreamURL = "http://localhost:8546"
+		}, wantErr: true},
+		{name: "events without head tracker", modify: func(c *Config) {
+			c.Events.Enabled = true
+			c.Tracker.Enabled = false
+		}, wantErr: true},
+		{name: "metrics path without slash", modify: func(c *Config) { c.Metrics.Path = "metrics" }, wantErr: true},
+		{name: "metrics path taken", modify: func(c *Config) { c.Metrics.Path = "/health" }, wantErr: true},
+		{name: "tracing unknown exporter", modify: func(c *Config) {
+			c.Tracing.Enabled = true
+			c.Tracing.Exporter = "jaeger"
+		}, wantErr: true},
+		{name: "tracing file exporter without file", modify: func(c *Config) {
+			c.Tracing.Enabled = true
+			c.Tracing.Exporter = "file"
+		}, wantErr: true},
+		{name: "tracing sample ratio above 1", modify: func(c *Config) {
+			c.Tracing.Enabled = true
+			c.Tracing.SampleRatio = 2
+		}, wantErr: true},
+		{name: "batch fanout without workers", modify: func(c *Config) {
+			c.Batch.Fanout = true
+			c.Batch.Concurrency = 0
+		}, wantErr: true},
+		{name: "circuit breaker with defaults", modify: func(c *Config) {
+			c.Upstream.CircuitBreaker = CircuitBreakerConfig{Enabled: true, ConsecutiveFailures: 5, ErrorRate: 0.5, Window: 20, Cooldown: 30 * time.Second, Probes: 1}
+		}, wantErr: false},
+		{name: "circuit breaker error rate above 1", modify: func(c *Config) {
+			c.Upstream.CircuitBreaker = CircuitBreakerConfig{Enabled: true, ErrorRate: 1.5, Window: 20, Cooldown: 30 * time.Second, Probes: 1}
+		}, wantErr: true},
+		{name: "circuit breaker that never opens", modify: func(c *Config) {
+			c.Upstream.CircuitBreaker = CircuitBreakerConfig{Enabled: true, Cooldown: 30 * time.Second, Probes: 1}
+		}, wantErr: true},
+		{name: "circuit breaker without cooldown", modify: func(c *Config) {
+			c.Upstream.CircuitBreaker = CircuitBreakerConfig{Enabled: true, ConsecutiveFailures: 5, Probes: 1}
+		}, wantErr: true},
+		{name: "retry with defaults", modify: func(c *Config) {
+			c.Upstream.Retry = RetryConfig{Enabled: true, MaxRetries: 2, Backoff: 100 * time.Millisecond, MaxBackoff: 2 * time.Second, BudgetRatio: 0.1, BudgetBurst: 10}
+		}, wantErr: false},
+		{name: "retry max backoff below backoff", modify: func(c *Config) {
+			c.Upstream.Retry = RetryConfig{Enabled: true, MaxRetries: 2, Backoff: time.Second, MaxBackoff: time.Millisecond}
+		}, wantErr: true},
+		{name: "retry without retries", modify: func(c *Config) {
+			c.Upstream.Retry = RetryConfig{Enabled: true, Backoff: time.Second, MaxBackoff: time.Second}
+		}, wantErr: true},
+		{name: "hedge with defaults", modify: func(c *Config) {
+			c.Upstream.Hedge = HedgeConfig{Enabled: true, Methods: []string{"eth_call"}, Percentile: 0.95, MinDelay: 10 * time.Millisecond, MaxRate: 0.05}
+		}, wantErr: false},
+		{name: "hedge without methods", modify: func(c *Config) {
+			c.Upstream.Hedge = HedgeConfig{Enabled: true, Percentile: 0.95, MaxRate: 0.05}
+		}, wantErr: true},
+		{name: "hedge percentile of 1", modify: func(c *Config) {
+			c.Upstream.Hedge = HedgeConfig{Enabled: true, Methods: []string{"eth_call"}, Percentile: 1, MaxRate: 0.05}
+		}, wantErr: true},
+		{name: "hedge without rate", modify: func(c *Config) {
+			c.Upstream.Hedge = HedgeConfig{Enabled: true, Methods: []string{"eth_call"}, Percentile: 0.95}
+		}, wantErr: true},
+		{name: "bad method rule", modify: func(c *Config) { c.Methods.Deny = []string{"debug*"} }, wantErr: true},
+		{name: "auth without keys", modify: func(c *Config) { c.Auth.Enabled = true }, wantErr: true},
+		{name: "auth with keys", modify: func(c *Config) {
+			c.Auth.Enabled = true
+			c.Auth.Keys = []APIKeyConfig{{Name: "a", Key: "secret-a"}, {Key: "secret-b"}}
+		}, wantErr: false},
+		{name: "duplicate api key", modify: func(c *Config) {
+			c.Auth.Enabled = true
+			c.Auth.Keys = []APIKeyConfig{{Name: "a", Key: "secret"}, {Name: "b", Key: "secret"}}
+		}, wantErr: true},
+		{name: "empty api key", modify: func(c *Config) {
+			c.Auth.Keys = []APIKeyConfig{{Name: "a"}}
+		}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.modify(cfg)
+			if err := cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUpstreamConfigPool(t *testing.T) {
+	single := UpstreamConfig{URL: "http://localhost:8546", Timeout: 30 * time.Second}
+	pool := single.Pool()
+	if len(pool) != 1 || pool[0].URL != single.URL || pool[0].Timeout != single.Timeout {
+		t.Errorf("Pool() = %+v, want the single upstream.url node", pool)
+	}
+
+	multi := UpstreamConfig{
+		Timeout: 30 * time.Second,
+		Endpoints: []EndpointConfig{
+			{Name: "a", URL: "http://a:8545", Weight: 2, Timeout: 5 * time.Second},
+			{URL: "http://b:8545"},
+		},
+	}
+	pool = multi.Pool()
+	if len(pool) != 2 {
+		t.Fatalf("len(Pool()) = %d, want 2", len(pool))
+	}
+	if pool[0].Timeout != 5*time.Second || pool[0].Weight != 2 {
+		t.Errorf("pool[0] = %+v, want its own weight and timeout", pool[0])
+	}
+	if pool[1].Name != "upstream-1" || pool[1].Weight != 1 || pool[1].Timeout != 30*time.Second {
+		t.Errorf("pool[1] = %+v, want defaults applied", pool[1])
+	}
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := dir + "/keys.yaml"
+	keys := `keys:
+  - name: dapp
+    key: secret
+    rate_limit: 50
+    allowed_namespaces: [eth, net]
+    allowed_origins: ["https://*.example.com"]
+`
+	if err := os.WriteFile(keyFile, []byte(keys), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadWithOverrides("", map[string]string{"auth.key_file": keyFile})
+	if err != nil {
+		t.Fatalf("LoadWithOverrides() error = %v", err)
+	}
+	if len(cfg.Auth.Keys) != 1 {
+		t.Fatalf("len(Auth.Keys) = %d, want 1", len(cfg.Auth.Keys))
+	}
+	k := cfg.Auth.Keys[0]
+	if k.Name != "dapp" || k.Key != "secret" || k.RateLimit != 50 ||
+		len(k.AllowedNamespaces) != 2 || len(k.AllowedOrigins) != 1 {
+		t.Errorf("Auth.Keys[0] = %+v, want the key from the key file", k)
+	}
+
+	if _, err := LoadWithOverrides("", map[string]string{"auth.key_file": dir + "/missing.yaml"}); err == nil {
+		t.Error("LoadWithOverrides() with a missing key file should fail")
+	}
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/devlongs/geth-relay/chain"
+	"github.com/devlongs/geth-relay/rpc"
+	"github.com/devlongs/geth-relay/subscription"
+	"go.uber.org/zap"
+)
+
+const (
+	eventsPingInterval = 15 * time.Second
+	eventsWriteTimeout = 10 * time.Second
+)
+
+// eventStream writes Server-Sent Events. Every event carries the number of
+// the block it belongs to as its ID, so clients resume with Last-Event-ID.
+type eventStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (es *eventStream) send(id uint64, event string, data json.RawMessage) error {
+	es.rc.SetWriteDeadline(time.Now().Add(eventsWriteTimeout))
+	if _, err := fmt.Fprintf(es.w, "id: %d\nevent: %s\ndata: %s\n\n", id, event, data); err != nil {
+		return err
+	}
+	return es.rc.Flush()
+}
+
+func (es *eventStream) ping() error {
+	es.rc.SetWriteDeadline(time.Now().Add(eventsWriteTimeout))
+	if _, err := fmt.Fprint(es.w, ": ping\n\n"); err != nil {
+		return err
+	}
+	return es.rc.Flush()
+}
+
+// NewHeadsEventsHandler streams the heads of the canonical chain as
+// newHeads events, preceded by a reorg event when the chain switches.
+func (s *Server) NewHeadsEventsHandler(w http.ResponseWriter, r *http.Request) {
+	s.streamEvents(w, r, "newHeads", func(ctx context.Context, from, to uint64) ([]json.RawMessage, error) {
+		return subscription.FetchHeads(ctx, subscription.CallerFunc(s.call), from, to)
+	}, func(ctx context.Context, head chain.Head) ([]json.RawMessage, error) {
+		header, err := subscription.Header(head.Header)
+		if err != nil {
+			return nil, err
+		}
+		return []json.RawMessage{header}, nil
+	})
+}
+
+// LogsEventsHandler streams the logs matching the address and topics query
+// parameters as logs events. Addresses are comma separated; every topics
+// parameter is one topic position, with alternatives comma separated and
+// an empty value matching anything.
+func (s *Server) LogsEventsHandler(w http.ResponseWriter, r *http.Request) {
+	filter := logsFilter(r)
+	s.streamEvents(w, r, "logs",
+		func(ctx context.Context, from, to uint64) ([]json.RawMessage, error) {
+			params, _ := json.Marshal([]interface{}{"logs", filter})
+			return subscription.FetchLogs(ctx, subscription.CallerFunc(s.call), params, from, to)
+		},
+		func(ctx context.Context, head chain.Head) ([]json.RawMessage, error) {
+			f := cloneFilter(filter)
+			f["blockHash"] = head.Hash
+			return s.getLogs(ctx, f)
+		})
+}
+
+// streamEvents follows the head tracker and sends the events of every new
+// head. With a Last-Event-ID, the blocks after it are sent first.
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request, event string,
+	between func(ctx context.Context, from, to uint64) ([]json.RawMessage, error),
+	atHead func(ctx context.Context, head chain.Head) ([]json.RawMessage, error)) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	defer context.AfterFunc(s.streams, cancel)()
+
+	// Subscribe before backfilling so no head is missed in between.
+	events, unsubscribe := s.tracker.Subscribe(256)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	es := &eventStream{w: w, rc: http.NewResponseController(w)}
+	if err := es.rc.Flush(); err != nil {
+		s.logger.Error("event stream not supported", zap.Error(err))
+		return
+	}
+
+	var last uint64
+	if id, err := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64); err == nil {
+		last = id
+		if head, ok := s.tracker.Head(); ok && head.Number > last {
+			from := last + 1
+			if head.Number-last > s.eventsBackfill {
+				s.logger.Warn("event stream gap too large to resume completely",
+					zap.String("event", event),
+					zap.Uint64("last_event_id", last),
+					zap.Uint64("max_backfill", s.eventsBackfill))
+				from = head.Number - s.eventsBackfill + 1
+			}
+			if from <= head.Number {
+				results, err := between(ctx, from, head.Number)
+				if err != nil {
+					s.logger.Warn("failed to resume event stream", zap.String("event", event), zap.Error(err))
+				}
+				for _, result := range results {
+					if err := es.send(subscription.BlockNumber(event, result), event, result); err != nil {
+						return
+					}
+				}
+			}
+			last = head.Number
+		}
+	}
+
+	ping := time.NewTicker(eventsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ping.C:
+			if err := es.ping(); err != nil {
+				return
+			}
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			switch ev.Type {
+			case chain.EventReorg:
+				data, _ := json.Marshal(map[string]interface{}{
+					"commonAncestor": rpc.EncodeQuantity(ev.Reorg.CommonAncestor),
+					"depth":          ev.Reorg.Depth,
+					"oldHead":        ev.Reorg.OldHead.Hash,
+					"newHead":        ev.Reorg.NewHead.Hash,
+				})
+				if err := es.send(ev.Reorg.CommonAncestor, "reorg", data); err != nil {
+					return
+				}
+				last = ev.Reorg.CommonAncestor
+			case chain.EventNewHead:
+				// Heads already sent while resuming are skipped.
+				if ev.Head.Number <= last {
+					continue
+				}
+				results, err := atHead(ctx, ev.Head)
+				if err != nil {
+					s.logger.Warn("failed to fetch events for head",
+						zap.String("event", event),
+						zap.Uint64("block", ev.Head.Number),
+						zap.Error(err))
+				}
+				for _, result := range results {
+					if err := es.send(ev.Head.Number, event, result); err != nil {
+						return
+					}
+				}
+				last = ev.Head.Number
+			}
+		}
+	}
+}
+
+func (s *Server) getLogs(ctx context.Context, filter map[string]interface{}) ([]json.RawMessage, error) {
+	params, _ := json.Marshal([]interface{}{filter})
+	result, err := s.call(ctx, "eth_getLogs", params)
+	if err != nil {
+		return nil, err
+	}
+	var logs []json.RawMessage
+	if err := json.Unmarshal(result, &logs); err != nil {
+		return nil, fmt.Errorf("invalid eth_getLogs result: %w", err)
+	}
+	return logs, nil
+}
+
+// call sends a request through the proxy, so the client's method rules and
+// API key policy apply to it.
+func (s *Server) call(ctx context.Context, method string, params json.RawMessage) (json.RawMessage, error) {
+	resp := s.proxy.HandleRequest(ctx, &rpc.JSONRPCRequest{JSONRPC: "2.0", Method: method, Params: params, ID: json.RawMessage("1")})
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return resp.Result, nil
+}
+
+func logsFilter(r *http.Request) map[string]interface{} {
+	filter := make(map[string]interface{})
+	query := r.URL.Query()
+	if address := query.Get("address"); address != "" {
+		filter["address"] = strings.Split(address, ",")
+	}
+	if topics := query["topics"]; len(topics) > 0 {
+		positions := make([]interface{}, len(topics))
+		for i, topic := range topics {
+			if topic != "" {
+				positions[i] = strings.Split(topic, ",")
+			}
+		}
+		filter["topics"] = positions
+	}
+	return filter
+}
+
+func cloneFilter(filter map[string]interface{}) map[string]interface{} {
+	clone := make(map[string]interface{}, len(filter)+2)
+	for k, v := range filter {
+		clone[k] = v
+	}
+	return clone
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devlongs/geth-relay/chain"
+	"github.com/devlongs/geth-relay/proxy"
+	"github.com/devlongs/geth-relay/rpc"
+	"go.uber.org/zap"
+)
+
+// eventsChain is an upstream serving a linear chain whose head can be
+// moved, with one log per block.
+type eventsChain struct {
+	mu   sync.Mutex
+	head uint64
+}
+
+func (c *eventsChain) block(n uint64) map[string]interface{} {
+	return map[string]interface{}{
+		"number":       rpc.EncodeQuantity(n),
+		"hash":         fmt.Sprintf("0xh%d", n),
+		"parentHash":   fmt.Sprintf("0xh%d", n-1),
+		"transactions": []string{},
+	}
+}
+
+func (c *eventsChain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req rpc.JSONRPCRequest
+	json.NewDecoder(r.Body).Decode(&req)
+	var params []json.RawMessage
+	json.Unmarshal(req.Params, &params)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var result interface{}
+	switch req.Method {
+	case "eth_getBlockByNumber":
+		var tag string
+		json.Unmarshal(params[0], &tag)
+		n, err := rpc.ParseQuantity(tag)
+		if tag == "latest" {
+			n, err = c.head, nil
+		}
+		if err == nil {
+			result = c.block(n)
+		}
+	case "eth_getBlockByHash":
+		var hash string
+		json.Unmarshal(params[0], &hash)
+		var n uint64
+		fmt.Sscanf(hash, "0xh%d", &n)
+		result = c.block(n)
+	case "eth_getLogs":
+		var filter struct {
+			FromBlock string `json:"fromBlock"`
+			ToBlock   string `json:"toBlock"`
+			BlockHash string `json:"blockHash"`
+		}
+		json.Unmarshal(params[0], &filter)
+		from, _ := rpc.ParseQuantity(filter.FromBlock)
+		to, _ := rpc.ParseQuantity(filter.ToBlock)
+		if filter.BlockHash != "" {
+			fmt.Sscanf(filter.BlockHash, "0xh%d", &from)
+			to = from
+		}
+		logs := []map[string]string{}
+		for b := from; b <= to; b++ {
+			logs = append(logs, map[string]string{"blockNumber": rpc.EncodeQuantity(b), "blockHash": fmt.Sprintf("0xh%d", b), "logIndex": "0x0"})
+		}
+		result = logs
+	}
+	b, _ := json.Marshal(result)
+	json.NewEncoder(w).Encode(rpc.JSONRPCResponse{JSONRPC: "2.0", Result: b, ID: req.ID})
+}
+
+func (c *eventsChain) setHead(n uint64) {
+	c.mu.Lock()
+	c.head = n
+	c.mu.Unlock()
+}
+
+type sseEvent struct {
+	id, event, data string
+}
+
+func readEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("failed to read event: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if ev.event != "" {
+				return ev
+			}
+		case strings.HasPrefix(line, "id: "):
+			ev.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			ev.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestServer_Events(t *testing.T) {
+	upstream := &eventsChain{head: 10}
+	node := httptest.NewServer(upstream)
+	defer node.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient(node.URL, 5*time.Second, logger)
+	tracker := chain.NewTracker(client, logger, time.Hour, 128)
+	ctx := context.Background()
+	if err := tracker.Poll(ctx); err != nil {
+		t.Fatalf("Poll() error = %v", err)
+	}
+
+	server := New("localhost:8545", proxy.New(client, logger, 100, 25000000), logger, 5242880,
+		WithEvents(tracker, 128))
+	relay := httptest.NewServer(server.httpServer.Handler)
+	// Registered before the streams so their bodies are closed first.
+	t.Cleanup(relay.Close)
+
+	open := func(path, lastEventID string) *bufio.Reader {
+		req, _ := http.NewRequest("GET", relay.URL+path, nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET %s error = %v", path, err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+		}
+		return bufio.NewReader(resp.Body)
+	}
+
+	// Resuming after block 8 sends blocks 9 and 10 before live heads.
+	heads := open("/events/newHeads", "8")
+	logs := open("/events/logs?address=0xabc&topics=&topics=0x1,0x2", "9")
+	for _, want := range []string{"9", "10"} {
+		if ev := readEvent(t, heads); ev.event != "newHeads" || ev.id != want || strings.Contains(ev.data, "transactions") {
+			t.Errorf("resumed head = %+v, want newHeads %s without transactions", ev, want)
+		}
+	}
+	if ev := readEvent(t, logs); ev.event != "logs" || ev.id != "10" {
+		t.Errorf("resumed log = %+v, want logs 10", ev)
+	}
+
+	upstream.setHead(11)
+	if err := tracker.Poll(ctx); err != nil {
+		t.Fatalf("Poll() error = %v", err)
+	}
+	if ev := readEvent(t, heads); ev.id != "11" || !strings.Contains(ev.data, `"0xh11"`) {
+		t.Errorf("live head = %+v, want block 11", ev)
+	}
+	if ev := readEvent(t, logs); ev.id != "11" || !strings.Contains(ev.data, `"0xh11"`) {
+		t.Errorf("live log = %+v, want the log of block 11", ev)
+	}
+}
+
+func TestServer_EventsShutdown(t *testing.T) {
+	node := httptest.NewServer(&eventsChain{head: 10})
+	defer node.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient(node.URL, 5*time.Second, logger)
+	tracker := chain.NewTracker(client, logger, time.Hour, 128)
+	server := New("localhost:8545", proxy.New(client, logger, 100, 25000000), logger, 5242880,
+		WithEvents(tracker, 128))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	go server.httpServer.Serve(ln)
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/events/newHeads")
+	if err != nil {
+		t.Fatalf("GET /events/newHeads error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	// An open stream does not hold up the shutdown.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error = %v", err)
+	}
+	if _, err := io.ReadAll(resp.Body); err != nil {
+		t.Errorf("reading the stream after shutdown error = %v, want its end", err)
+	}
+}
+
+func TestLogsFilter(t *testing.T) {
+	r := httptest.NewRequest("GET", "/events/logs?address=0xa,0xb&topics=0x1&topics=&topics=0x2,0x3", nil)
+	got, _ := json.Marshal(logsFilter(r))
+	want := `{"address":["0xa","0xb"],"topics":[["0x1"],null,["0x2","0x3"]]}`
+	if string(got) != want {
+		t.Errorf("logsFilter() = %s, want %s", got, want)
+	}
+}
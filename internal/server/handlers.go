@@ -3,13 +3,137 @@ package server
 import (
 	"encoding/json"
 	"net/http"
+	"time"
+
+	"github.com/devlongs/geth-relay/health"
 )
 
 type HealthResponse struct {
-	Status string `json:"status"`
+	Status    string          `json:"status"`
+	Upstreams []health.Status `json:"upstreams,omitempty"`
 }
 
+// HealthHandler reports healthy as long as at least one upstream passed its
+// latest health check. Without a health checker it always reports healthy.
 func (s *Server) HealthHandler(w http.ResponseWriter, r *http.Request) {
+	resp := HealthResponse{Status: "healthy"}
+	code := http.StatusOK
+
+	if s.health != nil {
+		resp.Upstreams = s.health.Statuses()
+		if len(resp.Upstreams) > 0 && !anyHealthy(resp.Upstreams) {
+			resp.Status = "unhealthy"
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	writeJSON(w, code, resp)
+}
+
+func anyHealthy(statuses []health.Status) bool {
+	for _, s := range statuses {
+		if s.Healthy {
+			return true
+		}
+	}
+	return false
+}
+
+// LivezHandler reports that the relay process is up. It does not look at
+// the upstreams, so orchestrators only restart the relay when it is stuck.
+func (s *Server) LivezHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, HealthResponse{Status: "alive"})
+}
+
+// ReadyzHandler reports ready when at least one upstream is reachable and
+// synced according to the latest health check.
+func (s *Server) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	if s.health == nil {
+		writeJSON(w, http.StatusOK, HealthResponse{Status: "ready"})
+		return
+	}
+
+	statuses := s.health.Statuses()
+	if !anyHealthy(statuses) {
+		writeJSON(w, http.StatusServiceUnavailable, HealthResponse{Status: "not ready", Upstreams: statuses})
+		return
+	}
+	writeJSON(w, http.StatusOK, HealthResponse{Status: "ready", Upstreams: statuses})
+}
+
+type StatusResponse struct {
+	Version       string           `json:"version"`
+	StartedAt     time.Time        `json:"started_at"`
+	Uptime        string           `json:"uptime"`
+	UptimeSeconds float64          `json:"uptime_seconds"`
+	Upstreams     []UpstreamStatus `json:"upstreams"`
+}
+
+type UpstreamStatus struct {
+	Name        string     `json:"name"`
+	Healthy     bool       `json:"healthy"`
+	Reason      string     `json:"reason,omitempty"`
+	Circuit     string     `json:"circuit"`
+	Weight      int        `json:"weight"`
+	HeadBlock   uint64     `json:"head_block"`
+	Lag         uint64     `json:"lag"`
+	Syncing     bool       `json:"syncing"`
+	Peers       uint64     `json:"peers"`
+	LatencyMs   float64    `json:"latency_ms"`
+	Requests    uint64     `json:"requests"`
+	Errors      uint64     `json:"errors"`
+	ErrorRate   float64    `json:"error_rate"`
+	LastChecked *time.Time `json:"last_checked,omitempty"`
+}
+
+// StatusHandler reports the relay version and uptime together with the
+// traffic statistics and latest health check of every upstream.
+func (s *Server) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]health.Status)
+	if s.health != nil {
+		for _, st := range s.health.Statuses() {
+			checks[st.Upstream] = st
+		}
+	}
+
+	upstreams := s.proxy.Upstreams()
+	resp := StatusResponse{
+		Version:       s.version,
+		StartedAt:     s.startedAt,
+		Uptime:        time.Since(s.startedAt).Round(time.Second).String(),
+		UptimeSeconds: time.Since(s.startedAt).Seconds(),
+		Upstreams:     make([]UpstreamStatus, 0, len(upstreams)),
+	}
+
+	for _, u := range upstreams {
+		stats := u.Stats()
+		us := UpstreamStatus{
+			Name:      u.Name(),
+			Healthy:   u.Healthy(),
+			Circuit:   u.Circuit().String(),
+			Weight:    u.Weight(),
+			LatencyMs: float64(stats.Latency) / float64(time.Millisecond),
+			Requests:  stats.Requests,
+			Errors:    stats.Errors,
+			ErrorRate: stats.ErrorRate,
+		}
+		if check, ok := checks[u.Name()]; ok {
+			us.Reason = check.Reason
+			us.HeadBlock = check.BlockNumber
+			us.Lag = check.Lag
+			us.Syncing = check.Syncing
+			us.Peers = check.Peers
+			checkedAt := check.CheckedAt
+			us.LastChecked = &checkedAt
+		}
+		resp.Upstreams = append(resp.Upstreams, us)
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(HealthResponse{Status: "healthy"})
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
 }
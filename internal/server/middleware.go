@@ -1,9 +1,22 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/devlongs/geth-relay/auth"
+	"github.com/devlongs/geth-relay/metrics"
+	"github.com/devlongs/geth-relay/ratelimit"
+	"github.com/devlongs/geth-relay/rpc"
 	"go.uber.org/zap"
 )
 
@@ -47,6 +60,257 @@ func RecoveryMiddleware(logger *zap.Logger) func(http.Handler) http.Handler {
 	}
 }
 
+// AuthMiddleware rejects requests without a valid API key or from an origin
+// the key does not allow. The key's policy is stored in the request context
+// and a /v1/<key> path prefix is stripped. Browsers get CORS headers for
+// the origins their key allows, and CORS preflight requests are answered.
+// Rejected requests are counted in m.
+func AuthMiddleware(a *auth.Authenticator, m *metrics.Metrics, maxBodySize int, logger *zap.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isPreflight(r) {
+				preflight(w, r, a, logger)
+				return
+			}
+
+			policy, path, ok := a.Authenticate(r)
+			if !ok {
+				logger.Warn("unauthenticated request",
+					zap.String("path", r.URL.Path),
+					zap.String("remote_addr", r.RemoteAddr))
+				observeRejected(m, r, maxBodySize, rpc.ServerError)
+				writeRPCError(w, http.StatusUnauthorized, rpc.ServerError, "unauthorized: missing or invalid API key")
+				return
+			}
+
+			if origin := r.Header.Get("Origin"); !policy.AllowsOrigin(origin) {
+				logger.Warn("origin not allowed for API key",
+					zap.String("key", policy.Name),
+					zap.String("origin", origin))
+				observeRejected(m, r, maxBodySize, rpc.ServerError)
+				writeRPCError(w, http.StatusForbidden, rpc.ServerError, "origin not allowed")
+				return
+			}
+			if origin := r.Header.Get("Origin"); origin != "" {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Expose-Headers", "Retry-After")
+				w.Header().Add("Vary", "Origin")
+			}
+
+			r = r.WithContext(auth.NewContext(r.Context(), policy))
+			r.URL.Path = path
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// preflight answers a CORS preflight request. Browsers send no API key
+// header with it, so without a key in the path or query it is allowed for
+// any origin some key may be used from; the request that follows is
+// checked against its own key.
+func preflight(w http.ResponseWriter, r *http.Request, a *auth.Authenticator, logger *zap.Logger) {
+	origin := r.Header.Get("Origin")
+	allowed := a.AllowsOrigin(origin)
+	if policy, _, ok := a.Authenticate(r); ok {
+		allowed = policy.AllowsOrigin(origin)
+	}
+	if !allowed {
+		logger.Warn("origin not allowed", zap.String("origin", origin))
+		writeRPCError(w, http.StatusForbidden, rpc.ServerError, "origin not allowed")
+		return
+	}
+
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Set("Access-Control-Allow-Methods", "GET, POST")
+	if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+		h.Set("Access-Control-Allow-Headers", headers)
+	}
+	h.Set("Access-Control-Max-Age", "600")
+	h.Add("Vary", "Origin")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// RateLimitMiddleware limits the compute units each client may spend per
+// second, pricing every request with costs. Authenticated clients are
+// limited per API key, using the key's own limit if it has one. Limited
+// clients get a JSON-RPC "limit exceeded" error and a Retry-After header,
+// or HTTP 413 without one if the request costs more than the burst.
+// Limited requests are counted in m.
+func RateLimitMiddleware(limiter *ratelimit.Limiter, costs *ratelimit.CostTable, clientKey func(*http.Request) string, m *metrics.Metrics, maxBodySize int, logger *zap.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := peekBody(r, maxBodySize)
+			if err != nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			methods, isBatch := requestMethods(body)
+			cost := costs.Cost(methods, isBatch)
+
+			client := limitOf(r, clientKey)
+			if ok, retryAfter := client.allow(limiter, cost); !ok {
+				logger.Warn("rate limit exceeded",
+					zap.String("client", client.key),
+					zap.Float64("cost", cost),
+					zap.Duration("retry_after", retryAfter))
+				observeMethods(m, methods, rpc.LimitExceeded)
+				// Waiting does not help a request that costs more than
+				// the burst, so it gets no Retry-After.
+				if retryAfter == 0 {
+					writeRPCError(w, http.StatusRequestEntityTooLarge, rpc.LimitExceeded, errCostAboveBurst)
+					return
+				}
+				writeLimitExceeded(w, retryAfter)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientLimit is the client a request is charged to and, for API keys with
+// their own limit, its policy.
+type clientLimit struct {
+	key    string
+	policy *auth.Policy
+}
+
+// limitOf returns the client r is charged to: its API key when
+// authenticated, otherwise as identified by clientKey.
+func limitOf(r *http.Request, clientKey func(*http.Request) string) clientLimit {
+	if policy, ok := auth.FromContext(r.Context()); ok {
+		return clientLimit{key: "key:" + policy.Name, policy: policy}
+	}
+	return clientLimit{key: clientKey(r)}
+}
+
+// allow takes cost compute units from the client's bucket in limiter. If
+// they are not available it returns false and the time until they are.
+func (c clientLimit) allow(limiter *ratelimit.Limiter, cost float64) (bool, time.Duration) {
+	if c.policy != nil && c.policy.RateLimit > 0 {
+		return limiter.AllowLimit(c.key, cost, c.policy.RateLimit, c.policy.RateLimitBurst)
+	}
+	return limiter.Allow(c.key, cost)
+}
+
+// observeRejected counts the requests in the body of r, rejected before
+// they reached the proxy, as answered with the error code.
+func observeRejected(m *metrics.Metrics, r *http.Request, maxBodySize int, code int) {
+	if m == nil {
+		return
+	}
+	body, _ := peekBody(r, maxBodySize)
+	methods, _ := requestMethods(body)
+	observeMethods(m, methods, code)
+}
+
+// observeMethods counts a request for each of methods, or one without a
+// method if there are none, as answered with the error code.
+func observeMethods(m *metrics.Metrics, methods []string, code int) {
+	if len(methods) == 0 {
+		m.ObserveRequest("", code)
+		return
+	}
+	for _, method := range methods {
+		m.ObserveRequest(method, code)
+	}
+}
+
+// peekBody reads up to limit+1 bytes of the request body and puts them back
+// so the next handler can read the body again and apply its own limits.
+func peekBody(r *http.Request, limit int) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+	r.Body.Close()
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, err
+}
+
+// requestMethods extracts the methods called by a single or batch request
+// body. Bodies that are not valid JSON-RPC yield no methods.
+func requestMethods(body []byte) ([]string, bool) {
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var batch []struct {
+			Method string `json:"method"`
+		}
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return nil, true
+		}
+		methods := make([]string, len(batch))
+		for i, req := range batch {
+			methods[i] = req.Method
+		}
+		return methods, true
+	}
+
+	var req struct {
+		Method string `json:"method"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil || req.Method == "" {
+		return nil, false
+	}
+	return []string{req.Method}, false
+}
+
+// errCostAboveBurst is the error message for requests that cost more
+// compute units than the client's rate limit allows at once.
+const errCostAboveBurst = "request cost exceeds the rate limit burst"
+
+func writeLimitExceeded(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	writeRPCError(w, http.StatusTooManyRequests, rpc.LimitExceeded, "limit exceeded")
+}
+
+// writeRPCError answers a request rejected before it reached the proxy with
+// a JSON-RPC error body and the given HTTP status.
+func writeRPCError(w http.ResponseWriter, status, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(rpc.NewErrorResponse(nil, code, message))
+}
+
+// ClientKey returns a function identifying unauthenticated clients for rate
+// limiting by IP. Authenticated clients are limited by their API key
+// instead. With trustForwarded the IP is taken from X-Forwarded-For, which
+// is only safe behind a proxy that sets it.
+func ClientKey(trustForwarded bool) func(*http.Request) string {
+	return func(r *http.Request) string {
+		return "ip:" + clientIP(r, trustForwarded)
+	}
+}
+
+// clientIP returns the IP of the client of r. With trustForwarded it is the
+// last X-Forwarded-For entry, the one added by the proxy in front of the
+// relay; earlier entries are set by the client and cannot be trusted.
+func clientIP(r *http.Request, trustForwarded bool) string {
+	if trustForwarded {
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			entries := strings.Split(fwd[len(fwd)-1], ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
@@ -56,3 +320,19 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.statusCode = code
 	rw.ResponseWriter.WriteHeader(code)
 }
+
+// Unwrap lets http.ResponseController reach the underlying writer, e.g. to
+// flush event streams.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Hijack lets WebSocket upgrades take over the connection.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	rw.statusCode = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
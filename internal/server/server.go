@@ -9,28 +9,154 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/devlongs/geth-relay/auth"
+	"github.com/devlongs/geth-relay/chain"
+	"github.com/devlongs/geth-relay/health"
+	"github.com/devlongs/geth-relay/metrics"
 	"github.com/devlongs/geth-relay/proxy"
+	"github.com/devlongs/geth-relay/ratelimit"
 	"github.com/devlongs/geth-relay/rpc"
+	"github.com/devlongs/geth-relay/subscription"
+	"github.com/devlongs/geth-relay/tracing"
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+var tracer = otel.Tracer("github.com/devlongs/geth-relay/internal/server")
+
+// writeTimeout is how long the server takes to answer a request at most.
+const writeTimeout = 30 * time.Second
+
 type Server struct {
 	proxy       *proxy.Proxy
 	logger      *zap.Logger
 	httpServer  *http.Server
 	maxBodySize int
+	health      *health.Checker
+	version     string
+	startedAt   time.Time
+
+	limiter   *ratelimit.Limiter
+	costs     *ratelimit.CostTable
+	clientKey func(*http.Request) string
+
+	auth *auth.Authenticator
+
+	hub *subscription.Hub
+
+	tracker        *chain.Tracker
+	eventsBackfill uint64
+	// streams is cancelled on shutdown to end the event streams, which
+	// http.Server.Shutdown would otherwise wait for.
+	streams     context.Context
+	stopStreams context.CancelFunc
+
+	metrics     *metrics.Metrics
+	metricsPath string
+}
+
+// Option configures optional Server features.
+type Option func(*Server)
+
+// WithHealthChecker makes the health endpoint report the results of c.
+func WithHealthChecker(c *health.Checker) Option {
+	return func(s *Server) {
+		s.health = c
+	}
+}
+
+// WithVersion sets the relay version reported by the status endpoint.
+func WithVersion(version string) Option {
+	return func(s *Server) {
+		s.version = version
+	}
+}
+
+// WithRateLimit limits the compute units each client, as identified by
+// clientKey, may spend on RPC requests. Requests are priced with costs.
+func WithRateLimit(limiter *ratelimit.Limiter, costs *ratelimit.CostTable, clientKey func(*http.Request) string) Option {
+	return func(s *Server) {
+		s.limiter = limiter
+		s.costs = costs
+		s.clientKey = clientKey
+	}
+}
+
+// WithAuth requires every RPC request to carry an API key known to a.
+func WithAuth(a *auth.Authenticator) Option {
+	return func(s *Server) {
+		s.auth = a
+	}
+}
+
+// WithWebSocket accepts JSON-RPC over WebSocket on the RPC endpoint and
+// serves subscriptions from hub.
+func WithWebSocket(hub *subscription.Hub) Option {
+	return func(s *Server) {
+		s.hub = hub
+	}
+}
+
+// WithEvents streams newHeads and logs followed by tracker as Server-Sent
+// Events. Resuming clients are sent at most maxBackfill missed blocks.
+func WithEvents(tracker *chain.Tracker, maxBackfill uint64) Option {
+	return func(s *Server) {
+		s.tracker = tracker
+		s.eventsBackfill = maxBackfill
+	}
+}
+
+// WithMetrics serves m at path and records the in-flight requests and the
+// request and response sizes of the RPC endpoint in it.
+func WithMetrics(m *metrics.Metrics, path string) Option {
+	return func(s *Server) {
+		s.metrics = m
+		s.metricsPath = path
+	}
 }
 
-func New(addr string, p *proxy.Proxy, logger *zap.Logger, maxBodySize int) *Server {
+func New(addr string, p *proxy.Proxy, logger *zap.Logger, maxBodySize int, opts ...Option) *Server {
 	s := &Server{
 		proxy:       p,
 		logger:      logger,
 		maxBodySize: maxBodySize,
+		version:     "dev",
+		startedAt:   time.Now(),
+	}
+	s.streams, s.stopStreams = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	// Everything served to RPC clients is behind authentication and rate
+	// limiting, which may rewrite the path, so it has its own mux.
+	rpcMux := http.NewServeMux()
+	rpcMux.HandleFunc("/", s.RPCHandler)
+	if s.tracker != nil {
+		rpcMux.HandleFunc("/events/newHeads", s.NewHeadsEventsHandler)
+		rpcMux.HandleFunc("/events/logs", s.LogsEventsHandler)
+	}
+
+	var rpcHandler http.Handler = rpcMux
+	if s.limiter != nil {
+		rpcHandler = RateLimitMiddleware(s.limiter, s.costs, s.clientKey, s.metrics, s.maxBodySize, logger)(rpcHandler)
+	}
+	if s.auth != nil {
+		rpcHandler = AuthMiddleware(s.auth, s.metrics, s.maxBodySize, logger)(rpcHandler)
 	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/", s.RPCHandler)
+	mux.Handle("/", rpcHandler)
 	mux.HandleFunc("/health", s.HealthHandler)
+	mux.HandleFunc("/livez", s.LivezHandler)
+	mux.HandleFunc("/readyz", s.ReadyzHandler)
+	mux.HandleFunc("/status", s.StatusHandler)
+	if s.metrics != nil {
+		mux.Handle(s.metricsPath, s.metrics.Handler())
+	}
 
 	handler := RecoveryMiddleware(logger)(LoggingMiddleware(logger)(mux))
 
@@ -38,9 +164,10 @@ func New(addr string, p *proxy.Proxy, logger *zap.Logger, maxBodySize int) *Serv
 		Addr:         addr,
 		Handler:      handler,
 		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		WriteTimeout: writeTimeout,
 		IdleTimeout:  60 * time.Second,
 	}
+	s.httpServer.RegisterOnShutdown(s.stopStreams)
 
 	return s
 }
@@ -59,12 +186,28 @@ func (s *Server) Shutdown(ctx context.Context) error {
 }
 
 func (s *Server) RPCHandler(w http.ResponseWriter, r *http.Request) {
+	if s.hub != nil && websocket.IsWebSocketUpgrade(r) {
+		s.WebSocketHandler(w, r)
+		return
+	}
+
 	if r.Method != http.MethodPost {
 		s.logger.Warn("invalid method", zap.String("method", r.Method))
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	done := s.metrics.Begin()
+	defer done()
+
+	// Continue the caller's trace when the request carries a traceparent.
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "RPCHandler", trace.WithSpanKind(trace.SpanKindServer))
+	defer span.End()
+	// Work past the write timeout could not be answered anymore.
+	ctx, cancel := context.WithTimeout(ctx, writeTimeout)
+	defer cancel()
+
 	if r.ContentLength > int64(s.maxBodySize) {
 		s.logger.Warn("request body too large",
 			zap.Int64("content_length", r.ContentLength),
@@ -86,19 +229,29 @@ func (s *Server) RPCHandler(w http.ResponseWriter, r *http.Request) {
 	isBatch := len(body) > 0 && body[0] == '['
 
 	if isBatch {
-		var batchReqs []*rpc.JSONRPCRequest
-		if err := json.Unmarshal(body, &batchReqs); err != nil {
+		batchReqs, err := rpc.ParseBatch(body)
+		if err != nil {
 			s.logger.Error("failed to unmarshal batch request", zap.Error(err))
 			s.writeErrorResponse(w, nil, rpc.ParseError, "invalid json")
 			return
 		}
 
-		batchResps := s.proxy.HandleBatchRequest(r.Context(), batchReqs)
+		span.SetAttributes(tracing.BatchSizeKey.Int(len(batchReqs)))
+		batchResps := s.proxy.HandleBatchRequest(ctx, batchReqs)
+		// A batch of notifications gets an empty body, like geth.
+		if len(batchResps) == 0 {
+			s.metrics.ObserveBytes(metrics.BatchMethod, len(body), 0)
+			return
+		}
 
 		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(batchResps); err != nil {
+		cw := &countingWriter{w: w}
+		enc := json.NewEncoder(cw)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(batchResps); err != nil {
 			s.logger.Error("failed to encode batch response", zap.Error(err))
 		}
+		s.metrics.ObserveBytes(metrics.BatchMethod, len(body), cw.n)
 	} else {
 		var req rpc.JSONRPCRequest
 		if err := json.Unmarshal(body, &req); err != nil {
@@ -107,16 +260,41 @@ func (s *Server) RPCHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		resp := s.proxy.HandleRequest(r.Context(), &req)
+		span.SetAttributes(tracing.MethodKey.String(req.Method))
+		resp := s.proxy.HandleRequest(ctx, &req)
+		if resp == nil {
+			// Notifications get an empty body.
+			s.metrics.ObserveBytes(req.Method, len(body), 0)
+			return
+		}
+		if resp.Error != nil {
+			tracing.SetErrorCode(span, resp.Error.Code, resp.Error.Message)
+		}
 
 		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(resp); err != nil {
+		cw := &countingWriter{w: w}
+		enc := json.NewEncoder(cw)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(resp); err != nil {
 			s.logger.Error("failed to encode response", zap.Error(err))
 		}
+		s.metrics.ObserveBytes(req.Method, len(body), cw.n)
 	}
 }
 
-func (s *Server) writeErrorResponse(w http.ResponseWriter, id interface{}, code int, message string) {
+func (s *Server) writeErrorResponse(w http.ResponseWriter, id json.RawMessage, code int, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(rpc.NewErrorResponse(id, code, message))
 }
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += n
+	return n, err
+}
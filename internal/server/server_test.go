@@ -2,14 +2,30 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/devlongs/geth-relay/auth"
+	"github.com/devlongs/geth-relay/health"
+	"github.com/devlongs/geth-relay/metrics"
 	"github.com/devlongs/geth-relay/proxy"
+	"github.com/devlongs/geth-relay/ratelimit"
 	"github.com/devlongs/geth-relay/rpc"
+	"github.com/devlongs/geth-relay/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 	"go.uber.org/zap"
 )
 
@@ -124,3 +140,616 @@ func TestServer_RPCHandlerBatchRequest(t *testing.T) {
 		t.Errorf("status code = %d, want %d", w.Code, http.StatusOK)
 	}
 }
+
+func TestServer_HealthHandlerUnhealthyUpstream(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient(down.URL, time.Second, logger)
+	checker := health.NewChecker(client, logger, time.Minute, time.Second, 5, 1)
+	checker.Check(context.Background())
+
+	proxyHandler := proxy.New(client, logger, 100, 25000000)
+	server := New("localhost:8545", proxyHandler, logger, 5242880, WithHealthChecker(checker))
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	w := httptest.NewRecorder()
+
+	server.HealthHandler(w, req)
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status code = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	var resp HealthResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Status != "unhealthy" {
+		t.Errorf("status = %v, want unhealthy", resp.Status)
+	}
+	if len(resp.Upstreams) != 1 || resp.Upstreams[0].Reason == "" {
+		t.Errorf("upstreams = %+v, want one upstream with a reason", resp.Upstreams)
+	}
+}
+
+func TestServer_LivezHandler(t *testing.T) {
+	server := setupTestServer()
+
+	req := httptest.NewRequest("GET", "/livez", nil)
+	w := httptest.NewRecorder()
+
+	server.LivezHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status code = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestServer_ReadyzHandler(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient(down.URL, time.Second, logger)
+	checker := health.NewChecker(client, logger, time.Minute, time.Second, 5, 1)
+	proxyHandler := proxy.New(client, logger, 100, 25000000)
+	server := New("localhost:8545", proxyHandler, logger, 5242880, WithHealthChecker(checker))
+
+	req := httptest.NewRequest("GET", "/readyz", nil)
+	w := httptest.NewRecorder()
+	server.ReadyzHandler(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status code before first check = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	checker.Check(context.Background())
+
+	w = httptest.NewRecorder()
+	server.ReadyzHandler(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("status code with upstream down = %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	w = httptest.NewRecorder()
+	server.LivezHandler(w, httptest.NewRequest("GET", "/livez", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("livez status code with upstream down = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestServer_StatusHandler(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewPoolClient([]rpc.Endpoint{
+		{Name: "geth-a", URL: "http://localhost:8546", Weight: 2, Timeout: time.Second},
+		{Name: "geth-b", URL: "http://localhost:8547", Timeout: time.Second},
+	}, logger)
+	proxyHandler := proxy.New(client, logger, 100, 25000000)
+	server := New("localhost:8545", proxyHandler, logger, 5242880, WithVersion("v1.2.3"))
+
+	req := httptest.NewRequest("GET", "/status", nil)
+	w := httptest.NewRecorder()
+
+	server.StatusHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status code = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var resp StatusResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Version != "v1.2.3" {
+		t.Errorf("version = %q, want v1.2.3", resp.Version)
+	}
+	if len(resp.Upstreams) != 2 {
+		t.Fatalf("len(upstreams) = %d, want 2", len(resp.Upstreams))
+	}
+	if resp.Upstreams[0].Name != "geth-a" || resp.Upstreams[0].Weight != 2 {
+		t.Errorf("upstreams[0] = %+v, want geth-a with weight 2", resp.Upstreams[0])
+	}
+	if resp.Upstreams[0].Circuit != "closed" {
+		t.Errorf("upstreams[0].circuit = %q, want closed", resp.Upstreams[0].Circuit)
+	}
+}
+
+func TestServer_RateLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(rpc.JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: json.RawMessage("1")})
+	}))
+	defer upstream.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient(upstream.URL, 5*time.Second, logger)
+	proxyHandler := proxy.New(client, logger, 100, 25000000)
+	server := New("localhost:8545", proxyHandler, logger, 5242880,
+		WithRateLimit(ratelimit.New(1, 2), ratelimit.NewCostTable(1, 0, nil), ClientKey(false)))
+
+	send := func(remoteAddr, apiKey string) *httptest.ResponseRecorder {
+		body := `{"jsonrpc":"2.0","method":"eth_chainId","params":[],"id":1}`
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString(body))
+		req.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		w := httptest.NewRecorder()
+		server.httpServer.Handler.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		if w := send("10.0.0.1:1234", ""); w.Code != http.StatusOK {
+			t.Fatalf("request %d status code = %d, want %d", i, w.Code, http.StatusOK)
+		}
+	}
+
+	w := send("10.0.0.1:5678", "")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status code = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Retry-After = %q, want 1", w.Header().Get("Retry-After"))
+	}
+	var resp rpc.JSONRPCResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if resp.Error == nil || resp.Error.Code != rpc.LimitExceeded {
+		t.Errorf("error = %+v, want code %d", resp.Error, rpc.LimitExceeded)
+	}
+
+	if w := send("10.0.0.2:1234", ""); w.Code != http.StatusOK {
+		t.Errorf("other IP status code = %d, want %d", w.Code, http.StatusOK)
+	}
+	// An unauthenticated API key header does not get a bucket of its own.
+	if w := send("10.0.0.1:1234", "random-key"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("unauthenticated API key status code = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w := send("10.0.0.1:1234", ""); w.Code != http.StatusTooManyRequests {
+		t.Errorf("limited IP status code = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+
+	req := httptest.NewRequest("GET", "/livez", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	w = httptest.NewRecorder()
+	server.httpServer.Handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("livez status code for limited client = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	req := httptest.NewRequest("POST", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.7")
+	req.Header.Set("X-API-Key", "secret")
+
+	if got := ClientKey(false)(req); got != "ip:10.0.0.1" {
+		t.Errorf("untrusted key = %q, want ip:10.0.0.1", got)
+	}
+	// The first entry is set by the client; the last by the trusted proxy.
+	if got := ClientKey(true)(req); got != "ip:203.0.113.7" {
+		t.Errorf("trusted key = %q, want ip:203.0.113.7", got)
+	}
+}
+
+func TestServer_RateLimitComputeUnits(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"jsonrpc":"2.0","result":"0x1","id":1},{"jsonrpc":"2.0","result":"0x1","id":2}]`))
+	}))
+	defer upstream.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient(upstream.URL, 5*time.Second, logger)
+	proxyHandler := proxy.New(client, logger, 100, 25000000)
+	costs := ratelimit.NewCostTable(1, 1, map[string]float64{"debug_traceTransaction": 50})
+	server := New("localhost:8545", proxyHandler, logger, 5242880,
+		WithRateLimit(ratelimit.New(1, 60), costs, ClientKey(false)))
+
+	send := func(body string) int {
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		server.httpServer.Handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	trace := `{"jsonrpc":"2.0","method":"debug_traceTransaction","params":["0x1"],"id":1}`
+	if code := send(trace); code != http.StatusOK {
+		t.Fatalf("first trace status code = %d, want %d", code, http.StatusOK)
+	}
+	if code := send(trace); code != http.StatusTooManyRequests {
+		t.Fatalf("second trace status code = %d, want %d", code, http.StatusTooManyRequests)
+	}
+
+	// 10 units left: a two item batch costs 2 * (1 + 1).
+	batch := `[{"jsonrpc":"2.0","method":"eth_chainId","id":1},{"jsonrpc":"2.0","method":"eth_blockNumber","id":2}]`
+	if code := send(batch); code != http.StatusOK {
+		t.Errorf("batch status code = %d, want %d", code, http.StatusOK)
+	}
+
+	// A batch costing more than the burst never fits, so it is not worth
+	// retrying.
+	w := httptest.NewRecorder()
+	server.httpServer.Handler.ServeHTTP(w, httptest.NewRequest("POST", "/", bytes.NewBufferString("["+trace+","+trace+"]")))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("batch above burst status code = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if got := w.Header().Get("Retry-After"); got != "" {
+		t.Errorf("Retry-After = %q for a batch above burst, want none", got)
+	}
+}
+
+func TestServer_Auth(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(rpc.JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: json.RawMessage("1")})
+	}))
+	defer upstream.Close()
+
+	authenticator, err := auth.New("X-API-Key", "apikey", true, []auth.Policy{
+		{Name: "dapp", Key: "secret", RateLimit: 1, RateLimitBurst: 1, AllowedOrigins: []string{"https://app.example.com"}},
+	})
+	if err != nil {
+		t.Fatalf("auth.New() error = %v", err)
+	}
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient(upstream.URL, 5*time.Second, logger)
+	proxyHandler := proxy.New(client, logger, 100, 25000000)
+	server := New("localhost:8545", proxyHandler, logger, 5242880,
+		WithAuth(authenticator),
+		WithRateLimit(ratelimit.New(0, 0), ratelimit.NewCostTable(1, 0, nil), ClientKey(false)))
+
+	send := func(target string, header map[string]string) *httptest.ResponseRecorder {
+		body := `{"jsonrpc":"2.0","method":"eth_chainId","params":[],"id":1}`
+		req := httptest.NewRequest("POST", target, bytes.NewBufferString(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		server.httpServer.Handler.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		name     string
+		target   string
+		header   map[string]string
+		wantCode int
+	}{
+		{name: "no key", target: "/", wantCode: http.StatusUnauthorized},
+		{name: "unknown key", target: "/", header: map[string]string{"X-API-Key": "wrong"}, wantCode: http.StatusUnauthorized},
+		{name: "origin not allowed", target: "/v1/secret", header: map[string]string{"Origin": "https://evil.example.com"}, wantCode: http.StatusForbidden},
+		{name: "path key", target: "/v1/secret", wantCode: http.StatusOK},
+		// The key's own limit of one unit per second applies.
+		{name: "query key limited", target: "/?apikey=secret", header: map[string]string{"Origin": "https://app.example.com"}, wantCode: http.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := send(tt.target, tt.header)
+			if w.Code != tt.wantCode {
+				t.Fatalf("status code = %d, want %d", w.Code, tt.wantCode)
+			}
+			if tt.wantCode == http.StatusOK {
+				return
+			}
+			var resp rpc.JSONRPCResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if resp.Error == nil {
+				t.Error("expected a JSON-RPC error")
+			}
+		})
+	}
+
+	req := httptest.NewRequest("GET", "/livez", nil)
+	w := httptest.NewRecorder()
+	server.httpServer.Handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("livez status code without key = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// Browsers may read the answers for the origins the key allows.
+	w = send("/v1/secret", map[string]string{"Origin": "https://app.example.com"})
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the request's origin", got)
+	}
+
+	preflight := func(target, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("OPTIONS", target, nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "content-type, x-api-key")
+		w := httptest.NewRecorder()
+		server.httpServer.Handler.ServeHTTP(w, req)
+		return w
+	}
+	for _, target := range []string{"/", "/v1/secret"} {
+		w := preflight(target, "https://app.example.com")
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("preflight to %s status code = %d, want %d", target, w.Code, http.StatusNoContent)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+			t.Errorf("preflight Access-Control-Allow-Origin = %q, want the request's origin", got)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Headers"); got != "content-type, x-api-key" {
+			t.Errorf("preflight Access-Control-Allow-Headers = %q, want the requested headers", got)
+		}
+		if w := preflight(target, "https://evil.example.com"); w.Code != http.StatusForbidden {
+			t.Errorf("preflight to %s from another origin status code = %d, want %d", target, w.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestServer_Metrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if bytes.HasPrefix(body, []byte("[")) {
+			reqs, _ := rpc.ParseBatch(body)
+			fmt.Fprintf(w, `[{"jsonrpc":"2.0","result":"0x1","id":%s},{"jsonrpc":"2.0","error":{"code":3,"message":"execution reverted"},"id":%s}]`, reqs[0].ID, reqs[1].ID)
+			return
+		}
+		w.Write([]byte(`{"jsonrpc":"2.0","result":"0x1","id":1}`))
+	}))
+	defer upstream.Close()
+
+	logger, _ := zap.NewDevelopment()
+	m := metrics.New()
+	client := rpc.NewPoolClient([]rpc.Endpoint{{Name: "node-a", URL: upstream.URL, Timeout: 5 * time.Second}}, logger, rpc.WithMetrics(m))
+	server := New("localhost:8545", proxy.New(client, logger, 100, 25000000, proxy.WithMetrics(m)), logger, 5242880,
+		WithMetrics(m, "/metrics"))
+
+	for _, body := range []string{
+		`{"jsonrpc":"2.0","method":"eth_chainId","params":[],"id":1}`,
+		`[{"jsonrpc":"2.0","method":"eth_chainId","id":1},{"jsonrpc":"2.0","method":"eth_call","id":2}]`,
+	} {
+		w := httptest.NewRecorder()
+		server.httpServer.Handler.ServeHTTP(w, httptest.NewRequest("POST", "/", bytes.NewBufferString(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("POST %s status = %d", body, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	server.httpServer.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	got := w.Body.String()
+	for _, want := range []string{
+		`geth_relay_rpc_requests_total{method="eth_chainId"} 2`,
+		`geth_relay_rpc_errors_total{code="3",method="eth_call"} 1`,
+		`geth_relay_upstream_request_duration_seconds_count{method="eth_chainId",upstream="node-a"} 1`,
+		`geth_relay_upstream_request_duration_seconds_count{method="batch",upstream="node-a"} 1`,
+		`geth_relay_batch_size_count 1`,
+		`geth_relay_request_bytes_count{method="batch"} 1`,
+		`geth_relay_response_bytes_count{method="eth_chainId"} 1`,
+		`geth_relay_in_flight_requests 0`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics do not contain %q", want)
+		}
+	}
+}
+
+func TestServer_MetricsRejected(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	m := metrics.New()
+	authenticator, err := auth.New("X-API-Key", "", false, []auth.Policy{{Name: "dapp", Key: "secret"}})
+	if err != nil {
+		t.Fatalf("auth.New() error = %v", err)
+	}
+	client := rpc.NewClient("http://127.0.0.1:0", 5*time.Second, logger)
+	server := New("localhost:8545", proxy.New(client, logger, 100, 25000000, proxy.WithMetrics(m)), logger, 5242880,
+		WithMetrics(m, "/metrics"),
+		WithAuth(authenticator),
+		WithRateLimit(ratelimit.New(1, 1), ratelimit.NewCostTable(1, 0, nil), ClientKey(false)))
+
+	// Requests rejected by the middleware count like any other error.
+	for key, body := range map[string]string{
+		"":       `{"jsonrpc":"2.0","method":"eth_chainId","id":1}`,
+		"secret": `[{"jsonrpc":"2.0","method":"eth_call","id":1},{"jsonrpc":"2.0","method":"eth_call","id":2}]`,
+	} {
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString(body))
+		req.Header.Set("X-API-Key", key)
+		server.httpServer.Handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	w := httptest.NewRecorder()
+	server.httpServer.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	got := w.Body.String()
+	for _, want := range []string{
+		`geth_relay_rpc_errors_total{code="-32000",method="eth_chainId"} 1`,
+		`geth_relay_rpc_errors_total{code="-32005",method="eth_call"} 2`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics do not contain %q", want)
+		}
+	}
+}
+
+func TestServer_Tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+
+	var upstreamTraceparent string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceparent = r.Header.Get("traceparent")
+		w.Write([]byte(`{"jsonrpc":"2.0","error":{"code":3,"message":"execution reverted"},"id":1}`))
+	}))
+	defer upstream.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewPoolClient([]rpc.Endpoint{{Name: "node-a", URL: upstream.URL, Timeout: 5 * time.Second}}, logger)
+	server := New("localhost:8545", proxy.New(client, logger, 100, 25000000), logger, 5242880)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"jsonrpc":"2.0","method":"eth_call","params":[],"id":1}`))
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	server.httpServer.Handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !strings.HasPrefix(upstreamTraceparent, "00-"+traceID+"-") {
+		t.Errorf("upstream traceparent = %q, want trace %s", upstreamTraceparent, traceID)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() != traceID {
+			t.Errorf("span %s has trace %s, want %s", span.Name(), span.SpanContext().TraceID(), traceID)
+		}
+		spans[span.Name()] = span
+	}
+	for _, name := range []string{"RPCHandler", "Proxy.HandleRequest", "Client.forwardSingle"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		attrs := make(map[attribute.Key]attribute.Value)
+		for _, kv := range span.Attributes() {
+			attrs[kv.Key] = kv.Value
+		}
+		if attrs[tracing.MethodKey].AsString() != "eth_call" {
+			t.Errorf("%s method = %q, want eth_call", name, attrs[tracing.MethodKey].AsString())
+		}
+		if attrs[tracing.ErrorCodeKey].AsInt64() != 3 {
+			t.Errorf("%s error code = %v, want 3", name, attrs[tracing.ErrorCodeKey].AsInt64())
+		}
+	}
+	if upstream := spans["Client.forwardSingle"]; upstream != nil {
+		if upstream.Parent().SpanID() != spans["Proxy.HandleRequest"].SpanContext().SpanID() {
+			t.Error("Client.forwardSingle is not a child of Proxy.HandleRequest")
+		}
+	}
+}
+
+func TestServer_Notifications(t *testing.T) {
+	var forwarded atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		reqs, err := rpc.ParseBatch(body)
+		if err != nil {
+			forwarded.Add(1)
+			w.Write([]byte(`{"jsonrpc":"2.0","result":"0x1","id":null}`))
+			return
+		}
+		forwarded.Add(int32(len(reqs)))
+		resps := make([]*rpc.JSONRPCResponse, len(reqs))
+		for i, req := range reqs {
+			resps[i] = &rpc.JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: req.ID}
+		}
+		json.NewEncoder(w).Encode(resps)
+	}))
+	defer upstream.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient(upstream.URL, 5*time.Second, logger)
+	server := New("localhost:8545", proxy.New(client, logger, 100, 25000000), logger, 5242880)
+
+	tests := []struct {
+		name          string
+		body          string
+		wantBody      string
+		wantForwarded int32
+	}{
+		{
+			name:          "single notification",
+			body:          `{"jsonrpc":"2.0","method":"eth_sendRawTransaction","params":["0x00"]}`,
+			wantBody:      "",
+			wantForwarded: 1,
+		},
+		{
+			name:          "null id is answered",
+			body:          `{"jsonrpc":"2.0","method":"eth_chainId","id":null}`,
+			wantBody:      `{"jsonrpc":"2.0","result":"0x1","id":null}`,
+			wantForwarded: 1,
+		},
+		{
+			name:          "batch of notifications",
+			body:          `[{"jsonrpc":"2.0","method":"eth_chainId"},{"jsonrpc":"2.0","method":"eth_blockNumber"}]`,
+			wantBody:      "",
+			wantForwarded: 2,
+		},
+		{
+			name:          "mixed batch",
+			body:          `[{"jsonrpc":"2.0","method":"eth_chainId"},{"jsonrpc":"2.0","method":"eth_blockNumber","id":2},{"jsonrpc":"1.0","method":"eth_chainId"}]`,
+			wantBody:      `[{"jsonrpc":"2.0","result":"0x1","id":2},{"jsonrpc":"2.0","error":{"code":-32600,"message":"jsonrpc must be 2.0"},"id":null}]`,
+			wantForwarded: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarded.Store(0)
+			w := httptest.NewRecorder()
+			server.RPCHandler(w, httptest.NewRequest("POST", "/", bytes.NewBufferString(tt.body)))
+
+			if w.Code != http.StatusOK {
+				t.Errorf("status code = %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := strings.TrimSpace(w.Body.String()); got != tt.wantBody {
+				t.Errorf("body = %s, want %s", got, tt.wantBody)
+			}
+			if got := forwarded.Load(); got != tt.wantForwarded {
+				t.Errorf("forwarded %d requests, want %d", got, tt.wantForwarded)
+			}
+		})
+	}
+}
+
+func TestServer_RawIDs(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if reqs, err := rpc.ParseBatch(body); err == nil {
+			resps := make([]*rpc.JSONRPCResponse, len(reqs))
+			for i, req := range reqs {
+				resps[i] = &rpc.JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`null`), ID: req.ID}
+			}
+			json.NewEncoder(w).Encode(resps)
+			return
+		}
+		// Answer with a float id, as a node decoding ids into float64 would.
+		w.Write([]byte(`{"jsonrpc":"2.0","result":null,"id":1e+20}`))
+	}))
+	defer upstream.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient(upstream.URL, 5*time.Second, logger)
+	server := New("localhost:8545", proxy.New(client, logger, 100, 25000000), logger, 5242880)
+
+	tests := []struct {
+		name     string
+		body     string
+		wantBody string
+	}{
+		{
+			name:     "large id and null result",
+			body:     `{"jsonrpc":"2.0","method":"eth_getTransactionReceipt","params":["0x01"],"id":100000000000000000001}`,
+			wantBody: `{"jsonrpc":"2.0","result":null,"id":100000000000000000001}`,
+		},
+		{
+			name:     "batch",
+			body:     `[{"jsonrpc":"2.0","method":"eth_getTransactionReceipt","id":"<a>"},{"jsonrpc":"2.0","method":"eth_getTransactionReceipt","id":1.50}]`,
+			wantBody: `[{"jsonrpc":"2.0","result":null,"id":"<a>"},{"jsonrpc":"2.0","result":null,"id":1.50}]`,
+		},
+		{
+			name:     "invalid id",
+			body:     `{"jsonrpc":"2.0","method":"eth_chainId","id":{"a":1}}`,
+			wantBody: `{"jsonrpc":"2.0","error":{"code":-32600,"message":"id must be a string, number or null"},"id":null}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			server.RPCHandler(w, httptest.NewRequest("POST", "/", bytes.NewBufferString(tt.body)))
+
+			if got := strings.TrimSpace(w.Body.String()); got != tt.wantBody {
+				t.Errorf("body = %s, want %s", got, tt.wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,343 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/devlongs/geth-relay/proxy"
+	"github.com/devlongs/geth-relay/rpc"
+	"github.com/devlongs/geth-relay/subscription"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+const (
+	wsWriteTimeout = 10 * time.Second
+	wsPingInterval = 30 * time.Second
+	// wsMaxInFlight is the number of messages of one connection handled
+	// at once. Further messages are not read until one is answered.
+	wsMaxInFlight = 16
+)
+
+var upgrader = websocket.Upgrader{
+	// Origins are restricted per API key by AuthMiddleware.
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// WebSocketHandler serves JSON-RPC over a WebSocket. Subscriptions are
+// served by the subscription hub; other calls go through the proxy.
+func (s *Server) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.logger.Warn("websocket upgrade failed", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+	conn.SetReadLimit(int64(s.maxBodySize))
+
+	session := &wsSession{
+		server: s,
+		conn:   conn,
+		subs:   make(map[string]*subscription.Subscription),
+	}
+	if s.limiter != nil {
+		session.limit = limitOf(r, s.clientKey)
+	}
+	session.serve(r.Context())
+}
+
+type wsSession struct {
+	server *Server
+	conn   *websocket.Conn
+	// limit is the client messages are charged to when rate limiting.
+	limit clientLimit
+
+	writeMu sync.Mutex
+
+	mu   sync.Mutex
+	subs map[string]*subscription.Subscription
+}
+
+func (ws *wsSession) serve(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		ws.conn.Close()
+		wg.Wait()
+
+		ws.mu.Lock()
+		for id, sub := range ws.subs {
+			sub.Unsubscribe()
+			delete(ws.subs, id)
+		}
+		ws.mu.Unlock()
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ws.keepAlive(ctx)
+	}()
+
+	inFlight := make(chan struct{}, wsMaxInFlight)
+	for {
+		_, data, err := ws.conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				ws.server.logger.Debug("websocket client disconnected", zap.Error(err))
+			}
+			return
+		}
+
+		// Requests are handled concurrently, like geth does, so a slow
+		// call does not hold up the ones behind it.
+		inFlight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-inFlight }()
+			resp, subs := ws.handleMessage(ctx, data)
+			if resp != nil {
+				ws.write(resp)
+			}
+			// Notifications only follow the subscription ID they are for.
+			for _, sub := range subs {
+				go ws.forward(sub)
+			}
+		}()
+	}
+}
+
+// keepAlive pings the client so idle connections are not dropped by
+// intermediaries.
+func (ws *wsSession) keepAlive(ctx context.Context) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ws.writeMu.Lock()
+			err := ws.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+			ws.writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleMessage answers a message and returns the subscriptions it started,
+// whose notifications are to be forwarded once the answer is written.
+func (ws *wsSession) handleMessage(ctx context.Context, data []byte) (interface{}, []*subscription.Subscription) {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		reqs, err := rpc.ParseBatch(data)
+		if err != nil {
+			return rpc.NewErrorResponse(nil, rpc.ParseError, "invalid json"), nil
+		}
+		if resp := ws.charge(nil, reqs, true); resp != nil {
+			return resp, nil
+		}
+		var started []startedSub
+		resps := ws.server.proxy.HandleBatchRequestWith(ctx, reqs, ws.local(&started))
+		return answers(resps), ws.answered(started, resps)
+	}
+
+	var req rpc.JSONRPCRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return rpc.NewErrorResponse(nil, rpc.ParseError, "invalid json"), nil
+	}
+	if resp := ws.charge(req.ID, []*rpc.JSONRPCRequest{&req}, false); resp != nil {
+		return resp, nil
+	}
+	var started []startedSub
+	resp := ws.server.proxy.HandleRequestWith(ctx, &req, ws.local(&started))
+	subs := ws.answered(started, []*rpc.JSONRPCResponse{resp})
+	// Notifications get a nil response, which must not be returned as a
+	// non-nil interface.
+	if resp != nil {
+		return resp, subs
+	}
+	return nil, subs
+}
+
+// charge takes the compute units of a message with reqs from the client's
+// rate limit. If they are not available, it returns the error response to
+// the message with id.
+func (ws *wsSession) charge(id json.RawMessage, reqs []*rpc.JSONRPCRequest, batch bool) *rpc.JSONRPCResponse {
+	if ws.server.limiter == nil {
+		return nil
+	}
+	methods := make([]string, len(reqs))
+	for i, req := range reqs {
+		methods[i] = req.Method
+	}
+	cost := ws.server.costs.Cost(methods, batch)
+	ok, retryAfter := ws.limit.allow(ws.server.limiter, cost)
+	if ok {
+		return nil
+	}
+	ws.server.logger.Warn("rate limit exceeded",
+		zap.String("client", ws.limit.key),
+		zap.Float64("cost", cost),
+		zap.Duration("retry_after", retryAfter))
+	observeMethods(ws.server.metrics, methods, rpc.LimitExceeded)
+	if retryAfter == 0 {
+		return rpc.NewErrorResponse(id, rpc.LimitExceeded, errCostAboveBurst)
+	}
+	return rpc.NewErrorResponse(id, rpc.LimitExceeded, "limit exceeded")
+}
+
+// answers returns resps, or nil when a batch had only notifications so
+// nothing is sent.
+func answers(resps []*rpc.JSONRPCResponse) interface{} {
+	if len(resps) == 0 {
+		return nil
+	}
+	return resps
+}
+
+// startedSub is a subscription started by a request and the response
+// carrying its ID.
+type startedSub struct {
+	req  *rpc.JSONRPCRequest
+	resp *rpc.JSONRPCResponse
+	sub  *subscription.Subscription
+}
+
+// local answers the subscription methods, which the proxy does not
+// forward, and adds the subscriptions it starts to started.
+func (ws *wsSession) local(started *[]startedSub) proxy.Local {
+	return func(ctx context.Context, req *rpc.JSONRPCRequest) (*rpc.JSONRPCResponse, bool) {
+		switch req.Method {
+		case "eth_subscribe":
+			resp, sub := ws.subscribe(ctx, req)
+			if sub != nil {
+				*started = append(*started, startedSub{req, resp, sub})
+			}
+			return resp, true
+		case "eth_unsubscribe":
+			return ws.unsubscribe(ctx, req), true
+		}
+		return nil, false
+	}
+}
+
+// answered returns the started subscriptions whose IDs are sent in resps.
+// The others, whose answers a batch limit replaced, are ended, as the
+// client never learns their IDs.
+func (ws *wsSession) answered(started []startedSub, resps []*rpc.JSONRPCResponse) []*subscription.Subscription {
+	sent := make(map[*rpc.JSONRPCResponse]bool, len(resps))
+	for _, resp := range resps {
+		sent[resp] = true
+	}
+	subs := make([]*subscription.Subscription, 0, len(started))
+	for _, s := range started {
+		if sent[s.resp] || s.req.IsNotification() {
+			subs = append(subs, s.sub)
+			continue
+		}
+		ws.mu.Lock()
+		delete(ws.subs, s.sub.ID)
+		ws.mu.Unlock()
+		s.sub.Unsubscribe()
+	}
+	return subs
+}
+
+// subscribe starts a subscription. Its notifications are not forwarded
+// until the caller calls forward.
+func (ws *wsSession) subscribe(ctx context.Context, req *rpc.JSONRPCRequest) (*rpc.JSONRPCResponse, *subscription.Subscription) {
+	sub, err := ws.server.hub.Subscribe(ctx, req.Params)
+	if err != nil {
+		return upstreamError(ws.server.logger, req, err), nil
+	}
+
+	ws.mu.Lock()
+	ws.subs[sub.ID] = sub
+	ws.mu.Unlock()
+
+	return result(req.ID, sub.ID), sub
+}
+
+// forward writes the notifications of sub to the client until it ends.
+func (ws *wsSession) forward(sub *subscription.Subscription) {
+	for result := range sub.C() {
+		ws.write(subscription.NewNotification(sub.ID, result))
+	}
+	// The hub stopped or the upstream rejected the subscription after a
+	// reconnect. Clients cannot tell a lost subscription from a quiet one,
+	// so disconnect them to make them resubscribe.
+	if err := sub.Err(); err != nil {
+		ws.server.logger.Warn("closing websocket client after its subscription was lost",
+			zap.String("subscription", sub.ID),
+			zap.Error(err))
+		ws.conn.Close()
+	}
+}
+
+func (ws *wsSession) unsubscribe(ctx context.Context, req *rpc.JSONRPCRequest) *rpc.JSONRPCResponse {
+	var params []string
+	if err := json.Unmarshal(req.Params, &params); err != nil || len(params) != 1 {
+		return rpc.NewErrorResponse(req.ID, rpc.InvalidParams, "expected a subscription id")
+	}
+
+	ws.mu.Lock()
+	sub, ok := ws.subs[params[0]]
+	delete(ws.subs, params[0])
+	ws.mu.Unlock()
+	if !ok {
+		return result(req.ID, false)
+	}
+
+	sub.Unsubscribe()
+	return result(req.ID, true)
+}
+
+func (ws *wsSession) write(v interface{}) {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	if err := ws.writeJSON(v); err != nil {
+		ws.server.logger.Debug("failed to write to websocket client", zap.Error(err))
+	}
+}
+
+// writeJSON is like Conn.WriteJSON, but leaves IDs and results unescaped.
+func (ws *wsSession) writeJSON(v interface{}) error {
+	w, err := ws.conn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+func result(id json.RawMessage, v interface{}) *rpc.JSONRPCResponse {
+	b, _ := json.Marshal(v)
+	return &rpc.JSONRPCResponse{JSONRPC: "2.0", Result: b, ID: id}
+}
+
+// upstreamError passes JSON-RPC errors from the upstream through and hides
+// transport errors behind a generic one.
+func upstreamError(logger *zap.Logger, req *rpc.JSONRPCRequest, err error) *rpc.JSONRPCResponse {
+	var rpcErr *rpc.JSONRPCError
+	if errors.As(err, &rpcErr) {
+		return &rpc.JSONRPCResponse{JSONRPC: "2.0", Error: rpcErr, ID: req.ID}
+	}
+	logger.Error("upstream websocket call failed", zap.Error(err), zap.String("method", req.Method))
+	return rpc.NewErrorResponse(req.ID, rpc.InternalError, "failed to forward request to upstream")
+}
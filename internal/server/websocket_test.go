@@ -0,0 +1,258 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/devlongs/geth-relay/proxy"
+	"github.com/devlongs/geth-relay/ratelimit"
+	"github.com/devlongs/geth-relay/rpc"
+	"github.com/devlongs/geth-relay/subscription"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// wsUpstream is an upstream WebSocket endpoint that answers every
+// eth_subscribe with the same subscription and publishes on request.
+type wsUpstream struct {
+	server     *httptest.Server
+	subscribes atomic.Int32
+	unsubs     atomic.Int32
+
+	mu sync.Mutex
+	ws *websocket.Conn
+}
+
+func newWSUpstream(t *testing.T) *wsUpstream {
+	u := &wsUpstream{}
+	u.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		u.mu.Lock()
+		u.ws = ws
+		u.mu.Unlock()
+		for {
+			var req rpc.JSONRPCRequest
+			if err := ws.ReadJSON(&req); err != nil {
+				return
+			}
+			result := "0xabc"
+			switch req.Method {
+			case "eth_subscribe":
+				u.subscribes.Add(1)
+			case "eth_unsubscribe":
+				u.unsubs.Add(1)
+			}
+			u.write(map[string]interface{}{"jsonrpc": "2.0", "id": req.ID, "result": result})
+		}
+	}))
+	t.Cleanup(u.server.Close)
+	return u
+}
+
+func (u *wsUpstream) write(v interface{}) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.ws.WriteJSON(v)
+}
+
+func (u *wsUpstream) url() string {
+	return "ws" + strings.TrimPrefix(u.server.URL, "http")
+}
+
+func TestServer_WebSocket(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req rpc.JSONRPCRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(rpc.JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: req.ID})
+	}))
+	defer upstream.Close()
+	ws := newWSUpstream(t)
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient(upstream.URL, 5*time.Second, logger)
+	hub := subscription.NewHub(ws.url(), logger, 128)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go hub.Run(ctx)
+	for deadline := time.Now().Add(5 * time.Second); !hub.Connected(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("hub did not connect")
+		}
+	}
+	server := New("localhost:8545", proxy.New(client, logger, 100, 25000000), logger, 5242880,
+		WithWebSocket(hub))
+	relay := httptest.NewServer(server.httpServer.Handler)
+	defer relay.Close()
+
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(relay.URL, "http"), nil)
+		if err != nil {
+			t.Fatalf("Dial() error = %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+	call := func(conn *websocket.Conn, req rpc.JSONRPCRequest) rpc.JSONRPCResponse {
+		conn.WriteJSON(req)
+		var resp rpc.JSONRPCResponse
+		if err := conn.ReadJSON(&resp); err != nil {
+			t.Fatalf("ReadJSON() error = %v", err)
+		}
+		return resp
+	}
+
+	a, b := dial(), dial()
+	defer b.Close()
+
+	// Plain calls are answered through the proxy.
+	if resp := call(a, rpc.JSONRPCRequest{JSONRPC: "2.0", Method: "eth_chainId", ID: json.RawMessage("1")}); string(resp.Result) != `"0x1"` {
+		t.Errorf("eth_chainId result = %s, want \"0x1\"", resp.Result)
+	}
+
+	subscribe := rpc.JSONRPCRequest{JSONRPC: "2.0", Method: "eth_subscribe", Params: json.RawMessage(`["newHeads"]`), ID: json.RawMessage("2")}
+	var idA, idB string
+	json.Unmarshal(call(a, subscribe).Result, &idA)
+	json.Unmarshal(call(b, subscribe).Result, &idB)
+	if idA == "" || idA == idB {
+		t.Fatalf("subscription ids = %q, %q, want distinct ids", idA, idB)
+	}
+	if n := ws.subscribes.Load(); n != 1 {
+		t.Errorf("upstream subscriptions = %d, want 1", n)
+	}
+
+	ws.write(subscription.NewNotification("0xabc", json.RawMessage(`{"number":"0x10"}`)))
+	for conn, id := range map[*websocket.Conn]string{a: idA, b: idB} {
+		var msg subscription.NotificationMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("ReadJSON() error = %v", err)
+		}
+		if msg.Params.Subscription != id || string(msg.Params.Result) != `{"number":"0x10"}` {
+			t.Errorf("notification = %+v, want the head for %s", msg.Params, id)
+		}
+	}
+
+	// The upstream subscription outlives the first client and ends with
+	// the last one.
+	a.Close()
+	time.Sleep(100 * time.Millisecond)
+	if n := ws.unsubs.Load(); n != 0 {
+		t.Errorf("upstream unsubscribes after first client left = %d, want 0", n)
+	}
+	unsubscribe := rpc.JSONRPCRequest{JSONRPC: "2.0", Method: "eth_unsubscribe", Params: json.RawMessage(`["` + idB + `"]`), ID: json.RawMessage("3")}
+	if resp := call(b, unsubscribe); string(resp.Result) != "true" {
+		t.Errorf("eth_unsubscribe result = %s, want true", resp.Result)
+	}
+	if n := ws.unsubs.Load(); n != 1 {
+		t.Errorf("upstream unsubscribes = %d, want 1", n)
+	}
+}
+
+func TestServer_WebSocketRateLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req rpc.JSONRPCRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(rpc.JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: req.ID})
+	}))
+	defer upstream.Close()
+	ws := newWSUpstream(t)
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient(upstream.URL, 5*time.Second, logger)
+	hub := subscription.NewHub(ws.url(), logger, 128)
+	server := New("localhost:8545", proxy.New(client, logger, 100, 25000000), logger, 5242880,
+		WithWebSocket(hub),
+		WithRateLimit(ratelimit.New(0.1, 3), ratelimit.NewCostTable(1, 0, nil), ClientKey(false)))
+	relay := httptest.NewServer(server.httpServer.Handler)
+	defer relay.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(relay.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// The upgrade costs one unit, leaving two for messages.
+	for i, want := range []int{0, 0, rpc.LimitExceeded} {
+		id := json.RawMessage(strconv.Itoa(i))
+		conn.WriteJSON(rpc.JSONRPCRequest{JSONRPC: "2.0", Method: "eth_chainId", ID: id})
+		var resp rpc.JSONRPCResponse
+		if err := conn.ReadJSON(&resp); err != nil {
+			t.Fatalf("ReadJSON() error = %v", err)
+		}
+		if got := errorCode(resp); got != want {
+			t.Errorf("message %d error code = %d, want %d", i, got, want)
+		}
+		if string(resp.ID) != string(id) {
+			t.Errorf("message %d ID = %s, want %s", i, resp.ID, id)
+		}
+	}
+}
+
+func TestServer_WebSocketBatchValidation(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient("http://127.0.0.1:0", 5*time.Second, logger)
+	hub := subscription.NewHub(newWSUpstream(t).url(), logger, 128)
+	server := New("localhost:8545", proxy.New(client, logger, 2, 25000000), logger, 5242880,
+		WithWebSocket(hub))
+	relay := httptest.NewServer(server.httpServer.Handler)
+	defer relay.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(relay.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	send := func(msg string) json.RawMessage {
+		conn.WriteMessage(websocket.TextMessage, []byte(msg))
+		var resp json.RawMessage
+		if err := conn.ReadJSON(&resp); err != nil {
+			t.Fatalf("ReadJSON() error = %v", err)
+		}
+		return resp
+	}
+
+	// Subscription methods do not take a batch past the proxy's limits.
+	for name, msg := range map[string]string{
+		"empty":     `[]`,
+		"too large": `[{"jsonrpc":"2.0","method":"eth_unsubscribe","params":["0x1"],"id":1},{"jsonrpc":"2.0","method":"eth_chainId","id":2},{"jsonrpc":"2.0","method":"eth_chainId","id":3}]`,
+	} {
+		var resps []rpc.JSONRPCResponse
+		if err := json.Unmarshal(send(msg), &resps); err != nil || len(resps) != 1 || errorCode(resps[0]) != rpc.InvalidRequest {
+			t.Errorf("%s batch answer = %+v, want one invalid request error", name, resps)
+		}
+	}
+
+	// Items are validated one by one, like in any other batch.
+	var resps []rpc.JSONRPCResponse
+	json.Unmarshal(send(`[{"jsonrpc":"1.0","method":"eth_subscribe","params":["newHeads"],"id":1},{"jsonrpc":"2.0","method":"eth_unsubscribe","params":["0x1"],"id":2}]`), &resps)
+	if len(resps) != 2 || errorCode(resps[0]) != rpc.InvalidRequest || string(resps[1].Result) != "false" {
+		t.Errorf("batch answer = %+v, want an invalid request error and false", resps)
+	}
+
+	var resp rpc.JSONRPCResponse
+	json.Unmarshal(send(`{"jsonrpc":"1.0","method":"eth_subscribe","params":["newHeads"],"id":1}`), &resp)
+	if errorCode(resp) != rpc.InvalidRequest {
+		t.Errorf("eth_subscribe with jsonrpc 1.0 error = %+v, want invalid request", resp.Error)
+	}
+}
+
+func errorCode(resp rpc.JSONRPCResponse) int {
+	if resp.Error == nil {
+		return 0
+	}
+	return resp.Error.Code
+}
@@ -0,0 +1,37 @@
+package methods
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ValidateRule reports whether rule is an exact method name, a namespace
+// wildcard such as "debug_*", or "*".
+func ValidateRule(rule string) error {
+	if rule == "" {
+		return errors.New("method rule must not be empty")
+	}
+	if rule == "*" {
+		return nil
+	}
+	prefix, wildcard := strings.CutSuffix(rule, "_*")
+	if strings.Contains(prefix, "*") || (wildcard && prefix == "") {
+		return fmt.Errorf("method rule %q: wildcards are only supported as a namespace suffix such as debug_*", rule)
+	}
+	return nil
+}
+
+// Match reports whether method matches one of rules. A trailing * matches
+// any suffix.
+func Match(rules []string, method string) bool {
+	for _, rule := range rules {
+		if rule == "*" || rule == method {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(rule, "*"); ok && strings.HasPrefix(method, prefix) {
+			return true
+		}
+	}
+	return false
+}
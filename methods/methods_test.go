@@ -0,0 +1,37 @@
+package methods
+
+import "testing"
+
+func TestValidateRule(t *testing.T) {
+	for _, rule := range []string{"*", "eth_call", "debug_*"} {
+		if err := ValidateRule(rule); err != nil {
+			t.Errorf("ValidateRule(%q) error = %v", rule, err)
+		}
+	}
+	for _, rule := range []string{"", "debug*", "_*", "eth_*_call", "*_call"} {
+		if err := ValidateRule(rule); err == nil {
+			t.Errorf("ValidateRule(%q) should fail", rule)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		rules  []string
+		method string
+		want   bool
+	}{
+		{nil, "eth_call", false},
+		{[]string{"*"}, "eth_call", true},
+		{[]string{"eth_call"}, "eth_call", true},
+		{[]string{"eth_call"}, "eth_callMany", false},
+		{[]string{"debug_*"}, "debug_traceCall", true},
+		{[]string{"debug_trace*"}, "debug_traceCall", true},
+		{[]string{"debug_trace*"}, "debug_setHead", false},
+	}
+	for _, tt := range tests {
+		if got := Match(tt.rules, tt.method); got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.rules, tt.method, got, tt.want)
+		}
+	}
+}
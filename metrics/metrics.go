@@ -0,0 +1,200 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "geth_relay"
+
+// maxMethods bounds the number of method label values. Method names come
+// from clients, so without a bound every made-up name would create new
+// series; methods seen after the first maxMethods are counted as "other".
+const maxMethods = 512
+
+// BatchMethod is the method label of requests and upstream calls that carry
+// a whole batch.
+const BatchMethod = "batch"
+
+// Metrics records Prometheus metrics about the relay's traffic. A nil
+// *Metrics records nothing, so callers need not check whether metrics are
+// enabled.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	errors          *prometheus.CounterVec
+	upstreamLatency *prometheus.HistogramVec
+	upstreamErrors  *prometheus.CounterVec
+	batchSize       prometheus.Histogram
+	requestBytes    *prometheus.HistogramVec
+	responseBytes   *prometheus.HistogramVec
+	inFlight        prometheus.Gauge
+
+	mu      sync.Mutex
+	methods map[string]bool
+}
+
+func New() *Metrics {
+	sizeBuckets := prometheus.ExponentialBuckets(64, 4, 10) // 64B to 16MB
+
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rpc_requests_total",
+			Help:      "JSON-RPC requests handled, by method. Batch items are counted individually.",
+		}, []string{"method"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rpc_errors_total",
+			Help:      "JSON-RPC requests answered with an error, by method and JSON-RPC error code.",
+		}, []string{"method", "code"}),
+		upstreamLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "upstream_request_duration_seconds",
+			Help:      "Latency of requests to upstream nodes, by upstream and method.",
+			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		}, []string{"upstream", "method"}),
+		upstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upstream_errors_total",
+			Help:      "Requests to upstream nodes that failed or got a non-200 status, by upstream.",
+		}, []string{"upstream"}),
+		batchSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "batch_size",
+			Help:      "Number of items in batch requests.",
+			Buckets:   []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000},
+		}),
+		requestBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_bytes",
+			Help:      "Size of HTTP request bodies, by method.",
+			Buckets:   sizeBuckets,
+		}, []string{"method"}),
+		responseBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "response_bytes",
+			Help:      "Size of HTTP response bodies, by method.",
+			Buckets:   sizeBuckets,
+		}, []string{"method"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "in_flight_requests",
+			Help:      "HTTP JSON-RPC requests currently being handled.",
+		}),
+		methods: make(map[string]bool),
+	}
+
+	m.registry.MustRegister(
+		m.requests,
+		m.errors,
+		m.upstreamLatency,
+		m.upstreamErrors,
+		m.batchSize,
+		m.requestBytes,
+		m.responseBytes,
+		m.inFlight,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// ObserveRequest counts a request for method that was answered with the
+// JSON-RPC error code, or successfully if code is zero.
+func (m *Metrics) ObserveRequest(method string, code int) {
+	if m == nil {
+		return
+	}
+	method = m.methodLabel(method)
+	m.requests.WithLabelValues(method).Inc()
+	if code != 0 {
+		m.errors.WithLabelValues(method, strconv.Itoa(code)).Inc()
+	}
+}
+
+// ObserveUpstream records a request to upstream that took d.
+func (m *Metrics) ObserveUpstream(upstream, method string, d time.Duration, failed bool) {
+	if m == nil {
+		return
+	}
+	m.upstreamLatency.WithLabelValues(upstream, m.methodLabel(method)).Observe(d.Seconds())
+	if failed {
+		m.upstreamErrors.WithLabelValues(upstream).Inc()
+	}
+}
+
+// ObserveBatch records the number of items in a batch request.
+func (m *Metrics) ObserveBatch(size int) {
+	if m == nil {
+		return
+	}
+	m.batchSize.Observe(float64(size))
+}
+
+// ObserveBytes records the body sizes of an HTTP request for method and
+// its response.
+func (m *Metrics) ObserveBytes(method string, request, response int) {
+	if m == nil {
+		return
+	}
+	method = m.methodLabel(method)
+	m.requestBytes.WithLabelValues(method).Observe(float64(request))
+	m.responseBytes.WithLabelValues(method).Observe(float64(response))
+}
+
+// Begin counts a request as in flight until the returned function is called.
+func (m *Metrics) Begin() func() {
+	if m == nil {
+		return func() {}
+	}
+	m.inFlight.Inc()
+	return m.inFlight.Dec
+}
+
+func (m *Metrics) methodLabel(method string) string {
+	if method == "" {
+		return "none"
+	}
+	if !validMethod(method) {
+		return "invalid"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.methods[method] {
+		return method
+	}
+	if len(m.methods) >= maxMethods {
+		return "other"
+	}
+	m.methods[method] = true
+	return method
+}
+
+// validMethod reports whether method looks like a JSON-RPC method name:
+// short and made of letters, digits and underscores.
+func validMethod(method string) bool {
+	if len(method) > 64 {
+		return false
+	}
+	for _, c := range method {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
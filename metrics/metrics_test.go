@@ -0,0 +1,72 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics_Nil(t *testing.T) {
+	var m *Metrics
+	m.ObserveRequest("eth_chainId", 0)
+	m.ObserveUpstream("node", "eth_chainId", time.Millisecond, false)
+	m.ObserveBatch(2)
+	m.ObserveBytes("eth_chainId", 10, 20)
+	m.Begin()()
+}
+
+func TestMetrics_MethodLabel(t *testing.T) {
+	m := New()
+	for i := 0; i < maxMethods; i++ {
+		m.methodLabel(fmt.Sprintf("eth_method%d", i))
+	}
+
+	tests := []struct {
+		method string
+		want   string
+	}{
+		{"eth_method0", "eth_method0"},
+		{"eth_unseen", "other"},
+		{"", "none"},
+		{"eth_call\"}", "invalid"},
+		{strings.Repeat("a", 65), "invalid"},
+	}
+	for _, tt := range tests {
+		if got := m.methodLabel(tt.method); got != tt.want {
+			t.Errorf("methodLabel(%q) = %q, want %q", tt.method, got, tt.want)
+		}
+	}
+}
+
+func TestMetrics_Handler(t *testing.T) {
+	m := New()
+	m.ObserveRequest("eth_call", 0)
+	m.ObserveRequest("eth_call", 3)
+	m.ObserveUpstream("node-a", "eth_call", 20*time.Millisecond, true)
+	m.ObserveBatch(5)
+	m.ObserveBytes("eth_call", 100, 2000)
+	done := m.Begin()
+	defer done()
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(w.Body)
+
+	for _, want := range []string{
+		`geth_relay_rpc_requests_total{method="eth_call"} 2`,
+		`geth_relay_rpc_errors_total{code="3",method="eth_call"} 1`,
+		`geth_relay_upstream_request_duration_seconds_count{method="eth_call",upstream="node-a"} 1`,
+		`geth_relay_upstream_errors_total{upstream="node-a"} 1`,
+		`geth_relay_batch_size_sum 5`,
+		`geth_relay_request_bytes_sum{method="eth_call"} 100`,
+		`geth_relay_response_bytes_sum{method="eth_call"} 2000`,
+		`geth_relay_in_flight_requests 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("metrics do not contain %q", want)
+		}
+	}
+}
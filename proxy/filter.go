@@ -0,0 +1,31 @@
+package proxy
+
+import "github.com/devlongs/geth-relay/methods"
+
+// MethodFilter decides which methods may be forwarded upstream. Rules are
+// exact method names, namespace wildcards such as "debug_*", or "*".
+type MethodFilter struct {
+	allow []string
+	deny  []string
+}
+
+// NewMethodFilter returns a filter that rejects methods matching a deny
+// rule and, when allow is not empty, methods matching no allow rule.
+func NewMethodFilter(allow, deny []string) (*MethodFilter, error) {
+	for _, rules := range [][]string{allow, deny} {
+		for _, rule := range rules {
+			if err := methods.ValidateRule(rule); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &MethodFilter{allow: allow, deny: deny}, nil
+}
+
+// Allowed reports whether method may be forwarded.
+func (f *MethodFilter) Allowed(method string) bool {
+	if methods.Match(f.deny, method) {
+		return false
+	}
+	return len(f.allow) == 0 || methods.Match(f.allow, method)
+}
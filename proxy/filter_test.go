@@ -0,0 +1,34 @@
+package proxy
+
+import "testing"
+
+func TestMethodFilter_Allowed(t *testing.T) {
+	tests := []struct {
+		name   string
+		allow  []string
+		deny   []string
+		method string
+		want   bool
+	}{
+		{name: "no rules", method: "admin_addPeer", want: true},
+		{name: "denied namespace", deny: []string{"admin_*"}, method: "admin_addPeer", want: false},
+		{name: "other namespace", deny: []string{"admin_*"}, method: "eth_call", want: true},
+		{name: "denied method", deny: []string{"debug_traceCall"}, method: "debug_traceCall", want: false},
+		{name: "sibling of denied method", deny: []string{"debug_traceCall"}, method: "debug_traceTransaction", want: true},
+		{name: "not in allowlist", allow: []string{"eth_*", "net_version"}, method: "web3_clientVersion", want: false},
+		{name: "in allowlist", allow: []string{"eth_*", "net_version"}, method: "net_version", want: true},
+		{name: "deny wins", allow: []string{"*"}, deny: []string{"eth_sendRawTransaction"}, method: "eth_sendRawTransaction", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewMethodFilter(tt.allow, tt.deny)
+			if err != nil {
+				t.Fatalf("NewMethodFilter() error = %v", err)
+			}
+			if got := f.Allowed(tt.method); got != tt.want {
+				t.Errorf("Allowed(%q) = %v, want %v", tt.method, got, tt.want)
+			}
+		})
+	}
+}
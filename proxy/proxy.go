@@ -2,56 +2,224 @@ package proxy
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
 
+	"github.com/devlongs/geth-relay/auth"
+	"github.com/devlongs/geth-relay/cache"
+	"github.com/devlongs/geth-relay/metrics"
 	"github.com/devlongs/geth-relay/rpc"
+	"github.com/devlongs/geth-relay/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+var tracer = otel.Tracer("github.com/devlongs/geth-relay/proxy")
+
 type Proxy struct {
 	client        *rpc.Client
 	logger        *zap.Logger
 	maxBatchItems int
 	maxBatchSize  int
+	cache         *cache.Cache
+	methods       *MethodFilter
+	metrics       *metrics.Metrics
+
+	// subBatchSize and batchWorkers configure batch fan-out; zero
+	// subBatchSize forwards batches whole.
+	subBatchSize int
+	batchWorkers int
+}
+
+// Option configures optional Proxy features.
+type Option func(*Proxy)
+
+// WithCache serves deterministic requests from c instead of the upstream.
+func WithCache(c *cache.Cache) Option {
+	return func(p *Proxy) {
+		p.cache = c
+	}
+}
+
+// WithMethodFilter rejects methods f does not allow with MethodNotFound.
+func WithMethodFilter(f *MethodFilter) Option {
+	return func(p *Proxy) {
+		p.methods = f
+	}
 }
 
-func New(client *rpc.Client, logger *zap.Logger, maxBatchItems, maxBatchSize int) *Proxy {
-	return &Proxy{
+// WithMetrics counts requests and errors by method in m.
+func WithMetrics(m *metrics.Metrics) Option {
+	return func(p *Proxy) {
+		p.metrics = m
+	}
+}
+
+const (
+	// retryWorkers is the number of failed batch items retried at once
+	// when batch fan-out is not configured.
+	retryWorkers = 8
+	// maxItemRetries is the number of failed items of a batch retried at
+	// most.
+	maxItemRetries = 16
+	// minRetryTime is the time that must be left before the deadline to
+	// retry failed batch items.
+	minRetryTime = 2 * time.Second
+)
+
+// WithBatchFanout splits batches into sub-batches of up to subBatchSize
+// items, or individual calls when it is 1, and forwards at most workers of
+// them concurrently, each to the upstream the pool picks for it.
+func WithBatchFanout(subBatchSize, workers int) Option {
+	return func(p *Proxy) {
+		p.subBatchSize = subBatchSize
+		p.batchWorkers = workers
+	}
+}
+
+func New(client *rpc.Client, logger *zap.Logger, maxBatchItems, maxBatchSize int, opts ...Option) *Proxy {
+	p := &Proxy{
 		client:        client,
 		logger:        logger,
 		maxBatchItems: maxBatchItems,
 		maxBatchSize:  maxBatchSize,
 	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
 }
 
+// Upstreams returns the upstream pool requests are forwarded to.
+func (p *Proxy) Upstreams() []*rpc.Upstream {
+	return p.client.Upstreams()
+}
+
+// Local answers a request on the relay itself instead of forwarding it,
+// such as a subscription on a WebSocket, and reports whether it did. It is
+// only called for valid requests whose method is allowed.
+type Local func(ctx context.Context, req *rpc.JSONRPCRequest) (*rpc.JSONRPCResponse, bool)
+
+// HandleRequest answers req, or forwards it and returns nil if it is a
+// notification.
 func (p *Proxy) HandleRequest(ctx context.Context, req *rpc.JSONRPCRequest) *rpc.JSONRPCResponse {
-	if req.JSONRPC != "2.0" {
-		p.logger.Warn("invalid jsonrpc version",
-			zap.String("version", req.JSONRPC),
-			zap.String("method", req.Method))
-		return rpc.NewErrorResponse(req.ID, rpc.InvalidRequest, "jsonrpc must be 2.0")
+	return p.HandleRequestWith(ctx, req, nil)
+}
+
+// HandleRequestWith is like HandleRequest, but lets local answer req.
+func (p *Proxy) HandleRequestWith(ctx context.Context, req *rpc.JSONRPCRequest, local Local) *rpc.JSONRPCResponse {
+	ctx, span := tracer.Start(ctx, "Proxy.HandleRequest", trace.WithAttributes(tracing.MethodKey.String(req.Method)))
+	defer span.End()
+
+	resp := p.handleRequest(ctx, req, local)
+	if resp.Error != nil {
+		tracing.SetErrorCode(span, resp.Error.Code, resp.Error.Message)
 	}
+	p.metrics.ObserveRequest(req.Method, errorCode(resp))
+	if isNotification(req) {
+		return nil
+	}
+	return resp
+}
 
-	if req.Method == "" {
-		p.logger.Warn("empty method in request")
-		return rpc.NewErrorResponse(req.ID, rpc.InvalidRequest, "method cannot be empty")
+func (p *Proxy) handleRequest(ctx context.Context, req *rpc.JSONRPCRequest, local Local) *rpc.JSONRPCResponse {
+	if resp := p.validate(req); resp != nil {
+		return resp
+	}
+
+	if resp := p.CheckMethod(ctx, req); resp != nil {
+		return resp
+	}
+
+	if local != nil {
+		if resp, ok := local(ctx, req); ok {
+			return resp
+		}
 	}
 
 	p.logger.Info("handling request",
 		zap.String("method", req.Method),
-		zap.Any("id", req.ID))
+		zap.ByteString("id", req.ID))
+
+	var ticket *cache.Ticket
+	if p.cache != nil {
+		var result []byte
+		if result, ticket = p.cache.Get(req.Method, req.Params); result != nil {
+			p.logger.Debug("serving request from cache", zap.String("method", req.Method))
+			return &rpc.JSONRPCResponse{JSONRPC: "2.0", Result: result, ID: req.ID}
+		}
+	}
 
 	resp, err := p.client.Forward(ctx, req)
 	if err != nil {
 		p.logger.Error("failed to forward request",
 			zap.Error(err),
 			zap.String("method", req.Method))
-		return rpc.NewErrorResponse(req.ID, rpc.InternalError, "failed to forward request to upstream")
+		return forwardError(req, err, "failed to forward request to upstream")
+	}
+	// The client's id is echoed as sent, even if the upstream rewrote it.
+	resp.ID = req.ID
+
+	if p.cache != nil && resp.Error == nil {
+		if req.Method == "eth_blockNumber" {
+			if head, err := rpc.DecodeQuantity(resp.Result); err == nil {
+				p.cache.ObserveHead(head)
+			}
+		}
+		p.cache.Put(ticket, resp.Result)
 	}
 
 	return resp
 }
 
+// HandleBatchRequest answers the items of a batch in order. Notifications
+// are forwarded but left out, so a batch of notifications only gets an
+// empty list.
 func (p *Proxy) HandleBatchRequest(ctx context.Context, reqs []*rpc.JSONRPCRequest) []*rpc.JSONRPCResponse {
+	return p.HandleBatchRequestWith(ctx, reqs, nil)
+}
+
+// HandleBatchRequestWith is like HandleBatchRequest, but lets local answer
+// items. Local answers are subject to the same batch limits as forwarded
+// ones.
+func (p *Proxy) HandleBatchRequestWith(ctx context.Context, reqs []*rpc.JSONRPCRequest, local Local) []*rpc.JSONRPCResponse {
+	ctx, span := tracer.Start(ctx, "Proxy.HandleBatchRequest", trace.WithAttributes(tracing.BatchSizeKey.Int(len(reqs))))
+	defer span.End()
+
+	resps := p.handleBatchRequest(ctx, reqs, local)
+	// A batch rejected as a whole is answered with a single error.
+	if len(resps) == 1 && len(reqs) != 1 && resps[0].Error != nil {
+		tracing.SetErrorCode(span, resps[0].Error.Code, resps[0].Error.Message)
+	}
+	if p.metrics != nil && len(reqs) > 0 {
+		p.metrics.ObserveBatch(len(reqs))
+		p.observeBatch(reqs, resps)
+	}
+	if len(resps) != len(reqs) {
+		return resps
+	}
+
+	answered := resps[:0]
+	for i, resp := range resps {
+		if !isNotification(reqs[i]) {
+			answered = append(answered, resp)
+		}
+	}
+	return answered
+}
+
+// isNotification reports whether req must not be answered. Invalid
+// requests are answered even without an id, as the JSON-RPC spec requires.
+func isNotification(req *rpc.JSONRPCRequest) bool {
+	return req.IsNotification() && req.JSONRPC == "2.0" && req.Method != ""
+}
+
+func (p *Proxy) handleBatchRequest(ctx context.Context, reqs []*rpc.JSONRPCRequest, local Local) []*rpc.JSONRPCResponse {
 	if len(reqs) == 0 {
 		p.logger.Warn("empty batch request")
 		return []*rpc.JSONRPCResponse{
@@ -75,29 +243,276 @@ func (p *Proxy) HandleBatchRequest(ctx context.Context, reqs []*rpc.JSONRPCReque
 	p.logger.Info("handling batch request",
 		zap.Int("size", len(reqs)))
 
+	// Invalid items and items calling methods that are not allowed are
+	// answered here, each with its own error, like geth does. The rest
+	// are forwarded and slotted back in by position.
+	resps := make([]*rpc.JSONRPCResponse, len(reqs))
+	pending := make([]int, 0, len(reqs))
 	for i, req := range reqs {
-		if req.JSONRPC != "2.0" {
-			p.logger.Warn("invalid jsonrpc version in batch",
-				zap.Int("index", i),
-				zap.String("version", req.JSONRPC))
-			return []*rpc.JSONRPCResponse{
-				rpc.NewErrorResponse(req.ID, rpc.InvalidRequest, "jsonrpc must be 2.0"),
+		if resp := p.validate(req); resp != nil {
+			resps[i] = resp
+			continue
+		}
+		if resp := p.CheckMethod(ctx, req); resp != nil {
+			resps[i] = resp
+			continue
+		}
+		if local != nil {
+			if resp, ok := local(ctx, req); ok {
+				resps[i] = resp
+				continue
 			}
 		}
+		pending = append(pending, i)
+	}
+	if len(pending) == 0 {
+		p.limitResponseSize(resps)
+		return resps
+	}
+
+	if p.subBatchSize > 0 {
+		p.fanOut(ctx, reqs, resps, pending, p.subBatchSize, p.batchWorkers)
+	} else {
+		p.forwardChunk(ctx, reqs, resps, pending)
 	}
+	p.retryFailed(ctx, reqs, resps)
+	p.limitResponseSize(resps)
+	return resps
+}
 
-	resps, err := p.client.ForwardBatch(ctx, reqs)
+// limitResponseSize answers the items after the point where the responses
+// of the batch exceed maxBatchSize bytes with "response too large" errors,
+// like geth does. Errors count as well, including their data.
+func (p *Proxy) limitResponseSize(resps []*rpc.JSONRPCResponse) {
+	if p.maxBatchSize <= 0 {
+		return
+	}
+	size := 0
+	for i, resp := range resps {
+		if size > p.maxBatchSize {
+			p.logger.Warn("batch response exceeds limit",
+				zap.Int("size", size),
+				zap.Int("limit", p.maxBatchSize),
+				zap.Int("dropped_items", len(resps)-i))
+			for j := i; j < len(resps); j++ {
+				resps[j] = &rpc.JSONRPCResponse{JSONRPC: "2.0", Error: rpc.ErrResponseTooLarge, ID: resps[j].ID}
+			}
+			return
+		}
+		encoded, _ := json.Marshal(resp)
+		size += len(encoded)
+	}
+}
+
+// validate returns an error response if req is not a valid JSON-RPC 2.0
+// request, and nil otherwise.
+func (p *Proxy) validate(req *rpc.JSONRPCRequest) *rpc.JSONRPCResponse {
+	// An invalid id is not echoed.
+	if !req.HasValidID() {
+		p.logger.Warn("invalid id in request", zap.ByteString("id", req.ID))
+		return rpc.NewErrorResponse(nil, rpc.InvalidRequest, "id must be a string, number or null")
+	}
+	if req.JSONRPC != "2.0" {
+		p.logger.Warn("invalid jsonrpc version",
+			zap.String("version", req.JSONRPC),
+			zap.String("method", req.Method))
+		return rpc.NewErrorResponse(req.ID, rpc.InvalidRequest, "jsonrpc must be 2.0")
+	}
+	if req.Method == "" {
+		p.logger.Warn("empty method in request")
+		return rpc.NewErrorResponse(req.ID, rpc.InvalidRequest, "method cannot be empty")
+	}
+	return nil
+}
+
+// fanOut forwards the requests at the indices in pending as sub-batches of
+// up to size items, or individual calls when size is 1, at most workers at
+// a time, and stores the responses in their slots of resps.
+func (p *Proxy) fanOut(ctx context.Context, reqs []*rpc.JSONRPCRequest, resps []*rpc.JSONRPCResponse, pending []int, size, workers int) {
+	sem := make(chan struct{}, max(workers, 1))
+	var wg sync.WaitGroup
+	for start := 0; start < len(pending); start += size {
+		chunk := pending[start:min(start+size, len(pending))]
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if size == 1 {
+				p.forwardItem(ctx, reqs, resps, chunk[0])
+			} else {
+				p.forwardChunk(ctx, reqs, resps, chunk)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// forwardItem forwards the request at index i as an individual call and
+// stores its response in resps.
+func (p *Proxy) forwardItem(ctx context.Context, reqs []*rpc.JSONRPCRequest, resps []*rpc.JSONRPCResponse, i int) {
+	req := reqs[i]
+	resp, err := p.client.Forward(ctx, req)
+	if err != nil {
+		p.logger.Error("failed to forward batch item",
+			zap.Error(err),
+			zap.String("method", req.Method))
+		resp = forwardError(req, err, "failed to forward batch request")
+	}
+	resp.ID = req.ID
+	resps[i] = resp
+}
+
+// forwardChunk forwards the requests at the indices in chunk as a batch
+// and stores their responses in resps. Items are sent with their position
+// in the chunk as ID, so answers are matched back even when the client
+// reused an ID. When the batch fails or the upstream leaves items
+// unanswered, their slots stay empty for retryFailed.
+func (p *Proxy) forwardChunk(ctx context.Context, reqs []*rpc.JSONRPCRequest, resps []*rpc.JSONRPCResponse, chunk []int) {
+	sub := make([]*rpc.JSONRPCRequest, len(chunk))
+	for j, i := range chunk {
+		req := *reqs[i]
+		if !req.IsNotification() {
+			req.ID = json.RawMessage(strconv.Itoa(j))
+		}
+		sub[j] = &req
+	}
+	upstreamResps, err := p.client.ForwardBatch(ctx, sub)
 	if err != nil {
 		p.logger.Error("failed to forward batch request",
 			zap.Error(err),
-			zap.Int("size", len(reqs)))
+			zap.Int("size", len(sub)))
+		return
+	}
+	for j, i := range chunk {
+		// Notifications are not answered, and must not be sent again.
+		if sub[j].IsNotification() {
+			resps[i] = &rpc.JSONRPCResponse{JSONRPC: "2.0"}
+		}
+	}
+	for _, resp := range upstreamResps {
+		if resp == nil {
+			continue
+		}
+		j, err := strconv.Atoi(string(resp.ID))
+		if err != nil || j < 0 || j >= len(chunk) || resps[chunk[j]] != nil {
+			continue
+		}
+		i := chunk[j]
+		resp.ID = reqs[i].ID
+		resps[i] = resp
+	}
+}
 
-		errorResps := make([]*rpc.JSONRPCResponse, len(reqs))
-		for i, req := range reqs {
-			errorResps[i] = rpc.NewErrorResponse(req.ID, rpc.InternalError, "failed to forward batch request")
+// retryFailed forwards the items left without a response once more, each
+// as an individual call, so a failed batch costs only the items that fail
+// again. Items that must not run twice are not retried. Every retry comes
+// out of the client's retry budget, at most maxItemRetries items are
+// retried, and none when the deadline is near. Items left without a
+// response get an internal error.
+func (p *Proxy) retryFailed(ctx context.Context, reqs []*rpc.JSONRPCRequest, resps []*rpc.JSONRPCResponse) {
+	var failed []int
+	for i := range resps {
+		if resps[i] == nil {
+			failed = append(failed, i)
 		}
-		return errorResps
+	}
+	if len(failed) == 0 {
+		return
 	}
 
-	return resps
+	var retry []int
+	if retryTimeLeft(ctx) {
+		for _, i := range failed {
+			if len(retry) == maxItemRetries {
+				break
+			}
+			// The batch may have run the item already.
+			if rpc.Resendable(reqs[i].Method) && p.client.TakeRetry() {
+				retry = append(retry, i)
+			}
+		}
+	}
+	if len(retry) < len(failed) {
+		p.logger.Warn("not retrying failed batch items",
+			zap.Int("failed", len(failed)),
+			zap.Int("retried", len(retry)))
+	}
+	if len(retry) > 0 {
+		p.logger.Warn("retrying failed batch items individually", zap.Int("items", len(retry)))
+		p.fanOut(ctx, reqs, resps, retry, 1, max(p.batchWorkers, retryWorkers))
+		for _, i := range retry {
+			resps[i] = rpc.ResolveResent(reqs[i], resps[i])
+		}
+	}
+	for _, i := range failed {
+		if resps[i] == nil {
+			resps[i] = rpc.NewErrorResponse(reqs[i].ID, rpc.InternalError, "failed to forward batch request")
+		}
+	}
+}
+
+// retryTimeLeft reports whether ctx leaves time to retry failed items.
+func retryTimeLeft(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	deadline, ok := ctx.Deadline()
+	return !ok || time.Until(deadline) >= minRetryTime
+}
+
+// CheckMethod returns an error response if req.Method is disabled on the
+// relay or not allowed for the request's API key, and nil otherwise.
+func (p *Proxy) CheckMethod(ctx context.Context, req *rpc.JSONRPCRequest) *rpc.JSONRPCResponse {
+	if p.methods != nil && !p.methods.Allowed(req.Method) {
+		p.logger.Warn("method denied", zap.String("method", req.Method))
+		return rpc.NewErrorResponse(req.ID, rpc.MethodNotFound,
+			fmt.Sprintf("the method %s does not exist/is not available", req.Method))
+	}
+
+	policy, ok := auth.FromContext(ctx)
+	if !ok || policy.AllowsMethod(req.Method) {
+		return nil
+	}
+	p.logger.Warn("method not allowed for API key",
+		zap.String("key", policy.Name),
+		zap.String("method", req.Method))
+	return rpc.NewErrorResponse(req.ID, rpc.MethodNotFound,
+		fmt.Sprintf("method %s is not allowed for this API key", req.Method))
+}
+
+// observeBatch counts every item of a batch with the error code of its
+// response. When the whole batch was rejected with a single error, every
+// item is counted with that error.
+func (p *Proxy) observeBatch(reqs []*rpc.JSONRPCRequest, resps []*rpc.JSONRPCResponse) {
+	for i, req := range reqs {
+		resp := resps[0]
+		if len(resps) == len(reqs) {
+			resp = resps[i]
+		}
+		p.metrics.ObserveRequest(req.Method, errorCode(resp))
+	}
+}
+
+// forwardError returns the response to req when forwarding it failed with
+// err. JSON-RPC errors such as rpc.ErrResponseTooLarge are passed on; other
+// errors are hidden behind an internal error with message.
+func forwardError(req *rpc.JSONRPCRequest, err error, message string) *rpc.JSONRPCResponse {
+	var rpcErr *rpc.JSONRPCError
+	if errors.As(err, &rpcErr) {
+		return &rpc.JSONRPCResponse{JSONRPC: "2.0", Error: rpcErr, ID: req.ID}
+	}
+	return rpc.NewErrorResponse(req.ID, rpc.InternalError, message)
+}
+
+// errorCode returns the JSON-RPC error code of resp, zero if it succeeded.
+// A missing response counts as an internal error.
+func errorCode(resp *rpc.JSONRPCResponse) int {
+	if resp == nil {
+		return rpc.InternalError
+	}
+	if resp.Error != nil {
+		return resp.Error.Code
+	}
+	return 0
 }
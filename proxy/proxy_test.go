@@ -3,11 +3,17 @@ package proxy
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/devlongs/geth-relay/auth"
+	"github.com/devlongs/geth-relay/cache"
 	"github.com/devlongs/geth-relay/rpc"
 	"go.uber.org/zap"
 )
@@ -30,7 +36,7 @@ func TestProxy_HandleRequest(t *testing.T) {
 		resp := rpc.JSONRPCResponse{
 			JSONRPC: "2.0",
 			Result:  json.RawMessage(`"0x123"`),
-			ID:      1,
+			ID:      json.RawMessage("1"),
 		}
 		json.NewEncoder(w).Encode(resp)
 	}))
@@ -44,7 +50,7 @@ func TestProxy_HandleRequest(t *testing.T) {
 		JSONRPC: "2.0",
 		Method:  "eth_blockNumber",
 		Params:  json.RawMessage(`[]`),
-		ID:      1,
+		ID:      json.RawMessage("1"),
 	}
 
 	resp := proxy.HandleRequest(context.Background(), req)
@@ -64,7 +70,7 @@ func TestProxy_HandleRequestInvalidVersion(t *testing.T) {
 	req := &rpc.JSONRPCRequest{
 		JSONRPC: "1.0",
 		Method:  "eth_blockNumber",
-		ID:      1,
+		ID:      json.RawMessage("1"),
 	}
 
 	resp := proxy.HandleRequest(context.Background(), req)
@@ -84,7 +90,7 @@ func TestProxy_HandleRequestEmptyMethod(t *testing.T) {
 	req := &rpc.JSONRPCRequest{
 		JSONRPC: "2.0",
 		Method:  "",
-		ID:      1,
+		ID:      json.RawMessage("1"),
 	}
 
 	resp := proxy.HandleRequest(context.Background(), req)
@@ -96,8 +102,8 @@ func TestProxy_HandleRequestEmptyMethod(t *testing.T) {
 func TestProxy_HandleBatchRequest(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		resp := []*rpc.JSONRPCResponse{
-			{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: 1},
-			{JSONRPC: "2.0", Result: json.RawMessage(`"0x2"`), ID: 2},
+			{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: json.RawMessage("1")},
+			{JSONRPC: "2.0", Result: json.RawMessage(`"0x2"`), ID: json.RawMessage("2")},
 		}
 		json.NewEncoder(w).Encode(resp)
 	}))
@@ -108,8 +114,8 @@ func TestProxy_HandleBatchRequest(t *testing.T) {
 	proxy := New(client, logger, 100, 25000000)
 
 	reqs := []*rpc.JSONRPCRequest{
-		{JSONRPC: "2.0", Method: "eth_blockNumber", Params: json.RawMessage(`[]`), ID: 1},
-		{JSONRPC: "2.0", Method: "eth_gasPrice", Params: json.RawMessage(`[]`), ID: 2},
+		{JSONRPC: "2.0", Method: "eth_blockNumber", Params: json.RawMessage(`[]`), ID: json.RawMessage("1")},
+		{JSONRPC: "2.0", Method: "eth_gasPrice", Params: json.RawMessage(`[]`), ID: json.RawMessage("2")},
 	}
 
 	resps := proxy.HandleBatchRequest(context.Background(), reqs)
@@ -124,9 +130,9 @@ func TestProxy_HandleBatchRequestExceedsLimit(t *testing.T) {
 	proxy := New(client, logger, 2, 25000000)
 
 	reqs := []*rpc.JSONRPCRequest{
-		{JSONRPC: "2.0", Method: "eth_blockNumber", ID: 1},
-		{JSONRPC: "2.0", Method: "eth_gasPrice", ID: 2},
-		{JSONRPC: "2.0", Method: "eth_chainId", ID: 3},
+		{JSONRPC: "2.0", Method: "eth_blockNumber", ID: json.RawMessage("1")},
+		{JSONRPC: "2.0", Method: "eth_gasPrice", ID: json.RawMessage("2")},
+		{JSONRPC: "2.0", Method: "eth_chainId", ID: json.RawMessage("3")},
 	}
 
 	resps := proxy.HandleBatchRequest(context.Background(), reqs)
@@ -151,3 +157,543 @@ func TestProxy_HandleBatchRequestEmpty(t *testing.T) {
 		t.Error("Expected error for empty batch")
 	}
 }
+
+func TestProxy_HandleBatchRequestFailover(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqs []rpc.JSONRPCRequest
+		json.NewDecoder(r.Body).Decode(&reqs)
+		resp := []*rpc.JSONRPCResponse{
+			{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: reqs[0].ID},
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer up.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewPoolClient([]rpc.Endpoint{
+		{Name: "down", URL: down.URL, Weight: 10, Timeout: 5 * time.Second},
+		{Name: "up", URL: up.URL, Weight: 1, Timeout: 5 * time.Second},
+	}, logger)
+	proxy := New(client, logger, 100, 25000000)
+
+	reqs := []*rpc.JSONRPCRequest{
+		{JSONRPC: "2.0", Method: "eth_blockNumber", Params: json.RawMessage(`[]`), ID: json.RawMessage("1")},
+	}
+
+	resps := proxy.HandleBatchRequest(context.Background(), reqs)
+	if len(resps) != 1 {
+		t.Fatalf("len(resps) = %d, want 1", len(resps))
+	}
+	if resps[0].Error != nil {
+		t.Errorf("resps[0].Error = %v, want nil", resps[0].Error)
+	}
+}
+
+func TestProxy_HandleRequestCache(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var req rpc.JSONRPCRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		json.NewEncoder(w).Encode(rpc.JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: req.ID})
+	}))
+	defer server.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient(server.URL, 5*time.Second, logger)
+	proxy := New(client, logger, 100, 25000000, WithCache(cache.New(100, time.Minute)))
+
+	for i := 0; i < 3; i++ {
+		resp := proxy.HandleRequest(context.Background(), &rpc.JSONRPCRequest{
+			JSONRPC: "2.0",
+			Method:  "eth_chainId",
+			Params:  json.RawMessage(`[]`),
+			ID:      json.RawMessage(strconv.Itoa(i)),
+		})
+		if resp.Error != nil {
+			t.Fatalf("HandleRequest() error = %v", resp.Error)
+		}
+		if id, _ := json.Marshal(resp.ID); string(id) != fmt.Sprint(i) {
+			t.Errorf("ID = %s, want %d", id, i)
+		}
+	}
+
+	if calls.Load() != 1 {
+		t.Errorf("upstream called %d times, want 1", calls.Load())
+	}
+}
+
+func TestProxy_HandleBatchRequestPolicy(t *testing.T) {
+	var forwarded atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqs []rpc.JSONRPCRequest
+		json.NewDecoder(r.Body).Decode(&reqs)
+		forwarded.Add(int32(len(reqs)))
+		resps := make([]rpc.JSONRPCResponse, len(reqs))
+		for i, req := range reqs {
+			resps[i] = rpc.JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: req.ID}
+		}
+		json.NewEncoder(w).Encode(resps)
+	}))
+	defer server.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient(server.URL, 5*time.Second, logger)
+	proxy := New(client, logger, 100, 25000000)
+	ctx := auth.NewContext(context.Background(), &auth.Policy{Name: "dapp", AllowedNamespaces: []string{"eth"}})
+
+	resp := proxy.HandleRequest(ctx, &rpc.JSONRPCRequest{JSONRPC: "2.0", Method: "debug_traceTransaction", ID: json.RawMessage("1")})
+	if resp.Error == nil || resp.Error.Code != rpc.MethodNotFound {
+		t.Errorf("HandleRequest() error = %+v, want code %d", resp.Error, rpc.MethodNotFound)
+	}
+
+	resps := proxy.HandleBatchRequest(ctx, []*rpc.JSONRPCRequest{
+		{JSONRPC: "2.0", Method: "eth_chainId", ID: json.RawMessage("1")},
+		{JSONRPC: "2.0", Method: "admin_peers", ID: json.RawMessage("2")},
+		{JSONRPC: "2.0", Method: "eth_blockNumber", ID: json.RawMessage("3")},
+	})
+	if len(resps) != 3 {
+		t.Fatalf("len(resps) = %d, want 3", len(resps))
+	}
+	if resps[0].Error != nil || resps[2].Error != nil {
+		t.Errorf("allowed items errored: %+v, %+v", resps[0].Error, resps[2].Error)
+	}
+	if resps[1].Error == nil || resps[1].Error.Code != rpc.MethodNotFound {
+		t.Errorf("resps[1].Error = %+v, want code %d", resps[1].Error, rpc.MethodNotFound)
+	}
+	if id, _ := json.Marshal(resps[2].ID); string(id) != "3" {
+		t.Errorf("resps[2].ID = %s, want 3", id)
+	}
+	if forwarded.Load() != 2 {
+		t.Errorf("forwarded %d items, want 2", forwarded.Load())
+	}
+}
+
+func TestProxy_HandleRequestMethodFilter(t *testing.T) {
+	var forwarded atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqs []rpc.JSONRPCRequest
+		json.NewDecoder(r.Body).Decode(&reqs)
+		forwarded.Add(int32(len(reqs)))
+		resps := make([]rpc.JSONRPCResponse, len(reqs))
+		for i, req := range reqs {
+			resps[i] = rpc.JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: req.ID}
+		}
+		json.NewEncoder(w).Encode(resps)
+	}))
+	defer server.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient(server.URL, 5*time.Second, logger)
+	filter, err := NewMethodFilter(nil, []string{"admin_*"})
+	if err != nil {
+		t.Fatalf("NewMethodFilter() error = %v", err)
+	}
+	proxy := New(client, logger, 100, 25000000, WithMethodFilter(filter))
+
+	resp := proxy.HandleRequest(context.Background(), &rpc.JSONRPCRequest{JSONRPC: "2.0", Method: "admin_addPeer", ID: json.RawMessage("1")})
+	if resp.Error == nil || resp.Error.Code != rpc.MethodNotFound {
+		t.Errorf("HandleRequest() error = %+v, want code %d", resp.Error, rpc.MethodNotFound)
+	}
+
+	resps := proxy.HandleBatchRequest(context.Background(), []*rpc.JSONRPCRequest{
+		{JSONRPC: "2.0", Method: "admin_peers", ID: json.RawMessage("1")},
+		{JSONRPC: "2.0", Method: "eth_chainId", ID: json.RawMessage("2")},
+	})
+	if len(resps) != 2 {
+		t.Fatalf("len(resps) = %d, want 2", len(resps))
+	}
+	if resps[0].Error == nil || resps[0].Error.Code != rpc.MethodNotFound {
+		t.Errorf("resps[0].Error = %+v, want code %d", resps[0].Error, rpc.MethodNotFound)
+	}
+	if resps[1].Error != nil {
+		t.Errorf("resps[1].Error = %+v, want nil", resps[1].Error)
+	}
+	if forwarded.Load() != 1 {
+		t.Errorf("forwarded %d items, want 1", forwarded.Load())
+	}
+}
+
+func TestProxy_HandleBatchRequestFanout(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	// Each node answers eth_getTransactionReceipt with the hash it was
+	// asked for, in reverse order to check responses are matched by ID.
+	node := func(name string, items *atomic.Int32) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := inFlight.Add(1)
+			defer inFlight.Add(-1)
+			for {
+				m := maxInFlight.Load()
+				if n <= m || maxInFlight.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+
+			var reqs []rpc.JSONRPCRequest
+			json.NewDecoder(r.Body).Decode(&reqs)
+			items.Add(int32(len(reqs)))
+			resps := make([]rpc.JSONRPCResponse, len(reqs))
+			for i, req := range reqs {
+				var params []string
+				json.Unmarshal(req.Params, &params)
+				result, _ := json.Marshal(map[string]string{"transactionHash": params[0], "node": name})
+				resps[len(reqs)-1-i] = rpc.JSONRPCResponse{JSONRPC: "2.0", Result: result, ID: req.ID}
+			}
+			json.NewEncoder(w).Encode(resps)
+		}))
+	}
+	var itemsA, itemsB atomic.Int32
+	a := node("a", &itemsA)
+	defer a.Close()
+	b := node("b", &itemsB)
+	defer b.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewPoolClient([]rpc.Endpoint{
+		{Name: "a", URL: a.URL, Timeout: 5 * time.Second},
+		{Name: "b", URL: b.URL, Timeout: 5 * time.Second},
+	}, logger)
+	filter, _ := NewMethodFilter(nil, []string{"admin_*"})
+	proxy := New(client, logger, 100, 25000000, WithMethodFilter(filter), WithBatchFanout(3, 2))
+
+	reqs := make([]*rpc.JSONRPCRequest, 10)
+	for i := range reqs {
+		reqs[i] = &rpc.JSONRPCRequest{
+			JSONRPC: "2.0",
+			Method:  "eth_getTransactionReceipt",
+			Params:  json.RawMessage(fmt.Sprintf(`["0x%d"]`, i)),
+			ID:      json.RawMessage(strconv.Itoa(i + 1)),
+		}
+	}
+	reqs[4].Method = "admin_peers"
+
+	resps := proxy.HandleBatchRequest(context.Background(), reqs)
+	if len(resps) != len(reqs) {
+		t.Fatalf("len(resps) = %d, want %d", len(resps), len(reqs))
+	}
+	for i, resp := range resps {
+		if id, _ := json.Marshal(resp.ID); string(id) != fmt.Sprint(i+1) {
+			t.Errorf("resps[%d].ID = %s, want %d", i, id, i+1)
+		}
+		if i == 4 {
+			if resp.Error == nil || resp.Error.Code != rpc.MethodNotFound {
+				t.Errorf("resps[4].Error = %+v, want code %d", resp.Error, rpc.MethodNotFound)
+			}
+			continue
+		}
+		var receipt map[string]string
+		json.Unmarshal(resp.Result, &receipt)
+		if want := fmt.Sprintf("0x%d", i); receipt["transactionHash"] != want {
+			t.Errorf("resps[%d] transactionHash = %q, want %q", i, receipt["transactionHash"], want)
+		}
+	}
+
+	if itemsA.Load() == 0 || itemsB.Load() == 0 {
+		t.Errorf("items forwarded to a = %d, b = %d, want both upstreams used", itemsA.Load(), itemsB.Load())
+	}
+	if got := itemsA.Load() + itemsB.Load(); got != 9 {
+		t.Errorf("forwarded %d items, want 9", got)
+	}
+	if got := maxInFlight.Load(); got > 2 {
+		t.Errorf("max concurrent sub-batches = %d, want at most 2", got)
+	}
+}
+
+func TestProxy_HandleBatchRequestDuplicateIDs(t *testing.T) {
+	// The node answers with the method name, in reverse order.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqs []rpc.JSONRPCRequest
+		json.NewDecoder(r.Body).Decode(&reqs)
+		resps := make([]rpc.JSONRPCResponse, len(reqs))
+		for i, req := range reqs {
+			result, _ := json.Marshal(req.Method)
+			resps[len(reqs)-1-i] = rpc.JSONRPCResponse{JSONRPC: "2.0", Result: result, ID: req.ID}
+		}
+		json.NewEncoder(w).Encode(resps)
+	}))
+	defer server.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient(server.URL, 5*time.Second, logger)
+	proxy := New(client, logger, 100, 25000000)
+
+	reqs := []*rpc.JSONRPCRequest{
+		{JSONRPC: "2.0", Method: "eth_chainId", ID: json.RawMessage("1")},
+		{JSONRPC: "2.0", Method: "eth_blockNumber", ID: json.RawMessage("1")},
+		{JSONRPC: "2.0", Method: "eth_gasPrice", ID: json.RawMessage("null")},
+		{JSONRPC: "2.0", Method: "net_version", ID: json.RawMessage("null")},
+	}
+	resps := proxy.HandleBatchRequest(context.Background(), reqs)
+	if len(resps) != len(reqs) {
+		t.Fatalf("len(resps) = %d, want %d", len(resps), len(reqs))
+	}
+	for i, resp := range resps {
+		if want := `"` + reqs[i].Method + `"`; string(resp.Result) != want {
+			t.Errorf("resps[%d].Result = %s, want %s", i, resp.Result, want)
+		}
+		if string(resp.ID) != string(reqs[i].ID) {
+			t.Errorf("resps[%d].ID = %s, want %s", i, resp.ID, reqs[i].ID)
+		}
+	}
+}
+
+func TestProxy_HandleBatchRequestInvalidItems(t *testing.T) {
+	var forwarded atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqs []rpc.JSONRPCRequest
+		json.NewDecoder(r.Body).Decode(&reqs)
+		forwarded.Add(int32(len(reqs)))
+		resps := make([]rpc.JSONRPCResponse, len(reqs))
+		for i, req := range reqs {
+			resps[i] = rpc.JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: req.ID}
+		}
+		json.NewEncoder(w).Encode(resps)
+	}))
+	defer server.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient(server.URL, 5*time.Second, logger)
+	proxy := New(client, logger, 100, 25000000)
+
+	resps := proxy.HandleBatchRequest(context.Background(), []*rpc.JSONRPCRequest{
+		{JSONRPC: "2.0", Method: "eth_chainId", ID: json.RawMessage("1")},
+		{JSONRPC: "1.0", Method: "eth_chainId", ID: json.RawMessage("2")},
+		{JSONRPC: "2.0", ID: json.RawMessage("3")},
+		{JSONRPC: "2.0", Method: "eth_blockNumber", ID: json.RawMessage("4")},
+	})
+	if len(resps) != 4 {
+		t.Fatalf("len(resps) = %d, want 4", len(resps))
+	}
+	for _, i := range []int{0, 3} {
+		if resps[i].Error != nil {
+			t.Errorf("resps[%d].Error = %+v, want nil", i, resps[i].Error)
+		}
+	}
+	for _, i := range []int{1, 2} {
+		if resps[i].Error == nil || resps[i].Error.Code != rpc.InvalidRequest {
+			t.Errorf("resps[%d].Error = %+v, want code %d", i, resps[i].Error, rpc.InvalidRequest)
+		}
+		if id, _ := json.Marshal(resps[i].ID); string(id) != fmt.Sprint(i+1) {
+			t.Errorf("resps[%d].ID = %s, want %d", i, id, i+1)
+		}
+	}
+	if forwarded.Load() != 2 {
+		t.Errorf("forwarded %d items, want 2", forwarded.Load())
+	}
+}
+
+func TestProxy_HandleBatchRequestRetryFailed(t *testing.T) {
+	var batches, singles atomic.Int32
+	// The node fails batches of more than two items and leaves out the
+	// answer to eth_getLogs in the batches it serves.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body json.RawMessage
+		json.NewDecoder(r.Body).Decode(&body)
+		if body[0] != '[' {
+			singles.Add(1)
+			var req rpc.JSONRPCRequest
+			json.Unmarshal(body, &req)
+			json.NewEncoder(w).Encode(rpc.JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: req.ID})
+			return
+		}
+		batches.Add(1)
+		var reqs []rpc.JSONRPCRequest
+		json.Unmarshal(body, &reqs)
+		if len(reqs) > 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		var resps []rpc.JSONRPCResponse
+		for _, req := range reqs {
+			if req.Method != "eth_getLogs" {
+				resps = append(resps, rpc.JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: req.ID})
+			}
+		}
+		json.NewEncoder(w).Encode(resps)
+	}))
+	defer server.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewClient(server.URL, 5*time.Second, logger)
+
+	tests := []struct {
+		name        string
+		opts        []Option
+		methods     []string
+		wantSingles int32
+	}{
+		{name: "batch fails", methods: []string{"eth_chainId", "eth_blockNumber", "eth_gasPrice"}, wantSingles: 3},
+		{name: "item missing", methods: []string{"eth_chainId", "eth_getLogs"}, wantSingles: 1},
+		{name: "sub-batch fails", opts: []Option{WithBatchFanout(3, 2)},
+			methods: []string{"eth_chainId", "eth_blockNumber", "eth_gasPrice", "eth_getLogs", "eth_call"}, wantSingles: 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batches.Store(0)
+			singles.Store(0)
+			proxy := New(client, logger, 100, 25000000, tt.opts...)
+
+			reqs := make([]*rpc.JSONRPCRequest, len(tt.methods))
+			for i, method := range tt.methods {
+				reqs[i] = &rpc.JSONRPCRequest{JSONRPC: "2.0", Method: method, ID: json.RawMessage(strconv.Itoa(i + 1))}
+			}
+			resps := proxy.HandleBatchRequest(context.Background(), reqs)
+			for i, resp := range resps {
+				if resp.Error != nil {
+					t.Errorf("resps[%d].Error = %+v, want nil", i, resp.Error)
+				}
+				if id, _ := json.Marshal(resp.ID); string(id) != fmt.Sprint(i+1) {
+					t.Errorf("resps[%d].ID = %s, want %d", i, id, i+1)
+				}
+			}
+			if got := singles.Load(); got != tt.wantSingles {
+				t.Errorf("retried %d items individually, want %d", got, tt.wantSingles)
+			}
+		})
+	}
+}
+
+func TestProxy_HandleBatchRequestRetryLimits(t *testing.T) {
+	var singles atomic.Int32
+	// The node fails every batch but answers individual calls.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body json.RawMessage
+		json.NewDecoder(r.Body).Decode(&body)
+		if body[0] == '[' {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		singles.Add(1)
+		var req rpc.JSONRPCRequest
+		json.Unmarshal(body, &req)
+		json.NewEncoder(w).Encode(rpc.JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: req.ID})
+	}))
+	defer server.Close()
+
+	logger, _ := zap.NewDevelopment()
+	tests := []struct {
+		name        string
+		opts        []rpc.ClientOption
+		timeout     time.Duration
+		wantSingles int32
+	}{
+		{name: "capped per batch", wantSingles: maxItemRetries},
+		{name: "retry budget", opts: []rpc.ClientOption{rpc.WithRetry(rpc.RetryConfig{BudgetBurst: 3})}, wantSingles: 3},
+		{name: "deadline near", timeout: minRetryTime / 2, wantSingles: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			singles.Store(0)
+			client := rpc.NewPoolClient([]rpc.Endpoint{{URL: server.URL, Timeout: 5 * time.Second}}, logger, tt.opts...)
+			proxy := New(client, logger, 100, 25000000)
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			reqs := make([]*rpc.JSONRPCRequest, 20)
+			for i := range reqs {
+				reqs[i] = &rpc.JSONRPCRequest{JSONRPC: "2.0", Method: "eth_chainId", ID: json.RawMessage(strconv.Itoa(i + 1))}
+			}
+			resps := proxy.HandleBatchRequest(ctx, reqs)
+			failed := 0
+			for _, resp := range resps {
+				if resp.Error != nil {
+					failed++
+				}
+			}
+			if got := singles.Load(); got != tt.wantSingles {
+				t.Errorf("retried %d items individually, want %d", got, tt.wantSingles)
+			}
+			if want := len(reqs) - int(tt.wantSingles); failed != want {
+				t.Errorf("failed items = %d, want %d", failed, want)
+			}
+		})
+	}
+}
+
+func TestProxy_ResponseSizeLimits(t *testing.T) {
+	// Results are 1000 bytes of hex, except eth_getLogs which is larger
+	// than the client's maximum response size.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body json.RawMessage
+		json.NewDecoder(r.Body).Decode(&body)
+		answer := func(req rpc.JSONRPCRequest) rpc.JSONRPCResponse {
+			size := 998
+			if req.Method == "eth_getLogs" {
+				size = 5000
+			}
+			if req.Method == "eth_estimateGas" {
+				return rpc.JSONRPCResponse{JSONRPC: "2.0", Error: &rpc.JSONRPCError{Code: 3, Message: "execution reverted", Data: "0x" + strings.Repeat("f", 996)}, ID: req.ID}
+			}
+			result, _ := json.Marshal(strings.Repeat("f", size))
+			return rpc.JSONRPCResponse{JSONRPC: "2.0", Result: result, ID: req.ID}
+		}
+		if body[0] != '[' {
+			var req rpc.JSONRPCRequest
+			json.Unmarshal(body, &req)
+			json.NewEncoder(w).Encode(answer(req))
+			return
+		}
+		var reqs []rpc.JSONRPCRequest
+		json.Unmarshal(body, &reqs)
+		resps := make([]rpc.JSONRPCResponse, len(reqs))
+		for i, req := range reqs {
+			resps[i] = answer(req)
+		}
+		json.NewEncoder(w).Encode(resps)
+	}))
+	defer server.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := rpc.NewPoolClient([]rpc.Endpoint{{URL: server.URL, Timeout: 5 * time.Second}}, logger,
+		rpc.WithMaxResponseSize(4096))
+	proxy := New(client, logger, 100, 2500)
+
+	resp := proxy.HandleRequest(context.Background(), &rpc.JSONRPCRequest{JSONRPC: "2.0", Method: "eth_getLogs", ID: json.RawMessage("1")})
+	if resp.Error == nil || resp.Error.Code != rpc.ResponseTooLarge {
+		t.Errorf("HandleRequest() error = %+v, want code %d", resp.Error, rpc.ResponseTooLarge)
+	}
+
+	// After three 1000 byte answers the batch is over its 2500 byte limit,
+	// so the last two items are dropped. Errors count towards the limit.
+	reqs := make([]*rpc.JSONRPCRequest, 5)
+	for i := range reqs {
+		method := "eth_call"
+		if i < 2 {
+			method = "eth_estimateGas"
+		}
+		reqs[i] = &rpc.JSONRPCRequest{JSONRPC: "2.0", Method: method, ID: json.RawMessage(strconv.Itoa(i + 1))}
+	}
+	resps := proxy.HandleBatchRequest(context.Background(), reqs)
+	for i, resp := range resps {
+		tooLarge := resp.Error != nil && resp.Error.Code == rpc.ResponseTooLarge
+		if tooLarge != (i >= 3) {
+			t.Errorf("resps[%d].Error = %+v, want response too large: %v", i, resp.Error, i >= 3)
+		}
+		if id, _ := json.Marshal(resp.ID); string(id) != fmt.Sprint(i+1) {
+			t.Errorf("resps[%d].ID = %s, want %d", i, id, i+1)
+		}
+	}
+
+	// A batch whose upstream body is too large is retried item by item,
+	// so only the oversized item fails.
+	resps = proxy.HandleBatchRequest(context.Background(), []*rpc.JSONRPCRequest{
+		{JSONRPC: "2.0", Method: "eth_call", ID: json.RawMessage("1")},
+		{JSONRPC: "2.0", Method: "eth_getLogs", ID: json.RawMessage("2")},
+	})
+	if resps[0].Error != nil {
+		t.Errorf("resps[0].Error = %+v, want nil", resps[0].Error)
+	}
+	if resps[1].Error == nil || resps[1].Error.Code != rpc.ResponseTooLarge {
+		t.Errorf("resps[1].Error = %+v, want code %d", resps[1].Error, rpc.ResponseTooLarge)
+	}
+}
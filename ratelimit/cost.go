@@ -0,0 +1,51 @@
+package ratelimit
+
+import "strings"
+
+// CostTable maps JSON-RPC methods to the compute units they cost.
+type CostTable struct {
+	defaultCost   float64
+	batchItemCost float64
+	methods       map[string]float64
+}
+
+// NewCostTable creates a cost table. Methods missing from methods cost
+// defaultCost; every item of a batch costs batchItemCost on top of its
+// method. Method names are matched case-insensitively since config keys
+// are lowercased when loaded.
+func NewCostTable(defaultCost, batchItemCost float64, methods map[string]float64) *CostTable {
+	normalized := make(map[string]float64, len(methods))
+	for method, cost := range methods {
+		normalized[strings.ToLower(method)] = cost
+	}
+	return &CostTable{
+		defaultCost:   defaultCost,
+		batchItemCost: batchItemCost,
+		methods:       normalized,
+	}
+}
+
+// MethodCost returns the compute units of a single call to method.
+func (t *CostTable) MethodCost(method string) float64 {
+	if cost, ok := t.methods[strings.ToLower(method)]; ok {
+		return cost
+	}
+	return t.defaultCost
+}
+
+// Cost returns the compute units of a request calling methods, which is a
+// batch request if batch is set.
+func (t *CostTable) Cost(methods []string, batch bool) float64 {
+	if len(methods) == 0 {
+		return t.defaultCost
+	}
+
+	var total float64
+	for _, method := range methods {
+		total += t.MethodCost(method)
+		if batch {
+			total += t.batchItemCost
+		}
+	}
+	return total
+}
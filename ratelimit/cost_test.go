@@ -0,0 +1,31 @@
+package ratelimit
+
+import "testing"
+
+func TestCostTable(t *testing.T) {
+	table := NewCostTable(1, 2, map[string]float64{
+		"debug_traceTransaction": 100,
+		"eth_getlogs":            20,
+	})
+
+	tests := []struct {
+		name    string
+		methods []string
+		batch   bool
+		want    float64
+	}{
+		{name: "default", methods: []string{"eth_blockNumber"}, want: 1},
+		{name: "configured", methods: []string{"debug_traceTransaction"}, want: 100},
+		{name: "lowercased config key", methods: []string{"eth_getLogs"}, want: 20},
+		{name: "unparsed request", methods: nil, want: 1},
+		{name: "batch", methods: []string{"eth_blockNumber", "eth_getLogs"}, batch: true, want: 1 + 2 + 20 + 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := table.Cost(tt.methods, tt.batch); got != tt.want {
+				t.Errorf("Cost(%v, %v) = %v, want %v", tt.methods, tt.batch, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often buckets that have refilled completely are
+// dropped, so that the limiter does not grow with every client it has seen.
+const sweepInterval = time.Minute
+
+// Limiter is a set of token buckets keyed by client. Each bucket holds up
+// to burst tokens and refills at rate tokens per second. A rate of zero
+// means unlimited.
+type Limiter struct {
+	rate  float64
+	burst int
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func New(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:    rate,
+		burst:   burst,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes cost tokens from the bucket of key using the limiter's rate
+// and burst. If the bucket does not hold enough tokens, nothing is taken
+// and Allow returns false together with the time until enough tokens will
+// be available. A cost above the burst is never allowed; the time returned
+// for it is zero.
+func (l *Limiter) Allow(key string, cost float64) (bool, time.Duration) {
+	return l.AllowLimit(key, cost, l.rate, l.burst)
+}
+
+// AllowLimit is like Allow but uses the given rate and burst for the
+// bucket of key, for clients with their own limits. A burst of zero
+// defaults to the rate rounded up.
+func (l *Limiter) AllowLimit(key string, cost, rate float64, burst int) (bool, time.Duration) {
+	if rate <= 0 {
+		return true, 0
+	}
+	capacity := float64(burst)
+	if burst < 1 {
+		capacity = math.Ceil(rate)
+	}
+	if cost > capacity {
+		return false, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok || b.rate != rate || b.burst != capacity {
+		b = &bucket{rate: rate, burst: capacity, tokens: capacity, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens >= cost {
+		b.tokens -= cost
+		return true, 0
+	}
+
+	missing := cost - b.tokens
+	return false, time.Duration(missing / b.rate * float64(time.Second))
+}
+
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestLimiter(rate float64, burst int) (*Limiter, *time.Time) {
+	l := New(rate, burst)
+	now := time.Unix(0, 0)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestLimiter_Allow(t *testing.T) {
+	l, now := newTestLimiter(2, 4)
+
+	for i := 0; i < 4; i++ {
+		if ok, _ := l.Allow("a", 1); !ok {
+			t.Fatalf("request %d within burst was limited", i)
+		}
+	}
+
+	ok, retryAfter := l.Allow("a", 1)
+	if ok {
+		t.Fatal("request beyond burst was allowed")
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Errorf("retryAfter = %v, want 500ms", retryAfter)
+	}
+
+	if ok, _ := l.Allow("b", 1); !ok {
+		t.Error("other key was limited")
+	}
+
+	*now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.Allow("a", 1); !ok {
+		t.Error("request after refill was limited")
+	}
+}
+
+func TestLimiter_CostAboveBurst(t *testing.T) {
+	l, _ := newTestLimiter(1, 2)
+
+	l.Allow("a", 1)
+	ok, retryAfter := l.Allow("a", 5)
+	if ok {
+		t.Fatal("cost above burst was allowed")
+	}
+	if retryAfter != 0 {
+		t.Errorf("retryAfter = %v for a cost that never fits, want 0", retryAfter)
+	}
+}
+
+func TestLimiter_Sweep(t *testing.T) {
+	l, now := newTestLimiter(10, 10)
+
+	l.Allow("a", 1)
+	*now = now.Add(2 * sweepInterval)
+	l.Allow("b", 1)
+
+	if _, ok := l.buckets["a"]; ok {
+		t.Error("idle bucket was not swept")
+	}
+	if _, ok := l.buckets["b"]; !ok {
+		t.Error("active bucket was swept")
+	}
+}
+
+func TestLimiter_AllowLimit(t *testing.T) {
+	l, _ := newTestLimiter(1, 1)
+
+	for i := 0; i < 5; i++ {
+		if ok, _ := l.AllowLimit("vip", 1, 10, 5); !ok {
+			t.Fatalf("request %d within the key's own burst was limited", i)
+		}
+	}
+	if ok, _ := l.AllowLimit("vip", 1, 10, 5); ok {
+		t.Error("request beyond the key's own burst was allowed")
+	}
+
+	if ok, _ := l.AllowLimit("free", 100, 0, 0); !ok {
+		t.Error("request without a rate limit was limited")
+	}
+}
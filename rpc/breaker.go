@@ -0,0 +1,215 @@
+package rpc
+
+import (
+	"sync"
+	"time"
+)
+
+// CircuitState is the state of an upstream's circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets every request through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen fails requests without sending them.
+	CircuitOpen
+	// CircuitHalfOpen lets a few probe requests through to find out
+	// whether the upstream has recovered.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreakerConfig configures the circuit breaker of every upstream.
+// The circuit opens after ConsecutiveFailures failures in a row, or once
+// the share of failures among the last Window requests reaches ErrorRate.
+// A zero ConsecutiveFailures or ErrorRate disables that trigger. After
+// Cooldown, Probes requests are let through and the circuit closes again
+// once all of them succeed.
+type CircuitBreakerConfig struct {
+	ConsecutiveFailures int
+	ErrorRate           float64
+	Window              int
+	Cooldown            time.Duration
+	Probes              int
+}
+
+// breaker is a circuit breaker. A nil *breaker lets every request through.
+type breaker struct {
+	cfg      CircuitBreakerConfig
+	onChange func(from, to CircuitState)
+	now      func() time.Time
+
+	mu       sync.Mutex
+	state    CircuitState
+	openedAt time.Time
+	failures int // consecutive failures
+	// generation counts state changes. Outcomes of requests let through
+	// in an earlier generation are ignored.
+	generation uint64
+
+	// outcomes holds whether each of the last Window requests failed.
+	outcomes       []bool
+	next           int
+	windowFailures int
+
+	inFlight  int // probes sent while half-open
+	successes int // probes that succeeded
+}
+
+func newBreaker(cfg CircuitBreakerConfig, onChange func(from, to CircuitState)) *breaker {
+	if cfg.Probes <= 0 {
+		cfg.Probes = 1
+	}
+	b := &breaker{cfg: cfg, onChange: onChange, now: time.Now}
+	if cfg.ErrorRate > 0 && cfg.Window > 0 {
+		b.outcomes = make([]bool, 0, cfg.Window)
+	}
+	return b
+}
+
+func (b *breaker) current() CircuitState {
+	if b == nil {
+		return CircuitClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// allow reports whether a request may be sent, and the generation it is
+// let through in. Every allowed request must be followed by record or
+// cancel with that generation.
+func (b *breaker) allow() (uint64, bool) {
+	if b == nil {
+		return 0, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		if b.now().Sub(b.openedAt) < b.cfg.Cooldown {
+			return 0, false
+		}
+		b.setState(CircuitHalfOpen)
+		b.inFlight, b.successes = 0, 0
+		fallthrough
+	case CircuitHalfOpen:
+		if b.inFlight+b.successes >= b.cfg.Probes {
+			return 0, false
+		}
+		b.inFlight++
+		return b.generation, true
+	default:
+		return b.generation, true
+	}
+}
+
+// record reports the outcome of a request allowed in generation gen.
+// Requests let through before the last state change are ignored, so that
+// requests sent while the circuit was closed do not count as probes.
+func (b *breaker) record(gen uint64, failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if gen != b.generation {
+		return
+	}
+
+	switch b.state {
+	case CircuitHalfOpen:
+		b.inFlight--
+		if failed {
+			b.open()
+			return
+		}
+		b.successes++
+		if b.successes >= b.cfg.Probes {
+			b.reset()
+			b.setState(CircuitClosed)
+		}
+
+	case CircuitClosed:
+		if failed {
+			b.failures++
+		} else {
+			b.failures = 0
+		}
+		if b.observe(failed) || b.cfg.ConsecutiveFailures > 0 && b.failures >= b.cfg.ConsecutiveFailures {
+			b.open()
+		}
+	}
+}
+
+// cancel releases a request allowed in generation gen that ended without
+// telling anything about the upstream, such as one abandoned by the caller.
+func (b *breaker) cancel(gen uint64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if gen == b.generation && b.state == CircuitHalfOpen {
+		b.inFlight--
+	}
+}
+
+// observe adds an outcome to the window and reports whether the error rate
+// over a full window reached the threshold.
+func (b *breaker) observe(failed bool) bool {
+	if b.outcomes == nil {
+		return false
+	}
+	if len(b.outcomes) < b.cfg.Window {
+		b.outcomes = append(b.outcomes, failed)
+	} else {
+		if b.outcomes[b.next] {
+			b.windowFailures--
+		}
+		b.outcomes[b.next] = failed
+		b.next = (b.next + 1) % b.cfg.Window
+	}
+	if failed {
+		b.windowFailures++
+	}
+	return len(b.outcomes) == b.cfg.Window &&
+		float64(b.windowFailures)/float64(b.cfg.Window) >= b.cfg.ErrorRate
+}
+
+func (b *breaker) open() {
+	b.reset()
+	b.openedAt = b.now()
+	b.setState(CircuitOpen)
+}
+
+func (b *breaker) reset() {
+	b.failures = 0
+	if b.outcomes != nil {
+		b.outcomes = b.outcomes[:0]
+	}
+	b.next, b.windowFailures = 0, 0
+}
+
+func (b *breaker) setState(state CircuitState) {
+	if state == b.state {
+		return
+	}
+	from := b.state
+	b.state = state
+	b.generation++
+	if b.onChange != nil {
+		b.onChange(from, state)
+	}
+}
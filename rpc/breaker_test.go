@@ -0,0 +1,169 @@
+package rpc
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestBreaker(cfg CircuitBreakerConfig) (*breaker, *time.Time, *[]CircuitState) {
+	now := time.Unix(0, 0)
+	var changes []CircuitState
+	b := newBreaker(cfg, func(from, to CircuitState) {
+		changes = append(changes, to)
+	})
+	b.now = func() time.Time { return now }
+	return b, &now, &changes
+}
+
+// send lets a request through b and records its outcome.
+func send(b *breaker, failed bool) {
+	gen, _ := b.allow()
+	b.record(gen, failed)
+}
+
+func TestBreaker_ConsecutiveFailures(t *testing.T) {
+	b, now, changes := newTestBreaker(CircuitBreakerConfig{ConsecutiveFailures: 3, Cooldown: time.Second})
+
+	for i := 0; i < 2; i++ {
+		send(b, true)
+	}
+	send(b, false)
+	for i := 0; i < 2; i++ {
+		send(b, true)
+	}
+	if got := b.current(); got != CircuitClosed {
+		t.Fatalf("state after interrupted failures = %s, want closed", got)
+	}
+
+	send(b, true)
+	if got := b.current(); got != CircuitOpen {
+		t.Fatalf("state after 3 failures = %s, want open", got)
+	}
+	if _, ok := b.allow(); ok {
+		t.Error("allow() = true while open")
+	}
+
+	*now = now.Add(time.Second)
+	gen, ok := b.allow()
+	if !ok {
+		t.Fatal("allow() = false after cooldown, want probe")
+	}
+	if _, ok := b.allow(); ok {
+		t.Error("allow() = true for a second probe, want 1 probe")
+	}
+	b.record(gen, false)
+	if got := b.current(); got != CircuitClosed {
+		t.Errorf("state after successful probe = %s, want closed", got)
+	}
+
+	want := []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitClosed}
+	if len(*changes) != len(want) {
+		t.Fatalf("state changes = %v, want %v", *changes, want)
+	}
+	for i := range want {
+		if (*changes)[i] != want[i] {
+			t.Errorf("state changes = %v, want %v", *changes, want)
+			break
+		}
+	}
+}
+
+func TestBreaker_ErrorRate(t *testing.T) {
+	b, _, _ := newTestBreaker(CircuitBreakerConfig{ErrorRate: 0.5, Window: 4, Cooldown: time.Second})
+
+	for _, failed := range []bool{true, false, true} {
+		send(b, failed)
+	}
+	if got := b.current(); got != CircuitClosed {
+		t.Fatalf("state before the window is full = %s, want closed", got)
+	}
+	send(b, false)
+	if got := b.current(); got != CircuitOpen {
+		t.Errorf("state at 50%% errors = %s, want open", got)
+	}
+}
+
+func TestBreaker_HalfOpenFailure(t *testing.T) {
+	b, now, _ := newTestBreaker(CircuitBreakerConfig{ConsecutiveFailures: 1, Cooldown: time.Second, Probes: 2})
+
+	send(b, true)
+	*now = now.Add(time.Second)
+
+	first, ok1 := b.allow()
+	second, ok2 := b.allow()
+	if !ok1 || !ok2 {
+		t.Fatal("allow() = false for probes after cooldown")
+	}
+	if _, ok := b.allow(); ok {
+		t.Error("allow() = true beyond 2 probes")
+	}
+	b.record(first, false)
+	if got := b.current(); got != CircuitHalfOpen {
+		t.Fatalf("state after 1 of 2 probes = %s, want half-open", got)
+	}
+	b.record(second, true)
+	if got := b.current(); got != CircuitOpen {
+		t.Errorf("state after failed probe = %s, want open", got)
+	}
+	if _, ok := b.allow(); ok {
+		t.Error("allow() = true right after reopening")
+	}
+}
+
+func TestBreaker_CancelReleasesProbe(t *testing.T) {
+	b, now, _ := newTestBreaker(CircuitBreakerConfig{ConsecutiveFailures: 1, Cooldown: time.Second})
+
+	send(b, true)
+	*now = now.Add(time.Second)
+
+	gen, _ := b.allow()
+	b.cancel(gen)
+	if _, ok := b.allow(); !ok {
+		t.Error("allow() = false after the probe was cancelled")
+	}
+}
+
+func TestBreaker_StaleOutcomes(t *testing.T) {
+	b, now, _ := newTestBreaker(CircuitBreakerConfig{ConsecutiveFailures: 1, Cooldown: time.Second})
+
+	// A request let through while closed is still in flight when the
+	// circuit opens and goes half-open.
+	stale, _ := b.allow()
+	send(b, true)
+	*now = now.Add(time.Second)
+	probe, ok := b.allow()
+	if !ok {
+		t.Fatal("allow() = false after cooldown, want probe")
+	}
+
+	b.record(stale, false)
+	b.cancel(stale)
+	if got := b.current(); got != CircuitHalfOpen {
+		t.Fatalf("state after a stale outcome = %s, want half-open", got)
+	}
+	if _, ok := b.allow(); ok {
+		t.Error("allow() = true while the probe is in flight")
+	}
+
+	b.record(probe, false)
+	if got := b.current(); got != CircuitClosed {
+		t.Errorf("state after successful probe = %s, want closed", got)
+	}
+	b.record(stale, true)
+	if got := b.current(); got != CircuitClosed {
+		t.Errorf("state after a stale failure = %s, want closed", got)
+	}
+}
+
+func TestBreaker_Nil(t *testing.T) {
+	var b *breaker
+	gen, ok := b.allow()
+	if !ok {
+		t.Error("allow() = false for nil breaker")
+	}
+	b.record(gen, true)
+	b.cancel(gen)
+	if got := b.current(); got != CircuitClosed {
+		t.Errorf("current() = %s, want closed", got)
+	}
+}
@@ -4,32 +4,352 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"time"
 
+	"github.com/devlongs/geth-relay/metrics"
+	"github.com/devlongs/geth-relay/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
+var tracer = otel.Tracer("github.com/devlongs/geth-relay/rpc")
+
 type Client struct {
-	url        string
-	httpClient *http.Client
-	logger     *zap.Logger
+	upstreams []*Upstream
+	balancer  *balancer
+	logger    *zap.Logger
+	metrics   *metrics.Metrics
+
+	maxResponseSize int64
+	circuitBreaker  *CircuitBreakerConfig
+	retry           *RetryConfig
+	retryBudget     *budget
+	hedge           *HedgeConfig
+	hedgeBudget     *budget
+	latencies       *latencies
+}
+
+// ClientOption configures optional Client features.
+type ClientOption func(*Client)
+
+// WithMetrics records the latency and failures of upstream requests in m.
+func WithMetrics(m *metrics.Metrics) ClientOption {
+	return func(c *Client) {
+		c.metrics = m
+	}
 }
 
 func NewClient(url string, timeout time.Duration, logger *zap.Logger) *Client {
-	return &Client{
-		url: url,
-		httpClient: &http.Client{
-			Timeout: timeout,
-		},
-		logger: logger,
+	return NewPoolClient([]Endpoint{{URL: url, Timeout: timeout}}, logger)
+}
+
+// WithMaxResponseSize fails requests whose upstream response body is larger
+// than size bytes with ErrResponseTooLarge, without reading the rest of it.
+func WithMaxResponseSize(size int64) ClientOption {
+	return func(c *Client) {
+		c.maxResponseSize = size
+	}
+}
+
+// WithCircuitBreaker puts a circuit breaker configured by cfg in front of
+// every upstream, so requests skip an upstream that keeps failing instead
+// of waiting for it to time out.
+func WithCircuitBreaker(cfg CircuitBreakerConfig) ClientOption {
+	return func(c *Client) {
+		c.circuitBreaker = &cfg
+	}
+}
+
+// WithRetry sends requests that failed on every upstream through the pool
+// again, as configured by cfg. Only failures another attempt may not run
+// into are retried, and never in a way that repeats a state change.
+func WithRetry(cfg RetryConfig) ClientOption {
+	return func(c *Client) {
+		c.retry = &cfg
+	}
+}
+
+// WithHedging sends the reads configured by cfg to a second upstream too
+// when the first one is slower than usual, and takes whichever answers
+// first.
+func WithHedging(cfg HedgeConfig) ClientOption {
+	return func(c *Client) {
+		c.hedge = &cfg
+	}
+}
+
+// NewPoolClient creates a client that spreads requests over several
+// upstreams by weight and fails over to the next one when an upstream
+// cannot be reached or answers with a 5xx status.
+func NewPoolClient(endpoints []Endpoint, logger *zap.Logger, opts ...ClientOption) *Client {
+	upstreams := make([]*Upstream, len(endpoints))
+	for i, e := range endpoints {
+		upstreams[i] = newUpstream(e)
+	}
+
+	c := &Client{
+		upstreams: upstreams,
+		balancer:  newBalancer(upstreams),
+		logger:    logger,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.retry != nil {
+		c.retryBudget = newBudget(c.retry.BudgetRatio, c.retry.BudgetBurst)
+	}
+	if c.hedge != nil {
+		c.hedgeBudget = newBudget(c.hedge.MaxRate, hedgeBurst)
+		c.latencies = newLatencies()
+	}
+	if c.circuitBreaker != nil {
+		for _, u := range upstreams {
+			u.breaker = newBreaker(*c.circuitBreaker, c.logCircuit(u))
+		}
+	}
+	return c
+}
+
+func (c *Client) logCircuit(u *Upstream) func(from, to CircuitState) {
+	return func(from, to CircuitState) {
+		fields := []zap.Field{
+			zap.String("upstream", u.name),
+			zap.Stringer("from", from),
+			zap.Stringer("to", to),
+		}
+		if to == CircuitOpen {
+			c.logger.Warn("upstream circuit opened", fields...)
+		} else {
+			c.logger.Info("upstream circuit state changed", fields...)
+		}
+	}
+}
+
+// Upstreams returns the upstreams in the pool in configuration order.
+func (c *Client) Upstreams() []*Upstream {
+	return c.upstreams
+}
+
+// StatusError is returned when an upstream answers with a non-200 status.
+// Response holds the JSON-RPC error to return to the caller if no other
+// upstream can serve the request: the error in the response body if there
+// is one, or otherwise an error matching the status.
+type StatusError struct {
+	Upstream   string
+	StatusCode int
+	Response   *JSONRPCResponse
+
+	// fromBody is set when Response was sent by the upstream.
+	fromBody bool
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("upstream %s returned status %d", e.Upstream, e.StatusCode)
+}
+
+// shouldFailover reports whether a failed attempt may be retried on another
+// upstream: transport errors and 5xx responses are, anything else is an
+// answer from the node and is returned as is. It also decides which
+// failures count against an upstream's circuit breaker.
+func shouldFailover(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	// Other upstreams would return the same oversized response.
+	if errors.Is(err, ErrResponseTooLarge) {
+		return false
+	}
+	// A JSON-RPC error in the body is the node's answer, such as a revert
+	// reason, unless the status says the node or the gateway in front of
+	// it is down, as hosted nodes do on 502, 503 and 504.
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		if statusErr.fromBody {
+			return gatewayFailure(statusErr.StatusCode)
+		}
+		return statusErr.StatusCode >= 500
+	}
+	return true
+}
+
+func gatewayFailure(status int) bool {
+	return status == http.StatusBadGateway ||
+		status == http.StatusServiceUnavailable ||
+		status == http.StatusGatewayTimeout
+}
+
+// newStatusError returns the StatusError for a non-200 answer with body
+// from upstream to the request with id.
+func newStatusError(upstream string, status int, body []byte, id json.RawMessage) *StatusError {
+	var resp JSONRPCResponse
+	if err := json.Unmarshal(body, &resp); err == nil && resp.Error != nil {
+		return &StatusError{
+			Upstream:   upstream,
+			StatusCode: status,
+			Response:   &JSONRPCResponse{JSONRPC: "2.0", Error: resp.Error, ID: id},
+			fromBody:   true,
+		}
+	}
+	return &StatusError{
+		Upstream:   upstream,
+		StatusCode: status,
+		Response:   &JSONRPCResponse{JSONRPC: "2.0", Error: statusError(status), ID: id},
+	}
+}
+
+// statusError maps an HTTP status without a JSON-RPC error body to a
+// JSON-RPC error.
+func statusError(status int) *JSONRPCError {
+	switch status {
+	case http.StatusTooManyRequests:
+		return ErrUpstreamRateLimited
+	case http.StatusServiceUnavailable:
+		return ErrUpstreamUnavailable
+	case http.StatusRequestEntityTooLarge:
+		return ErrRequestTooLarge
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return ErrUpstreamTimeout
+	default:
+		return ErrUpstreamError
+	}
+}
+
+var errNoUpstreams = errors.New("no upstreams configured")
+
+// skipOpen returns the error of a request after an upstream was skipped
+// because its circuit is open. Requests that every upstream skipped fail
+// right away with ErrUpstreamUnavailable.
+func skipOpen(err error) error {
+	if err == errNoUpstreams {
+		return ErrUpstreamUnavailable
+	}
+	return err
+}
+
+// recordCircuit reports the outcome of a request u's circuit breaker let
+// through in generation gen. Only failures another upstream might not have
+// count against it; requests abandoned by the caller do not count at all.
+func recordCircuit(ctx context.Context, u *Upstream, gen uint64, err error) {
+	if ctx.Err() != nil {
+		u.breaker.cancel(gen)
+		return
 	}
+	u.breaker.record(gen, shouldFailover(ctx, err))
 }
 
+// Forward sends a request to the pool. A failed attempt moves on to the
+// next upstream, and with WithRetry through the pool again, as far as the
+// method allows sending it again.
 func (c *Client) Forward(ctx context.Context, req *JSONRPCRequest) (*JSONRPCResponse, error) {
-	return c.forwardSingle(ctx, req)
+	policy := methodPolicy(req.Method)
+	c.retryBudget.deposit()
+
+	err := errNoUpstreams
+	// resent is set once an attempt may have reached an upstream, so later
+	// attempts may find the request already known.
+	resent := false
+	// hedged is the upstream the first attempt was hedged to, if any.
+	var hedged *Upstream
+	first := true
+attempts:
+	for n := 0; ; n++ {
+		if n > 0 && !c.retryAgain(ctx, n, err) {
+			break
+		}
+		order := c.balancer.order()
+		for i, u := range order {
+			if n == 0 && u == hedged {
+				continue
+			}
+			gen, ok := u.breaker.allow()
+			if !ok {
+				err = skipOpen(err)
+				continue
+			}
+			var resp *JSONRPCResponse
+			if delay, backup, ok := c.hedgeFor(first, req.Method, u, order[i+1:]); ok {
+				var sent bool
+				resp, sent, err = c.forwardHedged(ctx, u, gen, backup, req, delay)
+				if sent {
+					hedged = backup
+				}
+			} else {
+				resp, err = c.forwardSingle(ctx, u, req)
+				recordCircuit(ctx, u, gen, err)
+			}
+			first = false
+			if err == nil {
+				if resent {
+					resp = ResolveResent(req, resp)
+				}
+				return resp, nil
+			}
+			if !policy.retryable(ctx, err) {
+				break attempts
+			}
+			resent = resent || !notSent(err)
+			c.logger.Warn("upstream failed, trying next",
+				zap.String("upstream", u.name),
+				zap.String("method", req.Method),
+				zap.Error(err))
+		}
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		if resent {
+			return ResolveResent(req, statusErr.Response), nil
+		}
+		return statusErr.Response, nil
+	}
+	return nil, err
+}
+
+// TakeRetry reports whether a request that failed may be sent once more as
+// a new request, such as a failed batch item on its own. With WithRetry,
+// the retry is taken from the retry budget.
+func (c *Client) TakeRetry() bool {
+	if c.retry == nil {
+		return true
+	}
+	return c.retryBudget.withdraw()
+}
+
+// retryAgain reports whether a request that failed with err on every
+// upstream may go through the pool for the n-th time, after waiting for
+// its backoff.
+func (c *Client) retryAgain(ctx context.Context, n int, err error) bool {
+	if c.retry == nil || n > c.retry.MaxRetries {
+		return false
+	}
+	// Nothing was sent, because there are no upstreams or all are open.
+	if err == errNoUpstreams || err == ErrUpstreamUnavailable {
+		return false
+	}
+	if !c.retryBudget.withdraw() {
+		c.logger.Warn("retry budget exhausted", zap.Error(err))
+		return false
+	}
+	d := backoff(c.retry, n)
+	c.logger.Warn("retrying request", zap.Int("retry", n), zap.Duration("backoff", d), zap.Error(err))
+	return wait(ctx, d)
+}
+
+// ForwardTo sends a request to the given upstream only, without failover.
+func (c *Client) ForwardTo(ctx context.Context, u *Upstream, req *JSONRPCRequest) (*JSONRPCResponse, error) {
+	resp, err := c.forwardSingle(ctx, u, req)
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Response, nil
+	}
+	return resp, err
 }
 
 func (c *Client) ForwardBatch(ctx context.Context, reqs []*JSONRPCRequest) ([]*JSONRPCResponse, error) {
@@ -39,54 +359,154 @@ func (c *Client) ForwardBatch(ctx context.Context, reqs []*JSONRPCRequest) ([]*J
 		return nil, fmt.Errorf("failed to marshal batch request: %w", err)
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(reqBody))
+	policy := batchPolicy(reqs)
+	c.retryBudget.deposit()
+
+	err = errNoUpstreams
+	resent := false
+attempts:
+	for n := 0; ; n++ {
+		if n > 0 && !c.retryAgain(ctx, n, err) {
+			break
+		}
+		for _, u := range c.balancer.order() {
+			gen, ok := u.breaker.allow()
+			if !ok {
+				err = skipOpen(err)
+				continue
+			}
+			var resps []*JSONRPCResponse
+			resps, err = c.forwardBatch(ctx, u, reqBody, len(reqs))
+			recordCircuit(ctx, u, gen, err)
+			if err == nil {
+				if resent {
+					resolveResentBatch(reqs, resps)
+				}
+				return resps, nil
+			}
+			if !policy.retryable(ctx, err) {
+				break attempts
+			}
+			resent = resent || !notSent(err)
+			c.logger.Warn("upstream failed batch request, trying next",
+				zap.String("upstream", u.name),
+				zap.Int("batch_size", len(reqs)),
+				zap.Error(err))
+		}
+	}
+	return batchStatusResponses(reqs, err)
+}
+
+// resolveResentBatch applies ResolveResent to the responses of a batch
+// that may have reached an upstream before.
+func resolveResentBatch(reqs []*JSONRPCRequest, resps []*JSONRPCResponse) {
+	byID := make(map[string]*JSONRPCRequest, len(reqs))
+	for _, req := range reqs {
+		byID[string(req.ID)] = req
+	}
+	for i, resp := range resps {
+		if resp == nil {
+			continue
+		}
+		if req, ok := byID[string(resp.ID)]; ok {
+			resps[i] = ResolveResent(req, resp)
+		}
+	}
+}
+
+// batchStatusResponses answers every request of a batch that failed with a
+// StatusError with its JSON-RPC error. Other errors, and statuses without a
+// more specific error than ErrUpstreamError, are returned as is, so the
+// caller may retry the requests on their own.
+func batchStatusResponses(reqs []*JSONRPCRequest, err error) ([]*JSONRPCResponse, error) {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.Response.Error == ErrUpstreamError {
+		return nil, err
+	}
+	resps := make([]*JSONRPCResponse, len(reqs))
+	for i, req := range reqs {
+		resps[i] = &JSONRPCResponse{JSONRPC: "2.0", Error: statusErr.Response.Error, ID: req.ID}
+	}
+	return resps, nil
+}
+
+func (c *Client) forwardBatch(ctx context.Context, u *Upstream, reqBody []byte, size int) (_ []*JSONRPCResponse, err error) {
+	ctx, span := tracer.Start(ctx, "Client.forwardBatch", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(tracing.BatchSizeKey.Int(size), tracing.UpstreamKey.String(u.name)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", u.url, bytes.NewReader(reqBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create batch request: %w", err)
 	}
 
 	httpReq.Header.Set("Content-Type", "application/json")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(httpReq.Header))
 
 	start := time.Now()
-	httpResp, err := c.httpClient.Do(httpReq)
+	httpResp, err := u.httpClient.Do(httpReq)
 	duration := time.Since(start)
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			// Abandoned by the caller.
+			return
+		}
+		u.record(duration, err != nil)
+		c.metrics.ObserveUpstream(u.name, metrics.BatchMethod, duration, err != nil)
+	}()
 
 	if err != nil {
 		c.logger.Error("upstream batch request failed",
 			zap.Error(err),
-			zap.Int("batch_size", len(reqs)),
+			zap.String("upstream", u.name),
+			zap.Int("batch_size", size),
 			zap.Duration("duration", duration))
 		return nil, fmt.Errorf("upstream batch request failed: %w", err)
 	}
 	defer httpResp.Body.Close()
 
-	respBody, err := io.ReadAll(httpResp.Body)
+	respBody, err := c.readBody(httpResp.Body)
 	if err != nil {
-		c.logger.Error("failed to read batch response", zap.Error(err))
+		c.logger.Error("failed to read batch response", zap.Error(err), zap.String("upstream", u.name))
 		return nil, fmt.Errorf("failed to read batch response: %w", err)
 	}
 
 	if httpResp.StatusCode != http.StatusOK {
 		c.logger.Warn("upstream returned non-200 status for batch",
 			zap.Int("status", httpResp.StatusCode),
-			zap.Int("batch_size", len(reqs)))
-		return nil, fmt.Errorf("upstream returned status %d", httpResp.StatusCode)
+			zap.String("upstream", u.name),
+			zap.Int("batch_size", size),
+			zap.String("body", string(respBody)))
+		return nil, newStatusError(u.name, httpResp.StatusCode, respBody, nil)
 	}
 
 	var rpcResps []*JSONRPCResponse
 	if err := json.Unmarshal(respBody, &rpcResps); err != nil {
-		c.logger.Error("failed to unmarshal batch response", zap.Error(err))
+		c.logger.Error("failed to unmarshal batch response", zap.Error(err), zap.String("upstream", u.name))
 		return nil, fmt.Errorf("failed to unmarshal batch response: %w", err)
 	}
 
 	c.logger.Debug("batch request forwarded successfully",
-		zap.Int("batch_size", len(reqs)),
+		zap.String("upstream", u.name),
+		zap.Int("batch_size", size),
 		zap.Duration("duration", duration),
 		zap.Int("status", httpResp.StatusCode))
 
 	return rpcResps, nil
 }
 
-func (c *Client) forwardSingle(ctx context.Context, req *JSONRPCRequest) (*JSONRPCResponse, error) {
+func (c *Client) forwardSingle(ctx context.Context, u *Upstream, req *JSONRPCRequest) (resp *JSONRPCResponse, err error) {
+	ctx, span := tracer.Start(ctx, "Client.forwardSingle", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(tracing.MethodKey.String(req.Method), tracing.UpstreamKey.String(u.name)))
+	defer func() {
+		if resp != nil && resp.Error != nil {
+			tracing.SetErrorCode(span, resp.Error.Code, resp.Error.Message)
+		}
+		endSpan(span, err)
+	}()
+
 	reqBody, err := json.Marshal(req)
 	if err != nil {
 		c.logger.Error("failed to marshal request",
@@ -95,30 +515,44 @@ func (c *Client) forwardSingle(ctx context.Context, req *JSONRPCRequest) (*JSONR
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
 
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(reqBody))
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", u.url, bytes.NewReader(reqBody))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	httpReq.Header.Set("Content-Type", "application/json")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(httpReq.Header))
 
 	start := time.Now()
-	httpResp, err := c.httpClient.Do(httpReq)
+	httpResp, err := u.httpClient.Do(httpReq)
 	duration := time.Since(start)
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			// Abandoned by the caller or by a hedge that answered first.
+			return
+		}
+		u.record(duration, err != nil)
+		c.metrics.ObserveUpstream(u.name, req.Method, duration, err != nil)
+		if err == nil && c.hedges(req.Method) {
+			c.latencies.observe(req.Method, duration)
+		}
+	}()
 
 	if err != nil {
 		c.logger.Error("upstream request failed",
 			zap.Error(err),
+			zap.String("upstream", u.name),
 			zap.String("method", req.Method),
 			zap.Duration("duration", duration))
 		return nil, fmt.Errorf("upstream request failed: %w", err)
 	}
 	defer httpResp.Body.Close()
 
-	respBody, err := io.ReadAll(httpResp.Body)
+	respBody, err := c.readBody(httpResp.Body)
 	if err != nil {
 		c.logger.Error("failed to read response",
 			zap.Error(err),
+			zap.String("upstream", u.name),
 			zap.String("method", req.Method))
 		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
@@ -126,29 +560,55 @@ func (c *Client) forwardSingle(ctx context.Context, req *JSONRPCRequest) (*JSONR
 	if httpResp.StatusCode != http.StatusOK {
 		c.logger.Warn("upstream returned non-200 status",
 			zap.Int("status", httpResp.StatusCode),
+			zap.String("upstream", u.name),
 			zap.String("method", req.Method),
 			zap.String("body", string(respBody)))
-
-		errMsg := "upstream error"
-		if httpResp.StatusCode == http.StatusRequestTimeout || httpResp.StatusCode == http.StatusGatewayTimeout {
-			errMsg = "upstream timeout"
-		}
-		return NewErrorResponse(req.ID, ServerError, errMsg), nil
+		return nil, newStatusError(u.name, httpResp.StatusCode, respBody, req.ID)
 	}
 
 	var rpcResp JSONRPCResponse
 	if err := json.Unmarshal(respBody, &rpcResp); err != nil {
 		c.logger.Error("failed to unmarshal response",
 			zap.Error(err),
+			zap.String("upstream", u.name),
 			zap.String("method", req.Method),
 			zap.String("body", string(respBody)))
 		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
 	}
 
 	c.logger.Debug("request forwarded successfully",
+		zap.String("upstream", u.name),
 		zap.String("method", req.Method),
 		zap.Duration("duration", duration),
 		zap.Int("status", httpResp.StatusCode))
 
 	return &rpcResp, nil
 }
+
+// readBody reads an upstream response body of up to maxResponseSize bytes.
+func (c *Client) readBody(body io.Reader) ([]byte, error) {
+	if c.maxResponseSize <= 0 {
+		return io.ReadAll(body)
+	}
+	b, err := io.ReadAll(io.LimitReader(body, c.maxResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > c.maxResponseSize {
+		return nil, ErrResponseTooLarge
+	}
+	return b, nil
+}
+
+// endSpan records why an upstream request failed, if it did, and ends span.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			span.SetAttributes(tracing.StatusCodeKey.Int(statusErr.StatusCode))
+		}
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -3,8 +3,13 @@ package rpc
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -18,8 +23,11 @@ func TestNewClient(t *testing.T) {
 	if client == nil {
 		t.Fatal("NewClient() returned nil")
 	}
-	if client.url != "http://localhost:8546" {
-		t.Errorf("url = %v, want http://localhost:8546", client.url)
+	if len(client.upstreams) != 1 {
+		t.Fatalf("len(upstreams) = %d, want 1", len(client.upstreams))
+	}
+	if client.upstreams[0].url != "http://localhost:8546" {
+		t.Errorf("url = %v, want http://localhost:8546", client.upstreams[0].url)
 	}
 }
 
@@ -28,7 +36,7 @@ func TestClient_Forward(t *testing.T) {
 		resp := JSONRPCResponse{
 			JSONRPC: "2.0",
 			Result:  json.RawMessage(`"0x123"`),
-			ID:      1,
+			ID:      json.RawMessage("1"),
 		}
 		json.NewEncoder(w).Encode(resp)
 	}))
@@ -41,7 +49,7 @@ func TestClient_Forward(t *testing.T) {
 		JSONRPC: "2.0",
 		Method:  "eth_blockNumber",
 		Params:  json.RawMessage(`[]`),
-		ID:      1,
+		ID:      json.RawMessage("1"),
 	}
 
 	resp, err := client.Forward(context.Background(), req)
@@ -60,8 +68,8 @@ func TestClient_Forward(t *testing.T) {
 func TestClient_ForwardBatch(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		resp := []*JSONRPCResponse{
-			{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: 1},
-			{JSONRPC: "2.0", Result: json.RawMessage(`"0x2"`), ID: 2},
+			{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: json.RawMessage("1")},
+			{JSONRPC: "2.0", Result: json.RawMessage(`"0x2"`), ID: json.RawMessage("2")},
 		}
 		json.NewEncoder(w).Encode(resp)
 	}))
@@ -71,8 +79,8 @@ func TestClient_ForwardBatch(t *testing.T) {
 	client := NewClient(server.URL, 5*time.Second, logger)
 
 	reqs := []*JSONRPCRequest{
-		{JSONRPC: "2.0", Method: "eth_blockNumber", Params: json.RawMessage(`[]`), ID: 1},
-		{JSONRPC: "2.0", Method: "eth_gasPrice", Params: json.RawMessage(`[]`), ID: 2},
+		{JSONRPC: "2.0", Method: "eth_blockNumber", Params: json.RawMessage(`[]`), ID: json.RawMessage("1")},
+		{JSONRPC: "2.0", Method: "eth_gasPrice", Params: json.RawMessage(`[]`), ID: json.RawMessage("2")},
 	}
 
 	resps, err := client.ForwardBatch(context.Background(), reqs)
@@ -99,7 +107,7 @@ func TestClient_ForwardError(t *testing.T) {
 		JSONRPC: "2.0",
 		Method:  "eth_blockNumber",
 		Params:  json.RawMessage(`[]`),
-		ID:      1,
+		ID:      json.RawMessage("1"),
 	}
 
 	resp, err := client.Forward(context.Background(), req)
@@ -111,3 +119,449 @@ func TestClient_ForwardError(t *testing.T) {
 		t.Error("Expected error response, got nil")
 	}
 }
+
+func TestClient_ForwardFailover(t *testing.T) {
+	var downCalls atomic.Int32
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downCalls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer down.Close()
+
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: json.RawMessage("1")})
+	}))
+	defer up.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := NewPoolClient([]Endpoint{
+		{Name: "down", URL: down.URL, Weight: 10, Timeout: 5 * time.Second},
+		{Name: "up", URL: up.URL, Weight: 1, Timeout: 5 * time.Second},
+	}, logger)
+
+	req := &JSONRPCRequest{JSONRPC: "2.0", Method: "eth_blockNumber", ID: json.RawMessage("1")}
+
+	resp, err := client.Forward(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Forward() error = %v", err)
+	}
+	if resp.Error != nil {
+		t.Fatalf("Forward() returned error response %v", resp.Error)
+	}
+	if downCalls.Load() != 1 {
+		t.Errorf("down upstream called %d times, want 1", downCalls.Load())
+	}
+}
+
+func TestClient_ForwardTransportFailover(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: json.RawMessage("1")})
+	}))
+	defer up.Close()
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := NewPoolClient([]Endpoint{
+		{Name: "closed", URL: closed.URL, Weight: 10, Timeout: time.Second},
+		{Name: "up", URL: up.URL, Weight: 1, Timeout: time.Second},
+	}, logger)
+
+	resp, err := client.Forward(context.Background(), &JSONRPCRequest{JSONRPC: "2.0", Method: "eth_chainId", ID: json.RawMessage("1")})
+	if err != nil {
+		t.Fatalf("Forward() error = %v", err)
+	}
+	if string(resp.Result) != `"0x1"` {
+		t.Errorf("Result = %s, want \"0x1\"", resp.Result)
+	}
+}
+
+func TestClient_ForwardNoFailoverOn4xx(t *testing.T) {
+	var calls atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	a := httptest.NewServer(handler)
+	defer a.Close()
+	b := httptest.NewServer(handler)
+	defer b.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := NewPoolClient([]Endpoint{
+		{Name: "a", URL: a.URL, Timeout: time.Second},
+		{Name: "b", URL: b.URL, Timeout: time.Second},
+	}, logger)
+
+	resp, err := client.Forward(context.Background(), &JSONRPCRequest{JSONRPC: "2.0", Method: "eth_chainId", ID: json.RawMessage("1")})
+	if err != nil {
+		t.Fatalf("Forward() error = %v", err)
+	}
+	if resp.Error == nil {
+		t.Error("Expected error response, got nil")
+	}
+	if calls.Load() != 1 {
+		t.Errorf("upstreams called %d times, want 1", calls.Load())
+	}
+}
+
+func TestClient_ForwardMaxResponseSize(t *testing.T) {
+	var calls atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Write([]byte(`{"jsonrpc":"2.0","result":"` + strings.Repeat("ab", 100) + `","id":1}`))
+	})
+	a := httptest.NewServer(handler)
+	defer a.Close()
+	b := httptest.NewServer(handler)
+	defer b.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := NewPoolClient([]Endpoint{
+		{URL: a.URL, Timeout: 5 * time.Second},
+		{URL: b.URL, Timeout: 5 * time.Second},
+	}, logger, WithMaxResponseSize(100))
+
+	req := &JSONRPCRequest{JSONRPC: "2.0", Method: "eth_getLogs", Params: json.RawMessage(`[{}]`), ID: json.RawMessage("1")}
+	if _, err := client.Forward(context.Background(), req); !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("Forward() error = %v, want ErrResponseTooLarge", err)
+	}
+	if _, err := client.ForwardBatch(context.Background(), []*JSONRPCRequest{req}); !errors.Is(err, ErrResponseTooLarge) {
+		t.Errorf("ForwardBatch() error = %v, want ErrResponseTooLarge", err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("upstream calls = %d, want 2 without failover", calls.Load())
+	}
+}
+
+func TestClient_ForwardStatusErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		wantCode  int
+		wantMsg   string
+		wantCalls int32
+	}{
+		{
+			name:      "error body",
+			status:    http.StatusInternalServerError,
+			body:      `{"jsonrpc":"2.0","error":{"code":3,"message":"execution reverted","data":"0x08c379a0"},"id":1}`,
+			wantCode:  3,
+			wantMsg:   "execution reverted",
+			wantCalls: 1,
+		},
+		{
+			name:      "unavailable with error body",
+			status:    http.StatusServiceUnavailable,
+			body:      `{"jsonrpc":"2.0","error":{"code":-32000,"message":"node is syncing"},"id":1}`,
+			wantCode:  -32000,
+			wantMsg:   "node is syncing",
+			wantCalls: 2,
+		},
+		{
+			name:      "rate limited",
+			status:    http.StatusTooManyRequests,
+			wantCode:  LimitExceeded,
+			wantMsg:   "upstream rate limit exceeded",
+			wantCalls: 2,
+		},
+		{
+			name:      "unavailable",
+			status:    http.StatusServiceUnavailable,
+			body:      "<html>maintenance</html>",
+			wantCode:  ResourceUnavailable,
+			wantMsg:   "upstream unavailable",
+			wantCalls: 2,
+		},
+		{
+			name:      "request too large",
+			status:    http.StatusRequestEntityTooLarge,
+			wantCode:  InvalidRequest,
+			wantMsg:   "request body too large",
+			wantCalls: 1,
+		},
+		{
+			name:      "timeout",
+			status:    http.StatusGatewayTimeout,
+			wantCode:  ServerError,
+			wantMsg:   "upstream request timeout",
+			wantCalls: 2,
+		},
+		{
+			name:      "other status",
+			status:    http.StatusBadGateway,
+			wantCode:  ServerError,
+			wantMsg:   "upstream error",
+			wantCalls: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+			a := httptest.NewServer(handler)
+			defer a.Close()
+			b := httptest.NewServer(handler)
+			defer b.Close()
+
+			logger, _ := zap.NewDevelopment()
+			client := NewPoolClient([]Endpoint{
+				{Name: "a", URL: a.URL, Timeout: time.Second},
+				{Name: "b", URL: b.URL, Timeout: time.Second},
+			}, logger)
+
+			resp, err := client.Forward(context.Background(), &JSONRPCRequest{JSONRPC: "2.0", Method: "eth_call", ID: json.RawMessage("7")})
+			if err != nil {
+				t.Fatalf("Forward() error = %v", err)
+			}
+			if resp.Error == nil || resp.Error.Code != tt.wantCode || resp.Error.Message != tt.wantMsg {
+				t.Errorf("Error = %v, want code %d and message %q", resp.Error, tt.wantCode, tt.wantMsg)
+			}
+			if string(resp.ID) != "7" {
+				t.Errorf("ID = %s, want 7", resp.ID)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("upstreams called %d times, want %d", got, tt.wantCalls)
+			}
+
+			calls.Store(0)
+			resps, err := client.ForwardBatch(context.Background(), []*JSONRPCRequest{
+				{JSONRPC: "2.0", Method: "eth_call", ID: json.RawMessage("1")},
+				{JSONRPC: "2.0", Method: "eth_call", ID: json.RawMessage("2")},
+			})
+			if tt.status == http.StatusBadGateway {
+				if err == nil {
+					t.Error("ForwardBatch() error = nil, want error to retry items on")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ForwardBatch() error = %v", err)
+			}
+			for i, resp := range resps {
+				if resp.Error == nil || resp.Error.Code != tt.wantCode {
+					t.Errorf("resps[%d].Error = %v, want code %d", i, resp.Error, tt.wantCode)
+				}
+				if want := strconv.Itoa(i + 1); string(resp.ID) != want {
+					t.Errorf("resps[%d].ID = %s, want %s", i, resp.ID, want)
+				}
+			}
+		})
+	}
+}
+
+func TestClient_CircuitBreaker(t *testing.T) {
+	var downCalls atomic.Int32
+	// Like a hosted node behind a gateway, the node fails with an error body.
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downCalls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"jsonrpc":"2.0","error":{"code":-32000,"message":"service unavailable"},"id":1}`))
+	}))
+	defer down.Close()
+
+	var upCalls atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upCalls.Add(1)
+		json.NewEncoder(w).Encode(JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: json.RawMessage("1")})
+	}))
+	defer up.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := NewPoolClient([]Endpoint{
+		{Name: "down", URL: down.URL, Weight: 10, Timeout: time.Second},
+		{Name: "up", URL: up.URL, Weight: 1, Timeout: time.Second},
+	}, logger, WithCircuitBreaker(CircuitBreakerConfig{ConsecutiveFailures: 2, Cooldown: time.Hour}))
+
+	req := &JSONRPCRequest{JSONRPC: "2.0", Method: "eth_chainId", ID: json.RawMessage("1")}
+	for i := 0; i < 5; i++ {
+		resp, err := client.Forward(context.Background(), req)
+		if err != nil || resp.Error != nil {
+			t.Fatalf("Forward() = %v, %v, want result", resp, err)
+		}
+	}
+	if got := downCalls.Load(); got != 2 {
+		t.Errorf("down upstream called %d times, want 2 before its circuit opened", got)
+	}
+	if got := client.Upstreams()[0].Circuit(); got != CircuitOpen {
+		t.Errorf("down circuit = %s, want open", got)
+	}
+	if got := client.Upstreams()[1].Circuit(); got != CircuitClosed {
+		t.Errorf("up circuit = %s, want closed", got)
+	}
+
+	// With every circuit open, requests fail without reaching an upstream.
+	up.Close()
+	for i := 0; i < 2; i++ {
+		client.Forward(context.Background(), req)
+	}
+	calls := upCalls.Load()
+	_, err := client.Forward(context.Background(), req)
+	if !errors.Is(err, ErrUpstreamUnavailable) {
+		t.Errorf("Forward() error = %v, want ErrUpstreamUnavailable", err)
+	}
+	if upCalls.Load() != calls {
+		t.Error("Forward() reached an upstream with an open circuit")
+	}
+}
+
+func TestClient_Retry(t *testing.T) {
+	var calls atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		json.NewEncoder(w).Encode(JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: json.RawMessage("1")})
+	}))
+	defer upstream.Close()
+
+	logger, _ := zap.NewDevelopment()
+	req := &JSONRPCRequest{JSONRPC: "2.0", Method: "eth_call", ID: json.RawMessage("1")}
+	endpoints := []Endpoint{{URL: upstream.URL, Timeout: time.Second}}
+
+	client := NewPoolClient(endpoints, logger, WithRetry(RetryConfig{
+		MaxRetries: 2, Backoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond, BudgetRatio: 0.1, BudgetBurst: 10,
+	}))
+	resp, err := client.Forward(context.Background(), req)
+	if err != nil || resp.Error != nil {
+		t.Fatalf("Forward() = %v, %v, want result after retries", resp, err)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("upstream called %d times, want 3", got)
+	}
+
+	// Without budget, the request is not retried.
+	calls.Store(0)
+	client = NewPoolClient(endpoints, logger, WithRetry(RetryConfig{
+		MaxRetries: 2, Backoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond,
+	}))
+	resp, err = client.Forward(context.Background(), req)
+	if err != nil || resp.Error == nil {
+		t.Fatalf("Forward() = %v, %v, want error response", resp, err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("upstream called %d times without budget, want 1", got)
+	}
+}
+
+func TestClient_ForwardUnsafeMethod(t *testing.T) {
+	var calls atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	a := httptest.NewServer(handler)
+	defer a.Close()
+	b := httptest.NewServer(handler)
+	defer b.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := NewPoolClient([]Endpoint{
+		{Name: "a", URL: a.URL, Timeout: time.Second},
+		{Name: "b", URL: b.URL, Timeout: time.Second},
+	}, logger, WithRetry(RetryConfig{MaxRetries: 2, Backoff: time.Millisecond, MaxBackoff: time.Millisecond, BudgetBurst: 10}))
+
+	client.Forward(context.Background(), &JSONRPCRequest{JSONRPC: "2.0", Method: "eth_sendTransaction", ID: json.RawMessage("1")})
+	if got := calls.Load(); got != 1 {
+		t.Errorf("upstreams called %d times for eth_sendTransaction, want 1", got)
+	}
+
+	calls.Store(0)
+	client.Forward(context.Background(), &JSONRPCRequest{JSONRPC: "2.0", Method: "eth_call", ID: json.RawMessage("1")})
+	if got := calls.Load(); got != 6 {
+		t.Errorf("upstreams called %d times for eth_call, want 6", got)
+	}
+}
+
+func TestClient_ForwardRawTransactionAlreadyKnown(t *testing.T) {
+	// The first node takes the transaction but fails to answer.
+	a := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer a.Close()
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"jsonrpc":"2.0","error":{"code":-32000,"message":"already known"},"id":1}`))
+	}))
+	defer b.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := NewPoolClient([]Endpoint{
+		{Name: "a", URL: a.URL, Weight: 10, Timeout: time.Second},
+		{Name: "b", URL: b.URL, Weight: 1, Timeout: time.Second},
+	}, logger)
+
+	resp, err := client.Forward(context.Background(), &JSONRPCRequest{
+		JSONRPC: "2.0", Method: "eth_sendRawTransaction", Params: json.RawMessage(`["0x616263"]`), ID: json.RawMessage("1"),
+	})
+	if err != nil {
+		t.Fatalf("Forward() error = %v", err)
+	}
+	if resp.Error != nil {
+		t.Fatalf("Error = %v, want transaction hash", resp.Error)
+	}
+	if want := `"0x4e03657aea45a94fc7d47ba826c8d667c0d1e6e33a64a036ec44f58fa12d6c45"`; string(resp.Result) != want {
+		t.Errorf("Result = %s, want %s", resp.Result, want)
+	}
+}
+
+func TestClient_Hedging(t *testing.T) {
+	cancelled := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the client going away once the body is read.
+		io.ReadAll(r.Body)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+			json.NewEncoder(w).Encode(JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"slow"`), ID: json.RawMessage("1")})
+		}
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"fast"`), ID: json.RawMessage("1")})
+	}))
+	defer fast.Close()
+
+	logger, _ := zap.NewDevelopment()
+	client := NewPoolClient([]Endpoint{
+		{Name: "slow", URL: slow.URL, Weight: 10, Timeout: 10 * time.Second},
+		{Name: "fast", URL: fast.URL, Weight: 1, Timeout: 10 * time.Second},
+	}, logger, WithHedging(HedgeConfig{Methods: []string{"eth_call"}, Percentile: 0.9, MaxRate: 1}))
+	for i := 0; i < minLatencySamples; i++ {
+		client.latencies.observe("eth_call", 10*time.Millisecond)
+	}
+
+	start := time.Now()
+	resp, err := client.Forward(context.Background(), &JSONRPCRequest{JSONRPC: "2.0", Method: "eth_call", ID: json.RawMessage("1")})
+	if err != nil {
+		t.Fatalf("Forward() error = %v", err)
+	}
+	if string(resp.Result) != `"fast"` {
+		t.Errorf("Result = %s, want the hedged answer", resp.Result)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Forward() took %v, want the hedged answer right away", elapsed)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("request to the slow upstream was not cancelled")
+	}
+
+	// The slow upstream's latency counts as at least the hedge delay.
+	samples := client.latencies.byMethod["eth_call"].samples
+	if got, want := len(samples), minLatencySamples+2; got != want {
+		t.Fatalf("latency samples = %d, want %d", got, want)
+	}
+	if got := samples[len(samples)-1]; got < 10*time.Millisecond {
+		t.Errorf("cancelled primary latency = %v, want at least the hedge delay", got)
+	}
+}
@@ -0,0 +1,184 @@
+package rpc
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/devlongs/geth-relay/methods"
+	"go.uber.org/zap"
+)
+
+// HedgeConfig configures hedged requests. A request for one of Methods
+// that has not been answered within the Percentile of the method's recent
+// latencies, but at least MinDelay, is sent to a second upstream as well.
+// At most MaxRate of the requests for those methods are hedged. Methods
+// that are not known to be read-only are never hedged.
+type HedgeConfig struct {
+	Methods    []string
+	Percentile float64
+	MinDelay   time.Duration
+	MaxRate    float64
+}
+
+const (
+	// hedgeBurst is the number of hedges the hedge budget saves up.
+	hedgeBurst = 10
+	// latencySamples is the number of recent latencies kept per method.
+	latencySamples = 256
+	// minLatencySamples is the number of latencies needed before a
+	// method's percentile is trusted.
+	minLatencySamples = 20
+)
+
+// hedges reports whether requests for method are hedged.
+func (c *Client) hedges(method string) bool {
+	return c.hedge != nil && methodPolicy(method) == retrySafe && methods.Match(c.hedge.Methods, method)
+}
+
+// hedgeFor returns how long to wait for u to answer a request for method
+// before hedging it, and the upstream among rest to hedge to. Only the
+// first attempt of a request is hedged.
+func (c *Client) hedgeFor(first bool, method string, u *Upstream, rest []*Upstream) (time.Duration, *Upstream, bool) {
+	if !first || !c.hedges(method) {
+		return 0, nil, false
+	}
+	c.hedgeBudget.deposit()
+
+	delay, ok := c.latencies.percentile(method, c.hedge.Percentile)
+	if !ok {
+		return 0, nil, false
+	}
+	for _, backup := range rest {
+		if backup.Healthy() && backup.Circuit() == CircuitClosed {
+			return max(delay, c.hedge.MinDelay), backup, true
+		}
+	}
+	return 0, nil, false
+}
+
+// forwardHedged sends req to primary, whose circuit breaker let it through
+// in generation gen, and, if it has not answered after delay, to backup as
+// well, and reports whether it did. The first successful answer is
+// returned and the other request is cancelled. When both fail, the first
+// error is returned. A primary cancelled in favour of the backup's answer
+// has its latency recorded as the time it had taken so far, so the slow
+// requests that are hedged still count towards the method's percentile.
+func (c *Client) forwardHedged(ctx context.Context, primary *Upstream, gen uint64, backup *Upstream, req *JSONRPCRequest, delay time.Duration) (*JSONRPCResponse, bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		u    *Upstream
+		resp *JSONRPCResponse
+		err  error
+	}
+	results := make(chan result, 2)
+	send := func(u *Upstream, gen uint64) {
+		resp, err := c.forwardSingle(ctx, u, req)
+		recordCircuit(ctx, u, gen, err)
+		results <- result{u, resp, err}
+	}
+
+	start := time.Now()
+	go send(primary, gen)
+	pending := 1
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var failed *result
+	hedged := false
+	for {
+		select {
+		case <-timer.C:
+			if !c.hedgeBudget.withdraw() {
+				continue
+			}
+			backupGen, ok := backup.breaker.allow()
+			if !ok {
+				continue
+			}
+			c.logger.Debug("hedging request",
+				zap.String("method", req.Method),
+				zap.String("upstream", primary.name),
+				zap.String("hedge", backup.name),
+				zap.Duration("delay", delay))
+			go send(backup, backupGen)
+			pending++
+			hedged = true
+
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				if r.u != primary && pending > 0 {
+					c.latencies.observe(req.Method, time.Since(start))
+				}
+				return r.resp, hedged, nil
+			}
+			if failed == nil {
+				failed = &r
+			}
+			if pending == 0 {
+				return failed.resp, hedged, failed.err
+			}
+		}
+	}
+}
+
+// latencies keeps the recent latencies of successful requests per method.
+// A nil *latencies keeps nothing.
+type latencies struct {
+	mu       sync.Mutex
+	byMethod map[string]*latencyWindow
+}
+
+type latencyWindow struct {
+	samples []time.Duration
+	next    int
+}
+
+func newLatencies() *latencies {
+	return &latencies{byMethod: make(map[string]*latencyWindow)}
+}
+
+func (l *latencies) observe(method string, d time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	w, ok := l.byMethod[method]
+	if !ok {
+		w = &latencyWindow{samples: make([]time.Duration, 0, latencySamples)}
+		l.byMethod[method] = w
+	}
+	if len(w.samples) < latencySamples {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencySamples
+}
+
+// percentile returns the p-th percentile, 0 < p < 1, of the recent
+// latencies of method, or false if too few were observed.
+func (l *latencies) percentile(method string, p float64) (time.Duration, bool) {
+	if l == nil {
+		return 0, false
+	}
+	l.mu.Lock()
+	w, ok := l.byMethod[method]
+	if !ok || len(w.samples) < minLatencySamples {
+		l.mu.Unlock()
+		return 0, false
+	}
+	samples := slices.Clone(w.samples)
+	l.mu.Unlock()
+
+	slices.Sort(samples)
+	i := int(p * float64(len(samples)))
+	return samples[min(i, len(samples)-1)], true
+}
@@ -0,0 +1,70 @@
+package rpc
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestLatencies_Percentile(t *testing.T) {
+	l := newLatencies()
+	for i := 1; i < minLatencySamples; i++ {
+		l.observe("eth_call", time.Duration(i)*time.Millisecond)
+	}
+	if _, ok := l.percentile("eth_call", 0.9); ok {
+		t.Fatal("percentile() ok = true before enough samples")
+	}
+
+	for i := minLatencySamples; i <= 100; i++ {
+		l.observe("eth_call", time.Duration(i)*time.Millisecond)
+	}
+	if got, _ := l.percentile("eth_call", 0.9); got != 91*time.Millisecond {
+		t.Errorf("percentile(0.9) = %v, want 91ms", got)
+	}
+	if got, _ := l.percentile("eth_call", 0.999); got != 100*time.Millisecond {
+		t.Errorf("percentile(0.999) = %v, want 100ms", got)
+	}
+	if _, ok := l.percentile("eth_getLogs", 0.9); ok {
+		t.Error("percentile() ok = true for a method without samples")
+	}
+
+	// Old samples drop out of the window.
+	for i := 0; i < latencySamples; i++ {
+		l.observe("eth_call", time.Second)
+	}
+	if got, _ := l.percentile("eth_call", 0.1); got != time.Second {
+		t.Errorf("percentile(0.1) = %v after the window turned over, want 1s", got)
+	}
+
+	var none *latencies
+	none.observe("eth_call", time.Millisecond)
+	if _, ok := none.percentile("eth_call", 0.9); ok {
+		t.Error("percentile() ok = true for nil latencies")
+	}
+}
+
+func TestClient_Hedges(t *testing.T) {
+	logger, _ := zap.NewDevelopment()
+	client := NewPoolClient(nil, logger, WithHedging(HedgeConfig{Methods: []string{"eth_call", "trace_*", "eth_sendTransaction", "eth_sendRawTransaction"}}))
+
+	tests := []struct {
+		method string
+		want   bool
+	}{
+		{"eth_call", true},
+		{"trace_block", true},
+		{"eth_blockNumber", false},
+		{"eth_sendTransaction", false},
+		{"eth_sendRawTransaction", false},
+	}
+	for _, tt := range tests {
+		if got := client.hedges(tt.method); got != tt.want {
+			t.Errorf("hedges(%q) = %v, want %v", tt.method, got, tt.want)
+		}
+	}
+
+	if NewPoolClient(nil, logger).hedges("eth_call") {
+		t.Error("hedges() = true without hedging")
+	}
+}
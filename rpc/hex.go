@@ -0,0 +1,58 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DecodeQuantity decodes a JSON-RPC quantity such as "0x1b4" into a uint64.
+func DecodeQuantity(raw json.RawMessage) (uint64, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return 0, fmt.Errorf("quantity is not a string: %w", err)
+	}
+	return ParseQuantity(s)
+}
+
+// ParseQuantity parses a 0x-prefixed hex quantity.
+func ParseQuantity(s string) (uint64, error) {
+	if !strings.HasPrefix(s, "0x") && !strings.HasPrefix(s, "0X") {
+		return 0, fmt.Errorf("quantity %q is missing 0x prefix", s)
+	}
+	n, err := strconv.ParseUint(s[2:], 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid quantity %q: %w", s, err)
+	}
+	return n, nil
+}
+
+// EncodeQuantity formats n as a 0x-prefixed hex quantity.
+func EncodeQuantity(n uint64) string {
+	return "0x" + strconv.FormatUint(n, 16)
+}
+
+// LowerHex lowercases the 0x-prefixed strings in a decoded JSON value, in
+// place, so values that only differ in hex case compare equal.
+func LowerHex(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if strings.HasPrefix(v, "0x") || strings.HasPrefix(v, "0X") {
+			return strings.ToLower(v)
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = LowerHex(v[i])
+		}
+		return v
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = LowerHex(v[k])
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,51 @@
+package rpc
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestDecodeQuantity(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    uint64
+		wantErr bool
+	}{
+		{raw: `"0x0"`, want: 0},
+		{raw: `"0x1b4"`, want: 436},
+		{raw: `"0xffffffffffffffff"`, want: 1<<64 - 1},
+		{raw: `"1b4"`, wantErr: true},
+		{raw: `"0xzz"`, wantErr: true},
+		{raw: `436`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := DecodeQuantity(json.RawMessage(tt.raw))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeQuantity(%s) error = %v, wantErr %v", tt.raw, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("DecodeQuantity(%s) = %d, want %d", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeQuantity(t *testing.T) {
+	if got := EncodeQuantity(436); got != "0x1b4" {
+		t.Errorf("EncodeQuantity(436) = %s, want 0x1b4", got)
+	}
+	if got := EncodeQuantity(0); got != "0x0" {
+		t.Errorf("EncodeQuantity(0) = %s, want 0x0", got)
+	}
+}
+
+func TestLowerHex(t *testing.T) {
+	var v interface{}
+	json.Unmarshal([]byte(`["0xABC",{"address":"0XDeF","topics":[["0xAa"]]},"Latest",1]`), &v)
+	got, _ := json.Marshal(LowerHex(v))
+	if want := `["0xabc",{"address":"0xdef","topics":[["0xaa"]]},"Latest",1]`; string(got) != want {
+		t.Errorf("LowerHex() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,254 @@
+package rpc
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devlongs/geth-relay/methods"
+	"golang.org/x/crypto/sha3"
+)
+
+// RetryConfig configures how often a request that failed on every upstream
+// is sent through the pool again. The n-th retry waits a random time of up
+// to Backoff doubled n-1 times, capped at MaxBackoff. Retries come out of a
+// budget shared by all requests: every request adds BudgetRatio retries to
+// it, and at most BudgetBurst retries are saved up.
+type RetryConfig struct {
+	MaxRetries  int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	BudgetRatio float64
+	BudgetBurst int
+}
+
+// retryPolicy says which failed attempts of a request may be sent again,
+// to the next upstream or in a retry.
+type retryPolicy int
+
+const (
+	// retrySafe is for read-only methods, which can run any number of
+	// times.
+	retrySafe retryPolicy = iota
+	// retryTransaction is for eth_sendRawTransaction. A signed transaction
+	// can be sent again, but a node that got it before rejects it as
+	// already known.
+	retryTransaction
+	// retryUnsafe is for every other method, which may change node state.
+	// They are only sent again when the failed attempt never reached the
+	// upstream.
+	retryUnsafe
+)
+
+// readMethods are the methods known not to change node state. A trailing *
+// matches any suffix.
+var readMethods = []string{
+	"eth_blockNumber",
+	"eth_blobBaseFee",
+	"eth_call",
+	"eth_chainId",
+	"eth_createAccessList",
+	"eth_estimateGas",
+	"eth_feeHistory",
+	"eth_gasPrice",
+	"eth_getBalance",
+	"eth_getBlockByHash",
+	"eth_getBlockByNumber",
+	"eth_getBlockReceipts",
+	"eth_getBlockTransactionCountByHash",
+	"eth_getBlockTransactionCountByNumber",
+	"eth_getCode",
+	"eth_getLogs",
+	"eth_getProof",
+	"eth_getStorageAt",
+	"eth_getTransactionByBlockHashAndIndex",
+	"eth_getTransactionByBlockNumberAndIndex",
+	"eth_getTransactionByHash",
+	"eth_getTransactionCount",
+	"eth_getTransactionReceipt",
+	"eth_getUncleByBlockHashAndIndex",
+	"eth_getUncleByBlockNumberAndIndex",
+	"eth_getUncleCountByBlockHash",
+	"eth_getUncleCountByBlockNumber",
+	"eth_maxPriorityFeePerGas",
+	"eth_protocolVersion",
+	"eth_simulateV1",
+	"eth_syncing",
+	"net_listening",
+	"net_peerCount",
+	"net_version",
+	"web3_clientVersion",
+	"web3_sha3",
+	"txpool_content",
+	"txpool_inspect",
+	"txpool_status",
+	"debug_trace*",
+	"trace_*",
+}
+
+func methodPolicy(method string) retryPolicy {
+	if method == "eth_sendRawTransaction" {
+		return retryTransaction
+	}
+	if methods.Match(readMethods, method) {
+		return retrySafe
+	}
+	return retryUnsafe
+}
+
+// Resendable reports whether a request for method may be sent again after
+// an attempt that may have run it on an upstream. Answers to resent
+// requests should go through ResolveResent.
+func Resendable(method string) bool {
+	return methodPolicy(method) != retryUnsafe
+}
+
+// batchPolicy returns the strictest policy of the requests in a batch.
+func batchPolicy(reqs []*JSONRPCRequest) retryPolicy {
+	policy := retrySafe
+	for _, req := range reqs {
+		policy = max(policy, methodPolicy(req.Method))
+	}
+	return policy
+}
+
+// retryable reports whether an attempt that failed with err may be sent
+// again under the policy.
+func (p retryPolicy) retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	if p == retryUnsafe {
+		return notSent(err)
+	}
+	return shouldFailover(ctx, err) || rateLimited(err)
+}
+
+// notSent reports whether a request that failed with err certainly did not
+// run on the upstream: it could not be connected to or turned the request
+// away for its rate limit.
+func notSent(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return rateLimited(err)
+}
+
+func rateLimited(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests
+}
+
+// budget caps extra attempts, retries or hedges, at a share of all
+// requests, so the pool is not hit with a multiple of its usual load. A nil
+// *budget allows no extra attempts.
+type budget struct {
+	mu     sync.Mutex
+	ratio  float64
+	burst  float64
+	tokens float64
+}
+
+func newBudget(ratio float64, burst int) *budget {
+	return &budget{ratio: ratio, burst: float64(burst), tokens: float64(burst)}
+}
+
+// deposit adds the extra attempts a new request earns.
+func (b *budget) deposit() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = min(b.burst, b.tokens+b.ratio)
+}
+
+// withdraw takes one attempt from the budget if there is one left.
+func (b *budget) withdraw() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// backoff returns a random wait of up to the exponential backoff of the
+// n-th retry.
+func backoff(cfg *RetryConfig, n int) time.Duration {
+	d := cfg.Backoff
+	for i := 1; i < n && d < cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, cfg.MaxBackoff)
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int64N(int64(d))) + 1
+}
+
+// wait sleeps for d or until ctx is done, and reports whether it slept the
+// whole time.
+func wait(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// ResolveResent returns the response to a request the relay may have sent
+// to an upstream before. An eth_sendRawTransaction rejected as already
+// known was accepted by the earlier attempt, so it is answered with the
+// transaction hash, as the first answer would have been.
+func ResolveResent(req *JSONRPCRequest, resp *JSONRPCResponse) *JSONRPCResponse {
+	if resp == nil || resp.Error == nil || req.Method != "eth_sendRawTransaction" || !alreadyKnown(resp.Error.Message) {
+		return resp
+	}
+	hash, ok := transactionHash(req.Params)
+	if !ok {
+		return resp
+	}
+	result, _ := json.Marshal(hash)
+	return &JSONRPCResponse{JSONRPC: "2.0", Result: result, ID: resp.ID}
+}
+
+// alreadyKnown reports whether message is how geth or another client
+// rejects a transaction that is already in its pool.
+func alreadyKnown(message string) bool {
+	message = strings.ToLower(message)
+	return strings.Contains(message, "already known") ||
+		strings.Contains(message, "alreadyknown") ||
+		strings.Contains(message, "known transaction")
+}
+
+// transactionHash returns the hash of the raw transaction in the params of
+// an eth_sendRawTransaction request.
+func transactionHash(params json.RawMessage) (string, bool) {
+	var args []string
+	if err := json.Unmarshal(params, &args); err != nil || len(args) == 0 {
+		return "", false
+	}
+	raw, err := hex.DecodeString(strings.TrimPrefix(args[0], "0x"))
+	if err != nil || len(raw) == 0 {
+		return "", false
+	}
+	h := sha3.NewLegacyKeccak256()
+	h.Write(raw)
+	return "0x" + hex.EncodeToString(h.Sum(nil)), true
+}
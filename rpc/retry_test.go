@@ -0,0 +1,107 @@
+package rpc
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMethodPolicy(t *testing.T) {
+	tests := []struct {
+		method string
+		want   retryPolicy
+	}{
+		{"eth_call", retrySafe},
+		{"eth_getLogs", retrySafe},
+		{"debug_traceTransaction", retrySafe},
+		{"eth_sendRawTransaction", retryTransaction},
+		{"trace_block", retrySafe},
+		{"eth_sendTransaction", retryUnsafe},
+		{"eth_sendBundle", retryUnsafe},
+		{"eth_sendRawTransactionConditional", retryUnsafe},
+		{"eth_newFilter", retryUnsafe},
+		{"personal_unlockAccount", retryUnsafe},
+		{"debug_setHead", retryUnsafe},
+		{"engine_forkchoiceUpdatedV3", retryUnsafe},
+		{"unknown_method", retryUnsafe},
+	}
+	for _, tt := range tests {
+		if got := methodPolicy(tt.method); got != tt.want {
+			t.Errorf("methodPolicy(%q) = %d, want %d", tt.method, got, tt.want)
+		}
+	}
+
+	batch := []*JSONRPCRequest{{Method: "eth_call"}, {Method: "eth_sendRawTransaction"}}
+	if got := batchPolicy(batch); got != retryTransaction {
+		t.Errorf("batchPolicy() = %d, want %d", got, retryTransaction)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	b := newBudget(0.5, 2)
+	if !b.withdraw() || !b.withdraw() {
+		t.Fatal("withdraw() = false within the burst")
+	}
+	if b.withdraw() {
+		t.Fatal("withdraw() = true with an empty budget")
+	}
+	b.deposit()
+	if b.withdraw() {
+		t.Error("withdraw() = true after half a retry was earned")
+	}
+	b.deposit()
+	if !b.withdraw() {
+		t.Error("withdraw() = false after a retry was earned")
+	}
+
+	var none *budget
+	none.deposit()
+	if none.withdraw() {
+		t.Error("withdraw() = true for nil budget")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	cfg := &RetryConfig{Backoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+	for _, tt := range []struct {
+		n   int
+		max time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 300 * time.Millisecond},
+		{10, 300 * time.Millisecond},
+	} {
+		for i := 0; i < 20; i++ {
+			if d := backoff(cfg, tt.n); d <= 0 || d > tt.max {
+				t.Fatalf("backoff(%d) = %s, want in (0, %s]", tt.n, d, tt.max)
+			}
+		}
+	}
+}
+
+func TestResolveResent(t *testing.T) {
+	known := &JSONRPCResponse{JSONRPC: "2.0", Error: &JSONRPCError{Code: -32000, Message: "already known"}, ID: json.RawMessage("1")}
+	send := &JSONRPCRequest{JSONRPC: "2.0", Method: "eth_sendRawTransaction", Params: json.RawMessage(`["0x616263"]`), ID: json.RawMessage("1")}
+
+	resp := ResolveResent(send, known)
+	if resp.Error != nil {
+		t.Fatalf("Error = %v, want transaction hash", resp.Error)
+	}
+	// Keccak-256 of "abc".
+	if want := `"0x4e03657aea45a94fc7d47ba826c8d667c0d1e6e33a64a036ec44f58fa12d6c45"`; string(resp.Result) != want {
+		t.Errorf("Result = %s, want %s", resp.Result, want)
+	}
+	if string(resp.ID) != "1" {
+		t.Errorf("ID = %s, want 1", resp.ID)
+	}
+
+	nonceTooLow := &JSONRPCResponse{JSONRPC: "2.0", Error: &JSONRPCError{Code: -32000, Message: "nonce too low"}, ID: json.RawMessage("1")}
+	if got := ResolveResent(send, nonceTooLow); got != nonceTooLow {
+		t.Errorf("ResolveResent() changed a %q error", nonceTooLow.Error.Message)
+	}
+	call := &JSONRPCRequest{JSONRPC: "2.0", Method: "eth_call", ID: json.RawMessage("1")}
+	if got := ResolveResent(call, known); got != known {
+		t.Error("ResolveResent() changed the response to eth_call")
+	}
+}
@@ -1,21 +1,79 @@
 package rpc
 
-import "encoding/json"
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
 
 type JSONRPCRequest struct {
 	JSONRPC string          `json:"jsonrpc"`
 	Method  string          `json:"method"`
 	Params  json.RawMessage `json:"params,omitempty"`
-	ID      interface{}     `json:"id"`
+	// ID is kept as sent, so it is echoed exactly. It is nil when the
+	// request has no id member, and "null" for an explicit null id.
+	ID json.RawMessage `json:"id"`
+}
+
+// IsNotification reports whether the request is a notification, which must
+// not be answered.
+func (r *JSONRPCRequest) IsNotification() bool {
+	return r.ID == nil
+}
+
+// HasValidID reports whether the request's id is a string, a number or
+// null, or missing. JSON-RPC 2.0 allows no other ids.
+func (r *JSONRPCRequest) HasValidID() bool {
+	if r.ID == nil {
+		return true
+	}
+	if len(r.ID) == 0 || !json.Valid(r.ID) {
+		return false
+	}
+	switch c := r.ID[0]; {
+	case c == '"', c == '-', c >= '0' && c <= '9':
+		return true
+	default:
+		return string(r.ID) == "null"
+	}
 }
 
 type JSONRPCResponse struct {
-	JSONRPC string          `json:"jsonrpc"`
-	Result  json.RawMessage `json:"result,omitempty"`
-	Error   *JSONRPCError   `json:"error,omitempty"`
-	ID      interface{}     `json:"id"`
+	JSONRPC string `json:"jsonrpc"`
+	// Result is kept as received. A successful response without one is
+	// written with a null result.
+	Result json.RawMessage `json:"result"`
+	Error  *JSONRPCError   `json:"error,omitempty"`
+	ID     json.RawMessage `json:"id"`
 }
 
+// MarshalJSON writes the result of successful responses, null if empty,
+// and leaves it out of error responses. IDs and results are written as
+// received, without HTML escaping.
+func (r JSONRPCResponse) MarshalJSON() ([]byte, error) {
+	out := struct {
+		JSONRPC string          `json:"jsonrpc"`
+		Result  json.RawMessage `json:"result,omitempty"`
+		Error   *JSONRPCError   `json:"error,omitempty"`
+		ID      json.RawMessage `json:"id"`
+	}{JSONRPC: r.JSONRPC, Result: r.Result, Error: r.Error, ID: r.ID}
+	if out.Error != nil {
+		out.Result = nil
+	} else if len(out.Result) == 0 {
+		out.Result = null
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(out); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+var null = json.RawMessage("null")
+
 type JSONRPCError struct {
 	Code    int         `json:"code"`
 	Message string      `json:"message"`
@@ -23,22 +81,29 @@ type JSONRPCError struct {
 }
 
 const (
-	ParseError     = -32700
-	InvalidRequest = -32600
-	MethodNotFound = -32601
-	InvalidParams  = -32602
-	InternalError  = -32603
-	ServerError    = -32000
+	ParseError          = -32700
+	InvalidRequest      = -32600
+	MethodNotFound      = -32601
+	InvalidParams       = -32602
+	InternalError       = -32603
+	ServerError         = -32000
+	LimitExceeded       = -32005
+	ResponseTooLarge    = -32003
+	ResourceUnavailable = -32002
 )
 
 var (
-	ErrRequestTooLarge = &JSONRPCError{Code: InvalidRequest, Message: "request body too large"}
-	ErrBatchTooLarge   = &JSONRPCError{Code: InvalidRequest, Message: "batch request exceeds limit"}
-	ErrUpstreamTimeout = &JSONRPCError{Code: ServerError, Message: "upstream request timeout"}
-	ErrUpstreamError   = &JSONRPCError{Code: ServerError, Message: "upstream error"}
+	ErrRequestTooLarge  = &JSONRPCError{Code: InvalidRequest, Message: "request body too large"}
+	ErrBatchTooLarge    = &JSONRPCError{Code: InvalidRequest, Message: "batch request exceeds limit"}
+	ErrUpstreamTimeout  = &JSONRPCError{Code: ServerError, Message: "upstream request timeout"}
+	ErrUpstreamError    = &JSONRPCError{Code: ServerError, Message: "upstream error"}
+	ErrResponseTooLarge = &JSONRPCError{Code: ResponseTooLarge, Message: "response too large"}
+
+	ErrUpstreamRateLimited = &JSONRPCError{Code: LimitExceeded, Message: "upstream rate limit exceeded"}
+	ErrUpstreamUnavailable = &JSONRPCError{Code: ResourceUnavailable, Message: "upstream unavailable"}
 )
 
-func NewErrorResponse(id interface{}, code int, message string) *JSONRPCResponse {
+func NewErrorResponse(id json.RawMessage, code int, message string) *JSONRPCResponse {
 	return &JSONRPCResponse{
 		JSONRPC: "2.0",
 		Error: &JSONRPCError{
@@ -48,3 +113,31 @@ func NewErrorResponse(id interface{}, code int, message string) *JSONRPCResponse
 		ID: id,
 	}
 }
+
+// ParseBatch decodes a batch request body. Items that are not request
+// objects are returned as requests with only their ID, if any, so they
+// fail validation on their own instead of failing the whole batch.
+func ParseBatch(body []byte) ([]*JSONRPCRequest, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		return nil, err
+	}
+
+	reqs := make([]*JSONRPCRequest, len(items))
+	for i, item := range items {
+		var req JSONRPCRequest
+		if err := json.Unmarshal(item, &req); err != nil {
+			var withID struct {
+				ID json.RawMessage `json:"id"`
+			}
+			json.Unmarshal(item, &withID)
+			req = JSONRPCRequest{ID: withID.ID}
+		}
+		reqs[i] = &req
+	}
+	return reqs, nil
+}
+
+func (e *JSONRPCError) Error() string {
+	return fmt.Sprintf("json-rpc error %d: %s", e.Code, e.Message)
+}
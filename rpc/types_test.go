@@ -1,7 +1,9 @@
 package rpc
 
 import (
+	"bytes"
 	"encoding/json"
+	"strings"
 	"testing"
 )
 
@@ -10,7 +12,7 @@ func TestJSONRPCRequest_Marshal(t *testing.T) {
 		JSONRPC: "2.0",
 		Method:  "eth_blockNumber",
 		Params:  json.RawMessage(`[]`),
-		ID:      1,
+		ID:      json.RawMessage("1"),
 	}
 
 	data, err := json.Marshal(req)
@@ -32,7 +34,7 @@ func TestJSONRPCResponse_Marshal(t *testing.T) {
 	resp := &JSONRPCResponse{
 		JSONRPC: "2.0",
 		Result:  json.RawMessage(`"0x123"`),
-		ID:      1,
+		ID:      json.RawMessage("1"),
 	}
 
 	data, err := json.Marshal(resp)
@@ -53,19 +55,19 @@ func TestJSONRPCResponse_Marshal(t *testing.T) {
 func TestNewErrorResponse(t *testing.T) {
 	tests := []struct {
 		name    string
-		id      interface{}
+		id      json.RawMessage
 		code    int
 		message string
 	}{
 		{
 			name:    "parse error",
-			id:      1,
+			id:      json.RawMessage("1"),
 			code:    ParseError,
 			message: "parse error",
 		},
 		{
 			name:    "invalid request",
-			id:      "test",
+			id:      json.RawMessage(`"test"`),
 			code:    InvalidRequest,
 			message: "invalid request",
 		},
@@ -93,8 +95,8 @@ func TestNewErrorResponse(t *testing.T) {
 			if resp.Error.Message != tt.message {
 				t.Errorf("Error.Message = %v, want %v", resp.Error.Message, tt.message)
 			}
-			if resp.ID != tt.id {
-				t.Errorf("ID = %v, want %v", resp.ID, tt.id)
+			if string(resp.ID) != string(tt.id) {
+				t.Errorf("ID = %s, want %s", resp.ID, tt.id)
 			}
 		})
 	}
@@ -127,3 +129,126 @@ func TestErrorCodes(t *testing.T) {
 		}
 	}
 }
+
+func TestParseBatch(t *testing.T) {
+	reqs, err := ParseBatch([]byte(`[{"jsonrpc":"2.0","method":"eth_chainId","id":1},42,{"jsonrpc":"2.0","method":7,"id":"b"}]`))
+	if err != nil {
+		t.Fatalf("ParseBatch() error = %v", err)
+	}
+	if len(reqs) != 3 {
+		t.Fatalf("len(reqs) = %d, want 3", len(reqs))
+	}
+	if reqs[0].Method != "eth_chainId" || reqs[0].JSONRPC != "2.0" {
+		t.Errorf("reqs[0] = %+v, want eth_chainId request", reqs[0])
+	}
+	if reqs[1].JSONRPC != "" || reqs[1].ID != nil {
+		t.Errorf("reqs[1] = %+v, want empty request", reqs[1])
+	}
+	if reqs[2].JSONRPC != "" || reqs[2].Method != "" || string(reqs[2].ID) != `"b"` {
+		t.Errorf("reqs[2] = %+v, want request with only ID b", reqs[2])
+	}
+
+	if _, err := ParseBatch([]byte(`[{"jsonrpc":"2.0"`)); err == nil {
+		t.Error("ParseBatch() error = nil, want error for invalid JSON")
+	}
+}
+
+func TestJSONRPCRequest_IsNotification(t *testing.T) {
+	tests := []struct {
+		body string
+		want bool
+	}{
+		{`{"jsonrpc":"2.0","method":"eth_chainId"}`, true},
+		{`{"jsonrpc":"2.0","method":"eth_chainId","id":null}`, false},
+		{`{"jsonrpc":"2.0","method":"eth_chainId","id":1}`, false},
+		{`{"jsonrpc":"2.0","method":"eth_chainId","id":"a"}`, false},
+	}
+	for _, tt := range tests {
+		var req JSONRPCRequest
+		if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+			t.Fatalf("Unmarshal(%s) error = %v", tt.body, err)
+		}
+		if got := req.IsNotification(); got != tt.want {
+			t.Errorf("IsNotification() of %s = %v, want %v", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestJSONRPCResponse_MarshalResult(t *testing.T) {
+	tests := []struct {
+		name string
+		resp JSONRPCResponse
+		want string
+	}{
+		{
+			name: "null result",
+			resp: JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`null`), ID: json.RawMessage(`1`)},
+			want: `{"jsonrpc":"2.0","result":null,"id":1}`,
+		},
+		{
+			name: "missing result",
+			resp: JSONRPCResponse{JSONRPC: "2.0", ID: json.RawMessage(`1`)},
+			want: `{"jsonrpc":"2.0","result":null,"id":1}`,
+		},
+		{
+			name: "error",
+			resp: JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`null`), Error: &JSONRPCError{Code: InternalError, Message: "internal error"}, ID: json.RawMessage(`1`)},
+			want: `{"jsonrpc":"2.0","error":{"code":-32603,"message":"internal error"},"id":1}`,
+		},
+		{
+			name: "large id",
+			resp: JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: json.RawMessage(`9007199254740993123`)},
+			want: `{"jsonrpc":"2.0","result":"0x1","id":9007199254740993123}`,
+		},
+		{
+			name: "unescaped id",
+			resp: JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`), ID: json.RawMessage(`"<a&b>"`)},
+			want: `{"jsonrpc":"2.0","result":"0x1","id":"<a&b>"}`,
+		},
+		{
+			name: "no id",
+			resp: JSONRPCResponse{JSONRPC: "2.0", Result: json.RawMessage(`"0x1"`)},
+			want: `{"jsonrpc":"2.0","result":"0x1","id":null}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The relay's encoders do not escape HTML either.
+			var buf bytes.Buffer
+			enc := json.NewEncoder(&buf)
+			enc.SetEscapeHTML(false)
+			if err := enc.Encode(tt.resp); err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+			if got := strings.TrimSpace(buf.String()); got != tt.want {
+				t.Errorf("Encode() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONRPCRequest_HasValidID(t *testing.T) {
+	tests := []struct {
+		body string
+		want bool
+	}{
+		{`{"jsonrpc":"2.0","method":"eth_chainId","id":1}`, true},
+		{`{"jsonrpc":"2.0","method":"eth_chainId","id":-1.5e3}`, true},
+		{`{"jsonrpc":"2.0","method":"eth_chainId","id":"a"}`, true},
+		{`{"jsonrpc":"2.0","method":"eth_chainId","id":null}`, true},
+		{`{"jsonrpc":"2.0","method":"eth_chainId"}`, true},
+		{`{"jsonrpc":"2.0","method":"eth_chainId","id":true}`, false},
+		{`{"jsonrpc":"2.0","method":"eth_chainId","id":[1]}`, false},
+		{`{"jsonrpc":"2.0","method":"eth_chainId","id":{"a":1}}`, false},
+	}
+	for _, tt := range tests {
+		var req JSONRPCRequest
+		if err := json.Unmarshal([]byte(tt.body), &req); err != nil {
+			t.Fatalf("Unmarshal(%s) error = %v", tt.body, err)
+		}
+		if got := req.HasValidID(); got != tt.want {
+			t.Errorf("HasValidID() of %s = %v, want %v", tt.body, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package rpc
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Endpoint describes a single upstream node.
+type Endpoint struct {
+	Name    string
+	URL     string
+	Weight  int
+	Timeout time.Duration
+}
+
+// Upstream is a node in the client's upstream pool.
+type Upstream struct {
+	name       string
+	url        string
+	weight     int
+	httpClient *http.Client
+
+	healthy atomic.Bool
+	breaker *breaker
+
+	statsMu   sync.Mutex
+	requests  uint64
+	errors    uint64
+	errorRate float64
+	latency   time.Duration
+}
+
+// UpstreamStats summarises the traffic an upstream has served. ErrorRate
+// and Latency are moving averages that favour recent requests.
+type UpstreamStats struct {
+	Requests  uint64
+	Errors    uint64
+	ErrorRate float64
+	Latency   time.Duration
+}
+
+// statsAlpha is the weight of the latest request in the moving averages.
+const statsAlpha = 0.1
+
+func newUpstream(e Endpoint) *Upstream {
+	weight := e.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	name := e.Name
+	if name == "" {
+		name = e.URL
+	}
+
+	u := &Upstream{
+		name:   name,
+		url:    e.URL,
+		weight: weight,
+		httpClient: &http.Client{
+			Timeout: e.Timeout,
+		},
+	}
+	u.healthy.Store(true)
+	return u
+}
+
+func (u *Upstream) Name() string {
+	return u.name
+}
+
+func (u *Upstream) URL() string {
+	return u.url
+}
+
+func (u *Upstream) Weight() int {
+	return u.weight
+}
+
+func (u *Upstream) Healthy() bool {
+	return u.healthy.Load()
+}
+
+func (u *Upstream) SetHealthy(healthy bool) {
+	u.healthy.Store(healthy)
+}
+
+// Circuit returns the state of the upstream's circuit breaker. Without a
+// circuit breaker it is always closed.
+func (u *Upstream) Circuit() CircuitState {
+	return u.breaker.current()
+}
+
+// Stats returns a snapshot of the upstream's traffic statistics.
+func (u *Upstream) Stats() UpstreamStats {
+	u.statsMu.Lock()
+	defer u.statsMu.Unlock()
+
+	return UpstreamStats{
+		Requests:  u.requests,
+		Errors:    u.errors,
+		ErrorRate: u.errorRate,
+		Latency:   u.latency,
+	}
+}
+
+func (u *Upstream) record(latency time.Duration, failed bool) {
+	u.statsMu.Lock()
+	defer u.statsMu.Unlock()
+
+	var failure float64
+	if failed {
+		failure = 1
+		u.errors++
+	}
+	if u.requests == 0 {
+		u.errorRate = failure
+		u.latency = latency
+	} else {
+		u.errorRate += statsAlpha * (failure - u.errorRate)
+		u.latency += time.Duration(statsAlpha * float64(latency-u.latency))
+	}
+	u.requests++
+}
+
+// balancer picks upstreams using smooth weighted round-robin, the same
+// scheme nginx uses, so that traffic is spread by weight without bursts.
+type balancer struct {
+	mu        sync.Mutex
+	upstreams []*Upstream
+	current   []int
+}
+
+func newBalancer(upstreams []*Upstream) *balancer {
+	return &balancer{
+		upstreams: upstreams,
+		current:   make([]int, len(upstreams)),
+	}
+}
+
+// order returns every upstream in the order they should be tried: the
+// weighted pick among healthy upstreams first, then the remaining healthy
+// ones by weight, then the unhealthy ones as a last resort.
+func (b *balancer) order() []*Upstream {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	total := 0
+	best := -1
+	for i, u := range b.upstreams {
+		if !u.Healthy() {
+			continue
+		}
+		b.current[i] += u.weight
+		total += u.weight
+		if best == -1 || b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+	if best != -1 {
+		b.current[best] -= total
+	}
+
+	ordered := make([]*Upstream, 0, len(b.upstreams))
+	if best != -1 {
+		ordered = append(ordered, b.upstreams[best])
+	}
+	var unhealthy []*Upstream
+	for i, u := range b.upstreams {
+		if i == best {
+			continue
+		}
+		if u.Healthy() {
+			ordered = insertByWeight(ordered, u, 1)
+		} else {
+			unhealthy = append(unhealthy, u)
+		}
+	}
+	return append(ordered, unhealthy...)
+}
+
+// insertByWeight inserts u into list after position from, keeping that
+// tail sorted by descending weight and stable for equal weights.
+func insertByWeight(list []*Upstream, u *Upstream, from int) []*Upstream {
+	if from > len(list) {
+		from = len(list)
+	}
+	i := from
+	for i < len(list) && list[i].weight >= u.weight {
+		i++
+	}
+	list = append(list, nil)
+	copy(list[i+1:], list[i:])
+	list[i] = u
+	return list
+}
@@ -0,0 +1,77 @@
+package rpc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBalancer_Weighted(t *testing.T) {
+	heavy := newUpstream(Endpoint{Name: "heavy", URL: "http://a", Weight: 3})
+	light := newUpstream(Endpoint{Name: "light", URL: "http://b", Weight: 1})
+	b := newBalancer([]*Upstream{heavy, light})
+
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		order := b.order()
+		if len(order) != 2 {
+			t.Fatalf("len(order) = %d, want 2", len(order))
+		}
+		counts[order[0].Name()]++
+	}
+
+	if counts["heavy"] != 6 || counts["light"] != 2 {
+		t.Errorf("first picks = %v, want heavy:6 light:2", counts)
+	}
+}
+
+func TestBalancer_UnhealthyLast(t *testing.T) {
+	a := newUpstream(Endpoint{Name: "a", URL: "http://a", Weight: 5})
+	b := newUpstream(Endpoint{Name: "b", URL: "http://b", Weight: 1})
+	c := newUpstream(Endpoint{Name: "c", URL: "http://c", Weight: 2})
+	a.SetHealthy(false)
+	bal := newBalancer([]*Upstream{a, b, c})
+
+	for i := 0; i < 4; i++ {
+		order := bal.order()
+		if order[len(order)-1] != a {
+			t.Errorf("last upstream = %s, want a", order[len(order)-1].Name())
+		}
+	}
+
+	b.SetHealthy(false)
+	c.SetHealthy(false)
+	if order := bal.order(); len(order) != 3 {
+		t.Errorf("len(order) = %d with all upstreams unhealthy, want 3", len(order))
+	}
+}
+
+func TestNewUpstreamDefaults(t *testing.T) {
+	u := newUpstream(Endpoint{URL: "http://localhost:8546"})
+	if u.Name() != "http://localhost:8546" {
+		t.Errorf("Name() = %q, want the URL", u.Name())
+	}
+	if u.Weight() != 1 {
+		t.Errorf("Weight() = %d, want 1", u.Weight())
+	}
+	if !u.Healthy() {
+		t.Error("new upstream should start healthy")
+	}
+}
+
+func TestUpstream_Stats(t *testing.T) {
+	u := newUpstream(Endpoint{URL: "http://localhost:8546"})
+
+	u.record(100*time.Millisecond, false)
+	u.record(100*time.Millisecond, true)
+
+	stats := u.Stats()
+	if stats.Requests != 2 || stats.Errors != 1 {
+		t.Errorf("Requests = %d, Errors = %d, want 2 and 1", stats.Requests, stats.Errors)
+	}
+	if stats.ErrorRate <= 0 || stats.ErrorRate >= 1 {
+		t.Errorf("ErrorRate = %v, want between 0 and 1", stats.ErrorRate)
+	}
+	if stats.Latency != 100*time.Millisecond {
+		t.Errorf("Latency = %v, want 100ms", stats.Latency)
+	}
+}
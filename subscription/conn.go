@@ -0,0 +1,280 @@
+package subscription
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/devlongs/geth-relay/rpc"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// ErrClosed is returned by calls on a closed connection.
+var ErrClosed = errors.New("upstream websocket closed")
+
+const (
+	writeTimeout = 10 * time.Second
+	// notificationBuffer is the number of notifications queued per
+	// subscription before new ones are dropped.
+	notificationBuffer = 128
+)
+
+// Conn is a JSON-RPC connection to an upstream WebSocket endpoint that
+// supports eth_subscribe.
+type Conn struct {
+	ws     *websocket.Conn
+	logger *zap.Logger
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]*call
+	subs    map[string]chan json.RawMessage
+	err     error
+
+	done chan struct{}
+}
+
+type call struct {
+	resp chan *message
+	// sub receives the subscription's notifications when the call is an
+	// eth_subscribe. It is registered by the read loop before the
+	// response is delivered so no notification is lost.
+	sub chan json.RawMessage
+}
+
+// message is any frame sent by the upstream: a response or a notification.
+type message struct {
+	ID     json.RawMessage   `json:"id,omitempty"`
+	Method string            `json:"method,omitempty"`
+	Params json.RawMessage   `json:"params,omitempty"`
+	Result json.RawMessage   `json:"result,omitempty"`
+	Error  *rpc.JSONRPCError `json:"error,omitempty"`
+}
+
+// Notification is the payload of an eth_subscription message.
+type Notification struct {
+	Subscription string          `json:"subscription"`
+	Result       json.RawMessage `json:"result"`
+}
+
+// NotificationMessage is an eth_subscription message sent to a subscriber.
+type NotificationMessage struct {
+	JSONRPC string       `json:"jsonrpc"`
+	Method  string       `json:"method"`
+	Params  Notification `json:"params"`
+}
+
+// NewNotification returns the message delivering result to subscription id.
+func NewNotification(id string, result json.RawMessage) *NotificationMessage {
+	return &NotificationMessage{
+		JSONRPC: "2.0",
+		Method:  "eth_subscription",
+		Params:  Notification{Subscription: id, Result: result},
+	}
+}
+
+// Dial connects to the upstream WebSocket endpoint at url.
+func Dial(ctx context.Context, url string, logger *zap.Logger) (*Conn, error) {
+	ws, _, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial upstream websocket: %w", err)
+	}
+
+	c := &Conn{
+		ws:      ws,
+		logger:  logger,
+		pending: make(map[uint64]*call),
+		subs:    make(map[string]chan json.RawMessage),
+		done:    make(chan struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+// Call sends a JSON-RPC request and returns its result. JSON-RPC errors
+// are returned as *rpc.JSONRPCError.
+func (c *Conn) Call(ctx context.Context, method string, params json.RawMessage) (json.RawMessage, error) {
+	msg, err := c.send(ctx, method, params, nil)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Result, nil
+}
+
+// Subscribe starts an upstream subscription with the given eth_subscribe
+// params and returns its ID and notification results. The channel is
+// closed when the subscription ends or the connection is lost.
+func (c *Conn) Subscribe(ctx context.Context, params json.RawMessage) (string, <-chan json.RawMessage, error) {
+	sub := make(chan json.RawMessage, notificationBuffer)
+	msg, err := c.send(ctx, "eth_subscribe", params, sub)
+	if err != nil {
+		return "", nil, err
+	}
+	var id string
+	if err := json.Unmarshal(msg.Result, &id); err != nil {
+		return "", nil, fmt.Errorf("invalid subscription id %s: %w", msg.Result, err)
+	}
+	return id, sub, nil
+}
+
+// Unsubscribe ends the upstream subscription id and closes its channel.
+func (c *Conn) Unsubscribe(ctx context.Context, id string) error {
+	c.mu.Lock()
+	if sub, ok := c.subs[id]; ok {
+		delete(c.subs, id)
+		close(sub)
+	}
+	c.mu.Unlock()
+
+	params, _ := json.Marshal([]string{id})
+	_, err := c.Call(ctx, "eth_unsubscribe", params)
+	return err
+}
+
+// Done is closed when the connection is lost or closed.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection ended, once Done is closed.
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close closes the connection, ending all of its subscriptions.
+func (c *Conn) Close() error {
+	c.writeMu.Lock()
+	c.ws.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(writeTimeout))
+	c.writeMu.Unlock()
+	return c.ws.Close()
+}
+
+func (c *Conn) send(ctx context.Context, method string, params json.RawMessage, sub chan json.RawMessage) (*message, error) {
+	cl := &call{resp: make(chan *message, 1), sub: sub}
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = cl
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+
+	req := rpc.JSONRPCRequest{JSONRPC: "2.0", Method: method, Params: params, ID: json.RawMessage(strconv.FormatUint(id, 10))}
+	c.writeMu.Lock()
+	c.ws.SetWriteDeadline(time.Now().Add(writeTimeout))
+	err := c.ws.WriteJSON(req)
+	c.writeMu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to send %s: %w", method, err)
+	}
+
+	select {
+	case msg, ok := <-cl.resp:
+		if !ok {
+			return nil, ErrClosed
+		}
+		if msg.Error != nil {
+			return nil, msg.Error
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Conn) readLoop() {
+	var err error
+	for {
+		var msg message
+		if err = c.ws.ReadJSON(&msg); err != nil {
+			break
+		}
+		if msg.Method == "eth_subscription" {
+			c.notify(msg.Params)
+			continue
+		}
+		c.respond(&msg)
+	}
+
+	c.ws.Close()
+
+	c.mu.Lock()
+	c.err = err
+	for id, cl := range c.pending {
+		close(cl.resp)
+		delete(c.pending, id)
+	}
+	for id, sub := range c.subs {
+		close(sub)
+		delete(c.subs, id)
+	}
+	c.mu.Unlock()
+	close(c.done)
+
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) && !errors.Is(err, websocket.ErrCloseSent) {
+		c.logger.Warn("upstream websocket closed", zap.Error(err))
+	}
+}
+
+func (c *Conn) respond(msg *message) {
+	id, err := strconv.ParseUint(string(msg.ID), 10, 64)
+	if err != nil {
+		c.logger.Warn("unexpected message from upstream websocket", zap.ByteString("id", msg.ID))
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cl, ok := c.pending[id]
+	if !ok {
+		return
+	}
+	if cl.sub != nil && msg.Error == nil {
+		var subID string
+		if json.Unmarshal(msg.Result, &subID) == nil {
+			c.subs[subID] = cl.sub
+		}
+	}
+	cl.resp <- msg
+}
+
+func (c *Conn) notify(params json.RawMessage) {
+	var n Notification
+	if err := json.Unmarshal(params, &n); err != nil {
+		c.logger.Warn("invalid subscription notification", zap.Error(err))
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sub, ok := c.subs[n.Subscription]
+	if !ok {
+		return
+	}
+	select {
+	case sub <- n.Result:
+	default:
+		c.logger.Warn("dropping notification for slow subscriber",
+			zap.String("subscription", n.Subscription))
+	}
+}
@@ -0,0 +1,225 @@
+package subscription
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/devlongs/geth-relay/rpc"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+)
+
+// fakeNode is an upstream WebSocket endpoint that hands out subscriptions,
+// publishes notifications to them on request and serves the blocks and
+// logs of a chain whose head can be moved.
+type fakeNode struct {
+	server *httptest.Server
+
+	mu         sync.Mutex
+	head       uint64
+	nextID     int
+	subscribes int
+	subs       map[string]*fakeNodeConn // by subscription id
+	kinds      map[string]string        // latest subscription id by kind
+	conns      []*fakeNodeConn
+	unsubs     []string
+}
+
+type fakeNodeConn struct {
+	mu sync.Mutex
+	ws *websocket.Conn
+}
+
+func (c *fakeNodeConn) write(v interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ws.WriteJSON(v)
+}
+
+func newFakeNode(t *testing.T) *fakeNode {
+	n := &fakeNode{
+		subs:  make(map[string]*fakeNodeConn),
+		kinds: make(map[string]string),
+	}
+	upgrader := websocket.Upgrader{}
+	n.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		conn := &fakeNodeConn{ws: ws}
+		n.mu.Lock()
+		n.conns = append(n.conns, conn)
+		n.mu.Unlock()
+		for {
+			var req rpc.JSONRPCRequest
+			if err := ws.ReadJSON(&req); err != nil {
+				return
+			}
+			result, rpcErr := n.handle(conn, req)
+			resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+			if rpcErr != nil {
+				resp["error"] = rpcErr
+			} else {
+				resp["result"] = result
+			}
+			conn.write(resp)
+		}
+	}))
+	t.Cleanup(n.server.Close)
+	return n
+}
+
+func (n *fakeNode) handle(conn *fakeNodeConn, req rpc.JSONRPCRequest) (interface{}, *rpc.JSONRPCError) {
+	var params []json.RawMessage
+	json.Unmarshal(req.Params, &params)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	switch req.Method {
+	case "eth_subscribe":
+		var kind string
+		json.Unmarshal(params[0], &kind)
+		n.nextID++
+		n.subscribes++
+		id := fmt.Sprintf("0x%x", n.nextID)
+		n.subs[id] = conn
+		n.kinds[kind] = id
+		return id, nil
+	case "eth_unsubscribe":
+		var id string
+		json.Unmarshal(params[0], &id)
+		n.unsubs = append(n.unsubs, id)
+		return true, nil
+	case "eth_blockNumber":
+		return rpc.EncodeQuantity(n.head), nil
+	case "eth_getBlockByNumber":
+		var number string
+		json.Unmarshal(params[0], &number)
+		num, _ := rpc.ParseQuantity(number)
+		block := fakeHead(num)
+		block["transactions"] = []string{}
+		return block, nil
+	case "eth_getLogs":
+		var filter struct {
+			FromBlock string `json:"fromBlock"`
+			ToBlock   string `json:"toBlock"`
+		}
+		json.Unmarshal(params[0], &filter)
+		from, _ := rpc.ParseQuantity(filter.FromBlock)
+		to, _ := rpc.ParseQuantity(filter.ToBlock)
+		var logs []map[string]string
+		for b := from; b <= to; b++ {
+			logs = append(logs, fakeLog(b))
+		}
+		return logs, nil
+	default:
+		return nil, &rpc.JSONRPCError{Code: rpc.MethodNotFound, Message: "method not found"}
+	}
+}
+
+func fakeHead(number uint64) map[string]interface{} {
+	return map[string]interface{}{"number": rpc.EncodeQuantity(number), "hash": fmt.Sprintf("0xh%d", number)}
+}
+
+func fakeLog(number uint64) map[string]string {
+	return map[string]string{"blockNumber": rpc.EncodeQuantity(number), "blockHash": fmt.Sprintf("0xh%d", number), "logIndex": "0x0"}
+}
+
+func (n *fakeNode) url() string {
+	return "ws" + strings.TrimPrefix(n.server.URL, "http")
+}
+
+// publish sends result to the latest subscription of kind.
+func (n *fakeNode) publish(kind string, result interface{}) {
+	n.mu.Lock()
+	id := n.kinds[kind]
+	conn := n.subs[id]
+	n.mu.Unlock()
+	b, _ := json.Marshal(result)
+	conn.write(NewNotification(id, b))
+}
+
+// drop closes every connection to the node.
+func (n *fakeNode) drop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, c := range n.conns {
+		c.ws.Close()
+	}
+	n.conns = nil
+}
+
+func TestConn_Subscribe(t *testing.T) {
+	node := newFakeNode(t)
+	logger, _ := zap.NewDevelopment()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := Dial(ctx, node.url(), logger)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	id, notifications, err := conn.Subscribe(ctx, json.RawMessage(`["newHeads"]`))
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	node.publish("newHeads", fakeHead(1))
+	select {
+	case result := <-notifications:
+		if BlockNumber("newHeads", result) != 1 {
+			t.Errorf("notification = %s, want the published head", result)
+		}
+	case <-ctx.Done():
+		t.Fatal("no notification received")
+	}
+
+	if err := conn.Unsubscribe(ctx, id); err != nil {
+		t.Fatalf("Unsubscribe() error = %v", err)
+	}
+	if _, ok := <-notifications; ok {
+		t.Error("notifications not closed after Unsubscribe()")
+	}
+}
+
+func TestConn_CallError(t *testing.T) {
+	node := newFakeNode(t)
+	logger, _ := zap.NewDevelopment()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := Dial(ctx, node.url(), logger)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+
+	_, err = conn.Call(ctx, "eth_foo", nil)
+	rpcErr, ok := err.(*rpc.JSONRPCError)
+	if !ok || rpcErr.Code != rpc.MethodNotFound {
+		t.Errorf("Call() error = %v, want a method not found error", err)
+	}
+
+	_, notifications, err := conn.Subscribe(ctx, json.RawMessage(`["newHeads"]`))
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	conn.Close()
+	<-conn.Done()
+	if _, ok := <-notifications; ok {
+		t.Error("notifications not closed after Close()")
+	}
+	if _, err := conn.Call(ctx, "eth_chainId", nil); err != ErrClosed {
+		t.Errorf("Call() after Close() error = %v, want ErrClosed", err)
+	}
+}
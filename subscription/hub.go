@@ -0,0 +1,575 @@
+package subscription
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/devlongs/geth-relay/rpc"
+	"go.uber.org/zap"
+)
+
+// ErrUnavailable is returned by Subscribe while the hub is not connected
+// to the upstream.
+var ErrUnavailable = errors.New("upstream websocket unavailable")
+
+const (
+	minBackoff  = 500 * time.Millisecond
+	maxBackoff  = 30 * time.Second
+	callTimeout = 10 * time.Second
+)
+
+// Hub multiplexes client subscriptions onto upstream subscriptions.
+// Clients subscribing with the same params share one upstream
+// subscription, and every notification is fanned out to each of them
+// under the client's own subscription ID.
+//
+// When the upstream connection is lost, the hub reconnects with backoff,
+// resubscribes and backfills the newHeads and logs missed in the gap
+// before resuming live notifications.
+type Hub struct {
+	url         string
+	logger      *zap.Logger
+	maxBackfill uint64
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+
+	mu     sync.Mutex
+	conn   *Conn // nil while disconnected
+	topics map[string]*topic
+	closed bool
+}
+
+// topic is one upstream subscription and the clients sharing it.
+type topic struct {
+	key    string
+	kind   string
+	params json.RawMessage
+	// ready is closed once the first upstream subscription is set up; err
+	// is set if that failed.
+	ready chan struct{}
+	err   error
+	// conn is the connection the topic is subscribed on, or being
+	// subscribed on, and upstreamID its subscription there.
+	conn       *Conn
+	upstreamID string
+	// lastBlock is the block the topic is caught up to: the head when it
+	// was subscribed or last backfilled, or the block of a later
+	// notification. The backfill after a reconnect starts after it.
+	lastBlock uint64
+
+	subscribers map[string]*Subscription
+}
+
+// Subscription is a client's view of a shared upstream subscription.
+type Subscription struct {
+	ID string
+
+	hub   *Hub
+	topic *topic
+	c     chan json.RawMessage
+	once  sync.Once
+	err   error
+}
+
+// C delivers the subscription's notification results. It is closed when
+// the subscription ends.
+func (s *Subscription) C() <-chan json.RawMessage {
+	return s.c
+}
+
+// Err returns why the subscription ended: nil after Unsubscribe and
+// ErrClosed if the hub stopped or the upstream rejected the subscription
+// after a reconnect.
+func (s *Subscription) Err() error {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.err
+}
+
+// Unsubscribe ends the subscription. The upstream subscription is ended
+// once its last client unsubscribes.
+func (s *Subscription) Unsubscribe() {
+	s.hub.unsubscribe(s)
+}
+
+// NewHub returns a hub for the upstream WebSocket endpoint at url. After
+// a reconnect, at most maxBackfill missed blocks are backfilled.
+func NewHub(url string, logger *zap.Logger, maxBackfill uint64) *Hub {
+	return &Hub{
+		url:         url,
+		logger:      logger,
+		maxBackfill: maxBackfill,
+		minBackoff:  minBackoff,
+		maxBackoff:  maxBackoff,
+		topics:      make(map[string]*topic),
+	}
+}
+
+// Run keeps the hub connected to the upstream until ctx is cancelled, then
+// ends every subscription.
+func (h *Hub) Run(ctx context.Context) {
+	backoff := h.minBackoff
+	for {
+		conn, err := Dial(ctx, h.url, h.logger)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			h.logger.Warn("failed to connect to upstream websocket",
+				zap.Error(err),
+				zap.Duration("retry_in", backoff))
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, h.maxBackoff)
+			continue
+		}
+		backoff = h.minBackoff
+
+		h.mu.Lock()
+		h.conn = conn
+		var resubscribe []*topic
+		for _, t := range h.topics {
+			if t.conn != conn && isClosed(t.ready) && t.err == nil {
+				t.conn = conn
+				resubscribe = append(resubscribe, t)
+			}
+		}
+		h.mu.Unlock()
+
+		if len(resubscribe) > 0 {
+			h.logger.Info("reconnected to upstream websocket",
+				zap.Int("subscriptions", len(resubscribe)))
+		}
+		for _, t := range resubscribe {
+			go h.attach(conn, t)
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-conn.Done():
+		}
+		h.mu.Lock()
+		h.conn = nil
+		h.mu.Unlock()
+		conn.Close()
+
+		if ctx.Err() != nil {
+			break
+		}
+		h.logger.Warn("lost upstream websocket, reconnecting", zap.Error(conn.Err()))
+	}
+
+	h.mu.Lock()
+	h.closed = true
+	for _, t := range h.topics {
+		h.endTopic(t)
+	}
+	h.mu.Unlock()
+}
+
+// Connected reports whether the hub is connected to the upstream.
+func (h *Hub) Connected() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.conn != nil
+}
+
+// Subscribe subscribes to the eth_subscribe params, reusing an upstream
+// subscription with the same params if there is one.
+func (h *Hub) Subscribe(ctx context.Context, params json.RawMessage) (*Subscription, error) {
+	key, kind, err := topicKey(params)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return nil, ErrClosed
+	}
+	t, ok := h.topics[key]
+	if !ok {
+		if h.conn == nil {
+			h.mu.Unlock()
+			return nil, ErrUnavailable
+		}
+		t = &topic{
+			key:         key,
+			kind:        kind,
+			params:      params,
+			ready:       make(chan struct{}),
+			conn:        h.conn,
+			subscribers: make(map[string]*Subscription),
+		}
+		h.topics[key] = t
+		go h.attach(h.conn, t)
+	}
+	sub := &Subscription{
+		ID:    newID(),
+		hub:   h,
+		topic: t,
+		c:     make(chan json.RawMessage, notificationBuffer),
+	}
+	t.subscribers[sub.ID] = sub
+	h.mu.Unlock()
+
+	select {
+	case <-t.ready:
+	case <-ctx.Done():
+		h.unsubscribe(sub)
+		return nil, ctx.Err()
+	}
+	if t.err != nil {
+		h.unsubscribe(sub)
+		return nil, t.err
+	}
+	return sub, nil
+}
+
+// attach subscribes t on conn and fans its notifications out until the
+// subscription ends. After a reconnect, the blocks missed since the topic
+// was last caught up are backfilled first.
+func (h *Hub) attach(conn *Conn, t *topic) {
+	first := !isClosed(t.ready)
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	// Taken before subscribing, so every later block is either notified
+	// or backfilled.
+	var head uint64
+	if first && h.backfills(t) {
+		head = h.headBlock(ctx, conn, t)
+	}
+	upstreamID, notifications, err := conn.Subscribe(ctx, t.params)
+	cancel()
+
+	h.mu.Lock()
+	if err != nil && first {
+		t.err = err
+		delete(h.topics, t.key)
+		h.mu.Unlock()
+		close(t.ready)
+		h.logger.Warn("failed to subscribe upstream",
+			zap.ByteString("params", t.params),
+			zap.Error(err))
+		return
+	}
+	if err != nil {
+		// A lost connection is retried on the next one; anything else
+		// means the upstream no longer accepts the subscription.
+		if !isClosed(conn.done) {
+			h.endTopic(t)
+		}
+		h.mu.Unlock()
+		h.logger.Warn("failed to resubscribe upstream",
+			zap.ByteString("params", t.params),
+			zap.Error(err))
+		return
+	}
+	// Every client may have given up while the subscription was set up.
+	abandoned := h.topics[t.key] != t || len(t.subscribers) == 0
+	if abandoned {
+		if h.topics[t.key] == t {
+			delete(h.topics, t.key)
+		}
+	} else {
+		t.upstreamID = upstreamID
+		t.lastBlock = max(t.lastBlock, head)
+	}
+	h.mu.Unlock()
+	if first {
+		close(t.ready)
+	}
+	if abandoned {
+		conn.Unsubscribe(context.Background(), upstreamID)
+		return
+	}
+
+	var seen map[string]bool
+	if first {
+		h.logger.Debug("upstream subscription started",
+			zap.ByteString("params", t.params),
+			zap.String("subscription", upstreamID))
+	} else {
+		seen = h.backfill(conn, t)
+	}
+
+	for result := range notifications {
+		if seen[notificationKey(t.kind, result)] {
+			continue
+		}
+		h.deliver(t, result)
+	}
+}
+
+// endTopic ends the subscriptions of t. h.mu must be held.
+func (h *Hub) endTopic(t *topic) {
+	if h.topics[t.key] == t {
+		delete(h.topics, t.key)
+	}
+	for id, sub := range t.subscribers {
+		sub.err = ErrClosed
+		sub.once.Do(func() { close(sub.c) })
+		delete(t.subscribers, id)
+	}
+}
+
+func (h *Hub) deliver(t *topic, result json.RawMessage) {
+	block := BlockNumber(t.kind, result)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t.lastBlock = max(t.lastBlock, block)
+	for _, sub := range t.subscribers {
+		select {
+		case sub.c <- result:
+		default:
+			h.logger.Warn("dropping notification for slow subscriber",
+				zap.String("subscription", sub.ID))
+		}
+	}
+}
+
+// backfill delivers the newHeads or logs of t between the block it was
+// caught up to and the current head. It returns the keys of what it delivered so
+// live notifications queued meanwhile are not delivered twice.
+func (h *Hub) backfill(conn *Conn, t *topic) map[string]bool {
+	h.mu.Lock()
+	from := t.lastBlock + 1
+	h.mu.Unlock()
+	if from == 1 || !h.backfills(t) {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+
+	head := h.headBlock(ctx, conn, t)
+	if head < from {
+		return nil
+	}
+	if head-from+1 > h.maxBackfill {
+		h.logger.Warn("subscription gap too large to backfill completely",
+			zap.String("kind", t.kind),
+			zap.Uint64("missed", head-from+1),
+			zap.Uint64("max_backfill", h.maxBackfill))
+		from = head - h.maxBackfill + 1
+	}
+
+	var results []json.RawMessage
+	var err error
+	if t.kind == "newHeads" {
+		results, err = FetchHeads(ctx, conn, from, head)
+	} else {
+		results, err = FetchLogs(ctx, conn, t.params, from, head)
+	}
+	if err != nil {
+		h.logger.Warn("failed to backfill subscription", zap.String("kind", t.kind), zap.Error(err))
+	}
+
+	seen := make(map[string]bool, len(results))
+	for _, result := range results {
+		seen[notificationKey(t.kind, result)] = true
+		h.deliver(t, result)
+	}
+	if err == nil {
+		h.mu.Lock()
+		t.lastBlock = max(t.lastBlock, head)
+		h.mu.Unlock()
+	}
+	h.logger.Info("backfilled subscription",
+		zap.String("kind", t.kind),
+		zap.Uint64("from", from),
+		zap.Uint64("to", head),
+		zap.Int("notifications", len(results)))
+	return seen
+}
+
+// backfills reports whether t is backfilled after a reconnect.
+func (h *Hub) backfills(t *topic) bool {
+	return h.maxBackfill > 0 && (t.kind == "newHeads" || t.kind == "logs")
+}
+
+// headBlock returns the upstream's head block number, or zero if it is
+// unknown.
+func (h *Hub) headBlock(ctx context.Context, conn *Conn, t *topic) uint64 {
+	raw, err := conn.Call(ctx, "eth_blockNumber", nil)
+	if err == nil {
+		var head uint64
+		if head, err = rpc.DecodeQuantity(raw); err == nil {
+			return head
+		}
+	}
+	h.logger.Warn("failed to get upstream head block", zap.String("kind", t.kind), zap.Error(err))
+	return 0
+}
+
+// Caller sends a JSON-RPC request and returns its result.
+type Caller interface {
+	Call(ctx context.Context, method string, params json.RawMessage) (json.RawMessage, error)
+}
+
+// CallerFunc adapts a function to a Caller.
+type CallerFunc func(ctx context.Context, method string, params json.RawMessage) (json.RawMessage, error)
+
+// Call calls f.
+func (f CallerFunc) Call(ctx context.Context, method string, params json.RawMessage) (json.RawMessage, error) {
+	return f(ctx, method, params)
+}
+
+// FetchHeads returns the headers of blocks from to to, as newHeads
+// notifications carry them.
+func FetchHeads(ctx context.Context, c Caller, from, to uint64) ([]json.RawMessage, error) {
+	heads := make([]json.RawMessage, 0, to-from+1)
+	for n := from; n <= to; n++ {
+		params, _ := json.Marshal([]interface{}{rpc.EncodeQuantity(n), false})
+		raw, err := c.Call(ctx, "eth_getBlockByNumber", params)
+		if err != nil {
+			return heads, err
+		}
+		header, err := Header(raw)
+		if err != nil {
+			return heads, fmt.Errorf("block %d: %w", n, err)
+		}
+		heads = append(heads, header)
+	}
+	return heads, nil
+}
+
+// Header strips a block as returned by eth_getBlockByNumber down to the
+// header a newHeads notification carries.
+func Header(block json.RawMessage) (json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(block, &fields); err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return nil, errors.New("block not found")
+	}
+	for _, field := range []string{"transactions", "uncles", "size", "withdrawals", "totalDifficulty"} {
+		delete(fields, field)
+	}
+	return json.Marshal(fields)
+}
+
+// FetchLogs returns the logs matching the filter of a logs subscription in
+// blocks from to to.
+func FetchLogs(ctx context.Context, c Caller, params json.RawMessage, from, to uint64) ([]json.RawMessage, error) {
+	var args []json.RawMessage
+	json.Unmarshal(params, &args)
+	filter := make(map[string]json.RawMessage)
+	if len(args) > 1 {
+		if err := json.Unmarshal(args[1], &filter); err != nil {
+			return nil, fmt.Errorf("invalid logs filter: %w", err)
+		}
+	}
+	filter["fromBlock"], _ = json.Marshal(rpc.EncodeQuantity(from))
+	filter["toBlock"], _ = json.Marshal(rpc.EncodeQuantity(to))
+
+	query, _ := json.Marshal([]interface{}{filter})
+	raw, err := c.Call(ctx, "eth_getLogs", query)
+	if err != nil {
+		return nil, err
+	}
+	var logs []json.RawMessage
+	if err := json.Unmarshal(raw, &logs); err != nil {
+		return nil, fmt.Errorf("invalid eth_getLogs result: %w", err)
+	}
+	return logs, nil
+}
+
+// BlockNumber returns the block a newHeads or logs notification is about.
+func BlockNumber(kind string, result json.RawMessage) uint64 {
+	var fields struct {
+		Number      string `json:"number"`
+		BlockNumber string `json:"blockNumber"`
+	}
+	if (kind != "newHeads" && kind != "logs") || json.Unmarshal(result, &fields) != nil {
+		return 0
+	}
+	n, _ := rpc.ParseQuantity(fields.Number + fields.BlockNumber)
+	return n
+}
+
+// notificationKey identifies a head by its hash and a log by its block
+// hash and index.
+func notificationKey(kind string, result json.RawMessage) string {
+	var fields struct {
+		Hash      string `json:"hash"`
+		BlockHash string `json:"blockHash"`
+		LogIndex  string `json:"logIndex"`
+	}
+	json.Unmarshal(result, &fields)
+	if kind == "newHeads" {
+		return strings.ToLower(fields.Hash)
+	}
+	return strings.ToLower(fields.BlockHash) + "/" + fields.LogIndex
+}
+
+func (h *Hub) unsubscribe(sub *Subscription) {
+	h.mu.Lock()
+	t := sub.topic
+	delete(t.subscribers, sub.ID)
+	sub.once.Do(func() { close(sub.c) })
+
+	last := len(t.subscribers) == 0 && h.topics[t.key] == t && isClosed(t.ready)
+	if last {
+		delete(h.topics, t.key)
+	}
+	conn, upstreamID := t.conn, t.upstreamID
+	h.mu.Unlock()
+
+	if last && t.err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+		defer cancel()
+		if err := conn.Unsubscribe(ctx, upstreamID); err != nil {
+			h.logger.Debug("failed to unsubscribe upstream",
+				zap.String("subscription", upstreamID),
+				zap.Error(err))
+		}
+	}
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// topicKey identifies subscriptions that can share an upstream
+// subscription: object keys are sorted and hex strings lowercased. It also
+// returns the subscription kind, such as newHeads.
+func topicKey(params json.RawMessage) (key, kind string, err error) {
+	dec := json.NewDecoder(bytes.NewReader(params))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return "", "", &rpc.JSONRPCError{Code: rpc.InvalidParams, Message: fmt.Sprintf("invalid subscription params: %v", err)}
+	}
+	if args, ok := v.([]interface{}); ok && len(args) > 0 {
+		kind, _ = args[0].(string)
+	}
+	b, err := json.Marshal(rpc.LowerHex(v))
+	if err != nil {
+		return "", "", err
+	}
+	return string(b), kind, nil
+}
+
+// newID returns a random subscription ID in geth's format.
+func newID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return "0x" + hex.EncodeToString(b[:])
+}
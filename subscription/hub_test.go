@@ -0,0 +1,203 @@
+package subscription
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestTopicKey(t *testing.T) {
+	a, kind, err := topicKey(json.RawMessage(`["logs",{"topics":["0xABC"],"address":"0xDef"}]`))
+	if err != nil {
+		t.Fatalf("topicKey() error = %v", err)
+	}
+	if kind != "logs" {
+		t.Errorf("kind = %q, want logs", kind)
+	}
+	b, _, _ := topicKey(json.RawMessage(`["logs", {"address":"0xdef","topics":["0xabc"]}]`))
+	if a != b {
+		t.Errorf("topicKey() = %s and %s, want equal keys", a, b)
+	}
+	c, _, _ := topicKey(json.RawMessage(`["newHeads"]`))
+	if a == c {
+		t.Error("different subscriptions share a key")
+	}
+	if _, _, err := topicKey(nil); err == nil {
+		t.Error("topicKey(nil) should fail")
+	}
+}
+
+func startHub(t *testing.T, node *fakeNode) (*Hub, context.CancelFunc) {
+	logger, _ := zap.NewDevelopment()
+	hub := NewHub(node.url(), logger, 128)
+	hub.minBackoff = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	go hub.Run(ctx)
+	waitFor(t, hub.Connected)
+	return hub, cancel
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func receive(t *testing.T, sub *Subscription) json.RawMessage {
+	t.Helper()
+	select {
+	case result, ok := <-sub.C():
+		if !ok {
+			t.Fatalf("subscription %s ended: %v", sub.ID, sub.Err())
+		}
+		return result
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no notification for %s", sub.ID)
+		return nil
+	}
+}
+
+func TestHub_Subscribe(t *testing.T) {
+	node := newFakeNode(t)
+	hub, stop := startHub(t, node)
+	ctx := context.Background()
+
+	a, err := hub.Subscribe(ctx, json.RawMessage(`["logs",{"address":"0xABC"}]`))
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	b, err := hub.Subscribe(ctx, json.RawMessage(`["logs",{"address":"0xabc"}]`))
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	other, err := hub.Subscribe(ctx, json.RawMessage(`["newHeads"]`))
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	if a.ID == b.ID {
+		t.Error("subscribers share a subscription id")
+	}
+	node.mu.Lock()
+	subscribes := node.subscribes
+	node.mu.Unlock()
+	if subscribes != 2 {
+		t.Fatalf("upstream subscriptions = %d, want 2", subscribes)
+	}
+
+	node.publish("logs", fakeLog(1))
+	for _, sub := range []*Subscription{a, b} {
+		if got := BlockNumber("logs", receive(t, sub)); got != 1 {
+			t.Errorf("notification block = %d, want 1", got)
+		}
+	}
+
+	a.Unsubscribe()
+	if _, ok := <-a.C(); ok {
+		t.Error("C() not closed after Unsubscribe()")
+	}
+	if a.Err() != nil {
+		t.Errorf("Err() after Unsubscribe() = %v, want nil", a.Err())
+	}
+
+	// Stopping the hub ends every subscription.
+	stop()
+	for _, sub := range []*Subscription{b, other} {
+		for range sub.C() {
+		}
+		if sub.Err() != ErrClosed {
+			t.Errorf("Err() = %v, want ErrClosed", sub.Err())
+		}
+	}
+	if _, err := hub.Subscribe(ctx, json.RawMessage(`["newHeads"]`)); err != ErrClosed {
+		t.Errorf("Subscribe() after stop error = %v, want ErrClosed", err)
+	}
+}
+
+func TestHub_ReconnectBackfill(t *testing.T) {
+	node := newFakeNode(t)
+	hub, stop := startHub(t, node)
+	defer stop()
+	ctx := context.Background()
+
+	heads, err := hub.Subscribe(ctx, json.RawMessage(`["newHeads"]`))
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	logs, err := hub.Subscribe(ctx, json.RawMessage(`["logs",{}]`))
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+
+	node.publish("newHeads", fakeHead(10))
+	node.publish("logs", fakeLog(10))
+	receive(t, heads)
+	receive(t, logs)
+
+	// Blocks 11 to 13 are produced while the relay is disconnected.
+	node.mu.Lock()
+	node.head = 13
+	node.mu.Unlock()
+	node.drop()
+	waitFor(t, func() bool {
+		node.mu.Lock()
+		defer node.mu.Unlock()
+		return node.subscribes == 4
+	})
+
+	for _, sub := range []struct {
+		kind string
+		s    *Subscription
+	}{{"newHeads", heads}, {"logs", logs}} {
+		for want := uint64(11); want <= 13; want++ {
+			result := receive(t, sub.s)
+			if got := BlockNumber(sub.kind, result); got != want {
+				t.Fatalf("%s backfill block = %d, want %d", sub.kind, got, want)
+			}
+			if sub.kind == "newHeads" && json.Valid(result) {
+				var header map[string]json.RawMessage
+				json.Unmarshal(result, &header)
+				if _, ok := header["transactions"]; ok {
+					t.Error("backfilled head carries transactions")
+				}
+			}
+		}
+	}
+
+	// Live notifications resume, skipping what the backfill delivered.
+	node.publish("newHeads", fakeHead(13))
+	node.publish("newHeads", fakeHead(14))
+	if got := BlockNumber("newHeads", receive(t, heads)); got != 14 {
+		t.Errorf("live head = %d, want 14", got)
+	}
+}
+
+func TestHub_ReconnectBackfillWithoutNotifications(t *testing.T) {
+	node := newFakeNode(t)
+	node.head = 10
+	hub, stop := startHub(t, node)
+	defer stop()
+
+	// No log has matched the filter by the time the connection drops.
+	logs, err := hub.Subscribe(context.Background(), json.RawMessage(`["logs",{"address":"0xabc"}]`))
+	if err != nil {
+		t.Fatalf("Subscribe() error = %v", err)
+	}
+	node.mu.Lock()
+	node.head = 12
+	node.mu.Unlock()
+	node.drop()
+
+	for want := uint64(11); want <= 12; want++ {
+		if got := BlockNumber("logs", receive(t, logs)); got != want {
+			t.Fatalf("logs backfill block = %d, want %d", got, want)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package tracing
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+)
+
+func TestSetup_FileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	shutdown, err := Setup(context.Background(), Config{
+		ServiceName: "geth-relay",
+		Version:     "test",
+		Exporter:    ExporterFile,
+		File:        path,
+		SampleRatio: 1,
+	})
+	if err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+
+	_, span := otel.Tracer("test").Start(context.Background(), "Proxy.HandleRequest")
+	span.SetAttributes(MethodKey.String("eth_chainId"))
+	span.End()
+
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read spans: %v", err)
+	}
+	for _, want := range []string{`"Name":"Proxy.HandleRequest"`, `"eth_chainId"`, `"geth-relay"`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("exported spans do not contain %s", want)
+		}
+	}
+}
+
+func TestSetup_UnknownExporter(t *testing.T) {
+	if _, err := Setup(context.Background(), Config{Exporter: "zipkin"}); err == nil {
+		t.Error("Setup() error = nil, want error for unknown exporter")
+	}
+}